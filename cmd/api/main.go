@@ -0,0 +1,9 @@
+package main
+
+import (
+	"postchi/internal/app"
+)
+
+func main() {
+	app.Run(app.RoleAPI)
+}
@@ -0,0 +1,148 @@
+// Command migrate applies the versioned schema migrations in pkg/db/migrations
+// to DB_DSN. The services refuse to start until the schema is current. Only
+// DB_DSN is required; DB_DRIVER, LOG_LEVEL and LOG_REDACT_PII are optional.
+//
+//	migrate up [n]    apply the next n pending migrations, all by default
+//	migrate down n    revert the last n applied migrations
+//	migrate status    print the applied version and the pending migrations
+//	migrate force v   record version v as applied without running anything
+//
+// Runs hold a database lock, so several deploy jobs can start at once.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"postchi/pkg/db"
+	"postchi/pkg/db/migrations"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+)
+
+func main() {
+	lockTimeout := flag.Duration("lock-timeout", time.Minute, "how long to wait for another migration run")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: migrate [-lock-timeout d] up [n] | down n | status | force version")
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	envs := env.ReadDbEnvs()
+	log, err := logger.Init(&envs)
+	if err != nil {
+		panic("logger not initialized with err " + err.Error())
+	}
+	defer log.Sync()
+
+	if err := run(log, &envs, *lockTimeout, args); err != nil {
+		log.Error("[migrate] failed", logger.String("command", args[0]), logger.Err(err))
+		log.Sync()
+		os.Exit(1)
+	}
+}
+
+func run(log logger.LoggerInterface, envs *env.Envs, lockTimeout time.Duration, args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if envs.DB_DSN == "" {
+		return fmt.Errorf("DB_DSN is not set")
+	}
+	conn, err := db.Open(envs.DB_DRIVER, envs.DB_DSN)
+	if err != nil {
+		return err
+	}
+	if sqlDB, err := conn.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	runner, err := migrations.New(conn)
+	if err != nil {
+		return err
+	}
+	runner.LockTimeout = lockTimeout
+
+	switch args[0] {
+	case "up":
+		steps, err := count(args, 0)
+		if err != nil {
+			return err
+		}
+		applied, err := runner.Up(ctx, steps)
+		for _, m := range applied {
+			log.Info("[migrate] applied", logger.Uint("version", m.Version), logger.String("name", m.Name))
+		}
+		if err != nil {
+			return err
+		}
+		log.Info("[migrate] schema up to date", logger.Int("applied", len(applied)), logger.Uint("version", runner.Latest()))
+	case "down":
+		steps, err := count(args, -1)
+		if err != nil {
+			return err
+		}
+		reverted, err := runner.Down(ctx, steps)
+		for _, m := range reverted {
+			log.Info("[migrate] reverted", logger.Uint("version", m.Version), logger.String("name", m.Name))
+		}
+		return err
+	case "status":
+		version, dirty, err := runner.Version(ctx)
+		if err != nil {
+			return err
+		}
+		pending, err := runner.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("version %d (latest %d)", version, runner.Latest())
+		if dirty {
+			fmt.Print(", dirty")
+		}
+		fmt.Println()
+		for _, m := range pending {
+			fmt.Printf("pending %04d_%s\n", m.Version, m.Name)
+		}
+	case "force":
+		if len(args) != 2 {
+			return fmt.Errorf("force needs a version")
+		}
+		version, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		if err := runner.Force(ctx, uint(version)); err != nil {
+			return err
+		}
+		log.Info("[migrate] version forced", logger.Uint("version", uint(version)))
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	return nil
+}
+
+// count parses the optional step count after the command; fallback -1 makes
+// it required.
+func count(args []string, fallback int) (int, error) {
+	if len(args) < 2 {
+		if fallback < 0 {
+			return 0, fmt.Errorf("%s needs a count", args[0])
+		}
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid count %q", args[1])
+	}
+	return n, nil
+}
@@ -0,0 +1,42 @@
+// Command rotate-content-keys moves every stored message onto the current key
+// of CONTENT_KEY_FILE, encrypting rows stored before encryption was enabled.
+// Run it after adding a new current key; old keys can be removed from the file
+// once it finishes. Retention archives are sealed under RETENTION_ARCHIVE_KEY_FILE
+// and never need the content keys.
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"postchi/internal/app"
+	"postchi/pkg/logger"
+)
+
+func main() {
+	batch := flag.Int("batch", 500, "rows per batch")
+	pause := flag.Duration("pause", 100*time.Millisecond, "pause between batches")
+	flag.Parse()
+
+	a := app.Bootstrap()
+	defer a.Db.Close()
+
+	total := 0
+	for {
+		n, err := a.Db.RewrapSmsContent(*batch)
+		total += n
+		if err != nil {
+			a.Logger.Error("[rotate] batch failed", logger.Int("rewrapped", total), logger.Err(err))
+			a.Logger.Sync()
+			os.Exit(1)
+		}
+		if n == 0 {
+			break
+		}
+		a.Logger.Info("[rotate] batch done", logger.Int("rewrapped", total))
+		time.Sleep(*pause)
+	}
+	a.Logger.Info("[rotate] finished", logger.Int("rewrapped", total))
+	a.Logger.Sync()
+}
@@ -0,0 +1,176 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"postchi/internal/sms"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+)
+
+const (
+	notifyTimeout = 10 * time.Second
+	// queueSize bounds pending checks; past it checks are dropped, which only
+	// delays an alert until the next debit re-checks the service
+	queueSize = 256
+)
+
+type LowBalanceEvent struct {
+	Event     string `json:"event"`
+	UserId    uint   `json:"user_id"`
+	ServiceId uint   `json:"service_id"`
+	Credits   uint64 `json:"credits"`
+	Threshold uint64 `json:"threshold"`
+	Time      int64  `json:"time"`
+}
+
+type NotifierInterface interface {
+	// CheckLowBalance notifies the owner of serviceId if its credits just
+	// dropped below the configured threshold. It never blocks the caller; the
+	// check runs on the notifier's worker.
+	CheckLowBalance(serviceId uint)
+	// Start runs the worker that handles queued checks until ctx is cancelled.
+	Start(ctx context.Context)
+}
+
+type Notifier struct {
+	Envs   *env.Envs
+	Logger logger.LoggerInterface
+	Db     db.DataBaseInterface
+	client *http.Client
+	queue  chan uint
+}
+
+func NotifierInit(l logger.LoggerInterface, e *env.Envs, d db.DataBaseInterface) NotifierInterface {
+	return &Notifier{Envs: e, Logger: l, Db: d, client: newWebhookClient(),
+		queue: make(chan uint, queueSize)}
+}
+
+func (n *Notifier) CheckLowBalance(serviceId uint) {
+	select {
+	case n.queue <- serviceId:
+	default:
+		n.Logger.Warn("[alerts] check queue full, dropping check", logger.ServiceID(serviceId))
+	}
+}
+
+func (n *Notifier) Start(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case serviceId := <-n.queue:
+			n.check(serviceId)
+		}
+	}
+}
+
+func (n *Notifier) check(serviceId uint) {
+	defer func() {
+		if r := recover(); r != nil {
+			n.Logger.Error("[alerts] recovered from panic", logger.Any("panic", r))
+		}
+	}()
+
+	svc, crossed, err := n.Db.ClaimLowBalanceAlert(serviceId)
+	if err != nil {
+		n.Logger.Error("[alerts] low balance check failed", logger.ServiceID(serviceId), logger.Err(err))
+		return
+	}
+	if !crossed {
+		return
+	}
+
+	evt := LowBalanceEvent{
+		Event:     "service.low_balance",
+		UserId:    svc.UserID,
+		ServiceId: svc.ID,
+		Credits:   svc.Credits,
+		Threshold: svc.LowBalanceThreshold,
+		Time:      time.Now().Unix(),
+	}
+	n.Logger.Warn("[alerts] credits below threshold", logger.ServiceID(evt.ServiceId),
+		logger.Any("credits", evt.Credits), logger.Any("threshold", evt.Threshold))
+	n.dispatch(svc, evt)
+}
+
+func (n *Notifier) dispatch(svc db.Service, evt LowBalanceEvent) {
+	text := fmt.Sprintf("postchi: service %d has %d credits left (threshold %d)", evt.ServiceId, evt.Credits, evt.Threshold)
+
+	if svc.AlertWebhookUrl != "" {
+		if err := n.sendWebhook(svc.AlertWebhookUrl, evt); err != nil {
+			n.Logger.Error("[alerts] webhook failed", logger.ServiceID(evt.ServiceId), logger.Err(err))
+		}
+	}
+	if svc.AlertEmail != "" {
+		if err := n.sendEmail(svc.AlertEmail, "Low balance on service "+fmt.Sprint(evt.ServiceId), text); err != nil {
+			n.Logger.Error("[alerts] email failed", logger.ServiceID(evt.ServiceId), logger.Err(err))
+		}
+	}
+	if svc.AlertSmsReceptor != "" {
+		if err := n.sendSms(svc.AlertSmsReceptor, text); err != nil {
+			n.Logger.Error("[alerts] sms failed", logger.ServiceID(evt.ServiceId), logger.Err(err))
+		}
+	}
+}
+
+func (n *Notifier) sendWebhook(url string, evt LowBalanceEvent) error {
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n *Notifier) sendEmail(to string, subject string, text string) error {
+	if n.Envs.SMTP_ADDR == "" || n.Envs.SMTP_FROM == "" {
+		return fmt.Errorf("smtp is not configured")
+	}
+	// addresses stored before validation was added may still be malformed
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid alert email: %w", err)
+	}
+	var auth smtp.Auth
+	if n.Envs.SMTP_USERNAME != "" {
+		host := strings.Split(n.Envs.SMTP_ADDR, ":")[0]
+		auth = smtp.PlainAuth("", n.Envs.SMTP_USERNAME, n.Envs.SMTP_PASSWORD, host)
+	}
+	msg := "From: " + n.Envs.SMTP_FROM + "\r\n" +
+		"To: " + rcpt.String() + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" + text + "\r\n"
+	return smtp.SendMail(n.Envs.SMTP_ADDR, auth, n.Envs.SMTP_FROM, []string{rcpt.Address}, []byte(msg))
+}
+
+func (n *Notifier) sendSms(to string, text string) error {
+	providerName := n.Envs.ALERT_SMS_PROVIDER
+	if providerName == "" {
+		providerName = "kavenegar"
+	}
+	prov, err := sms.NewProvider(n.Envs, providerName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	_, _, err = sms.NewService(prov).Send(ctx, to, text)
+	return err
+}
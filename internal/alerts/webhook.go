@@ -0,0 +1,74 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var ErrWebhookAddress = errors.New("webhook_url must resolve to a public address")
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), internal to
+// the provider's network like the private ranges.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP reports whether ip may be the target of a webhook. Loopback,
+// private, link-local (which holds cloud metadata endpoints), unspecified and
+// multicast addresses all reach into the server's own network.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// CheckWebhookURL validates a webhook url when it is configured: it must be
+// http(s) and its host must only resolve to public addresses. The sending
+// client checks the address again on every connection, since DNS can change.
+func CheckWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("webhook_url must be an http(s) url")
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("webhook_url host does not resolve: %w", err)
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return ErrWebhookAddress
+		}
+	}
+	return nil
+}
+
+// newWebhookClient returns a client that refuses to connect to non-public
+// addresses, including after redirects. It ignores proxy settings so the
+// check applies to the webhook host itself.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: notifyTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return ErrWebhookAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: notifyTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: notifyTimeout,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,306 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"postchi/internal/alerts"
+	"postchi/internal/export"
+	"postchi/internal/handlers"
+	"postchi/internal/health"
+	"postchi/internal/lifecycle"
+	"postchi/internal/metrics"
+	"postchi/internal/outbox"
+	"postchi/internal/pricing"
+	"postchi/internal/privacy"
+	"postchi/internal/quota"
+	"postchi/internal/ratelimit"
+	"postchi/internal/reports"
+	"postchi/internal/retention"
+	router "postchi/internal/routers"
+	"postchi/internal/tracing"
+	"postchi/internal/worker"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/envelope"
+	"postchi/pkg/kafka"
+	"postchi/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	fiber_logger "github.com/gofiber/fiber/v2/middleware/logger"
+)
+
+const (
+	RoleAPI    = "api"
+	RoleWorker = "worker"
+	RoleAll    = "all"
+)
+
+// App holds the dependencies shared by every process role.
+type App struct {
+	Envs    *env.Envs
+	Logger  logger.LoggerInterface
+	Metrics *metrics.Metrics
+	Db      db.DataBaseInterface
+	Health  *health.Registry
+}
+
+// Run bootstraps the shared dependencies, starts the given role and blocks
+// until shutdown. An empty role falls back to APP_ROLE and then to running API
+// and worker together. The process exits non-zero if anything failed to stop.
+func Run(role string) {
+	a := Bootstrap()
+	if role == "" {
+		role = a.Envs.APP_ROLE
+	}
+	if role == "" {
+		role = RoleAll
+	}
+	a.Logger.Info("[app] starting", logger.String("role", role))
+
+	m := lifecycle.ManagerInit(a.Logger, time.Duration(a.Envs.SHUTDOWN_TIMEOUT)*time.Second)
+
+	stopTracing, err := tracing.Init(a.Envs, "postchi-"+role)
+	if err != nil {
+		a.Logger.Error("[app] tracing init failed", logger.Err(err))
+		panic("tracing not initialized with err " + err.Error())
+	}
+	// flushes spans of everything stopped before it
+	m.Register("tracing", stopTracing)
+	// stopped last, after everything that uses it
+	m.Register("database", func(ctx context.Context) error { return a.Db.Close() })
+
+	a.StartMetrics(m)
+
+	switch role {
+	case RoleAPI:
+		a.StartAPI(m)
+	case RoleWorker:
+		a.StartWorker(m)
+	case RoleAll:
+		a.StartWorker(m)
+		a.StartAPI(m)
+	default:
+		panic("unknown role " + role + ", expected api, worker or all")
+	}
+
+	code := m.Wait()
+	a.Logger.Sync()
+	os.Exit(code)
+}
+
+func Bootstrap() *App {
+	envs := env.ReadEnvs()
+	log, err := logger.Init(&envs)
+	if err != nil {
+		panic("logger not initialized with err " + err.Error())
+	}
+	log.Info("[app] postchi service started")
+	for _, w := range envs.Warnings {
+		log.Warn("[app] deprecated setting", logger.String("warning", w))
+	}
+	metric := metrics.InitMetrics()
+
+	var sealer *envelope.Sealer
+	if envs.CONTENT_KEY_FILE != "" {
+		keys, err := envelope.LoadKeyFile(envs.CONTENT_KEY_FILE)
+		if err != nil {
+			log.Error("[app] content key file load failed", logger.Err(err))
+			panic("cannot run without content keys: " + err.Error())
+		}
+		sealer = envelope.SealerInit(keys)
+	}
+
+	DbClient, err := db.Init(envs.DB_DRIVER, envs.DB_DSN, sealer)
+	if err != nil {
+		log.Error("[app] db init failed", logger.Err(err))
+		panic("mian cannot run db not initialized with err " + err.Error())
+	}
+
+	healthRegistry := health.RegistryInit(time.Duration(envs.HEALTH_CACHE_TTL) * time.Second)
+	healthRegistry.Register("database", true, health.DatabaseCheck(DbClient))
+
+	return &App{Envs: &envs, Logger: log, Metrics: metric, Db: DbClient, Health: healthRegistry}
+}
+
+// StartMetrics serves /metrics, /health, /livez and /readyz on
+// PROMETHEUS_PORT, so roles without Fiber still expose them.
+func (a *App) StartMetrics(m *lifecycle.Manager) {
+	srv := metrics.NewMetricsServer(a.Envs.PROMETHEUS_PORT, map[string]http.Handler{
+		"/livez":  a.Health.LivenessHandler(),
+		"/readyz": a.Health.ReadinessHandler(),
+	})
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.Fail("metrics server", err)
+		}
+	}()
+	m.Register("metrics server", srv.Shutdown)
+}
+
+// StartAPI serves the HTTP API, relays the outbox to Kafka and writes async
+// message exports. It does not consume any topic.
+func (a *App) StartAPI(m *lifecycle.Manager) {
+	kafkaWriterClient, err := kafka.Init(a.Envs.KAFKA_BROKERS, a.Envs.KAFKA_TOPIC_SMS)
+	if err != nil {
+		a.Logger.Error("[api] kafka init failed", logger.Err(err))
+		panic("api cannot run kafka not initialized with err " + err.Error())
+	}
+	m.Register("kafka writer", func(ctx context.Context) error { return kafkaWriterClient.Close() })
+	a.registerDependencyChecks(kafkaWriterClient)
+
+	relay := outbox.RelayInit(a.Logger, a.Db, kafkaWriterClient)
+	runBackground(m, "outbox relay", relay.Start)
+
+	pricer := pricing.PricerInit(a.Envs, a.Db)
+	if err := pricer.Reload(); err != nil {
+		a.Logger.Warn("[api] price table load failed", logger.Err(err))
+	}
+
+	notifier := alerts.NotifierInit(a.Logger, a.Envs, a.Db)
+	runBackground(m, "alert notifier", notifier.Start)
+
+	masker, err := privacy.MaskerInit(a.Envs)
+	if err != nil {
+		a.Logger.Error("[api] privacy config invalid", logger.Err(err))
+		panic("api cannot run with invalid privacy config " + err.Error())
+	}
+
+	userHandler := handlers.UserHandlerInit(a.Logger, a.Envs, a.Metrics, a.Db, notifier, masker)
+	smsHandler := handlers.SmsHandlerInit(a.Logger, a.Envs, a.Metrics, kafkaWriterClient, a.Db, pricer, notifier)
+	priceHandler := handlers.PriceHandlerInit(a.Logger, a.Envs, a.Metrics, a.Db, pricer)
+	rateLimitHandler := handlers.RateLimitHandlerInit(a.Logger, a.Envs, a.Metrics, a.Db)
+	exportHandler := handlers.ExportHandlerInit(a.Logger, a.Envs, a.Metrics, a.Db, masker)
+	reportHandler := handlers.ReportHandlerInit(a.Logger, a.Envs, a.Metrics, a.Db)
+
+	exports := export.RunnerInit(a.Logger, a.Db, masker, a.Envs.EXPORT_DIR,
+		time.Duration(a.Envs.EXPORT_INTERVAL)*time.Second, a.Envs.EXPORT_BATCH,
+		time.Duration(a.Envs.EXPORT_TTL)*time.Second)
+	runBackground(m, "export runner", exports.Start)
+
+	quotaStore, err := quota.NewStore(a.Envs, a.Logger, a.Db)
+	if err != nil {
+		a.Logger.Error("[api] quota config invalid", logger.Err(err))
+		panic("api cannot run with invalid quota config " + err.Error())
+	}
+	quotaLimiter := quota.LimiterInit(a.Logger, a.Db, quotaStore)
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(tracing.FiberMiddleware())
+	app.Use(logger.RequestIDMiddleware())
+	app.Use(fiber_logger.New(fiber_logger.Config{
+		Format: "${time} | ${status} | ${latency} | ${ip} | ${method} | ${path} | ${respHeader:X-Request-ID} | ${error}\n",
+	}))
+	app.Use(a.Metrics.FiberMiddleware())
+	router.SetupRoutes(app, userHandler, smsHandler, priceHandler, rateLimitHandler, exportHandler, reportHandler, quotaLimiter, a.Health)
+
+	go func() {
+		if err := app.Listen(fmt.Sprintf(":%s", a.Envs.APP_PORT)); err != nil {
+			a.Logger.Error("[api] listen failed", logger.Err(err))
+			m.Fail("http server", err)
+		}
+	}()
+	// stops accepting connections and waits for in-flight requests
+	m.Register("http server", app.ShutdownWithContext)
+}
+
+// StartWorker consumes the priority lanes and sends messages; shutdown waits
+// for in-flight sends until the shutdown deadline.
+func (a *App) StartWorker(m *lifecycle.Manager) {
+	kafkaRetryClient, err := kafka.Init(a.Envs.KAFKA_BROKERS, a.Envs.KAFKA_TOPIC_SMS)
+	if err != nil {
+		a.Logger.Error("[worker] kafka init failed", logger.Err(err))
+		panic("worker cannot run kafka not initialized with err " + err.Error())
+	}
+
+	lanes, err := worker.LanesInit(a.Envs)
+	if err != nil {
+		a.Logger.Error("[worker] kafka lanes init failed", logger.Err(err))
+		panic("worker cannot run kafka lanes not initialized with err " + err.Error())
+	}
+
+	limiter := ratelimit.ProviderLimiterInit(a.Logger, a.Envs, a.Db)
+
+	w := worker.WorkerHandlerInit(a.Logger, a.Envs, a.Metrics, kafkaRetryClient, lanes, a.Db, limiter)
+	if err := w.Start(); err != nil {
+		m.Fail("worker", err)
+		return
+	}
+	m.Register("worker", w.Shutdown)
+
+	store, err := retention.NewStore(a.Envs)
+	if err != nil {
+		a.Logger.Error("[worker] retention archive init failed", logger.Err(err))
+		panic("worker cannot run retention archive not initialized with err " + err.Error())
+	}
+	archiveSealer, err := a.archiveSealer(store != nil)
+	if err != nil {
+		a.Logger.Error("[worker] retention archive key init failed", logger.Err(err))
+		panic("worker cannot run retention archive key not initialized with err " + err.Error())
+	}
+	job := retention.JobInit(a.Logger, a.Db, store, archiveSealer,
+		time.Duration(a.Envs.RETENTION_INTERVAL)*time.Second, a.Envs.RETENTION_BATCH)
+	runBackground(m, "retention job", job.Start)
+
+	rollups := reports.JobInit(a.Logger, a.Db, time.Duration(a.Envs.REPORT_ROLLUP_INTERVAL)*time.Second,
+		time.Duration(a.Envs.REPORT_ROLLUP_WINDOW)*time.Hour)
+	runBackground(m, "rollup job", rollups.Start)
+
+	a.registerDependencyChecks(kafkaRetryClient)
+	a.Health.Register("consumer_lag", true, health.ConsumerLagCheck(w.Lag, int64(a.Envs.HEALTH_MAX_CONSUMER_LAG)))
+}
+
+// archiveSealer loads RETENTION_ARCHIVE_KEY_FILE. Archives are sealed under
+// their own keys so rotating the content keys never strands them; encrypted
+// content is never archived as plaintext, so the file is required whenever
+// content keys are in use and archives are written.
+func (a *App) archiveSealer(archiving bool) (*envelope.Sealer, error) {
+	path := a.Envs.RETENTION_ARCHIVE_KEY_FILE
+	if path == "" {
+		if archiving && a.Envs.CONTENT_KEY_FILE != "" {
+			return nil, errors.New("RETENTION_ARCHIVE_KEY_FILE is required when CONTENT_KEY_FILE is set")
+		}
+		return nil, nil
+	}
+	if path == a.Envs.CONTENT_KEY_FILE {
+		return nil, errors.New("RETENTION_ARCHIVE_KEY_FILE must not be the content key file")
+	}
+	keys, err := envelope.LoadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return envelope.SealerInit(keys), nil
+}
+
+// runBackground runs start until shutdown, which cancels its context and
+// waits for it to return.
+func runBackground(m *lifecycle.Manager, name string, start func(ctx context.Context)) {
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		start(ctx)
+		close(done)
+	}()
+	m.Register(name, func(ctx context.Context) error {
+		stop()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// registerDependencyChecks adds the checks both roles share; registering them
+// twice in combined mode just replaces the first registration.
+func (a *App) registerDependencyChecks(k kafka.KafkaInterface) {
+	a.Health.Register("kafka", true, health.KafkaCheck(k,
+		a.Envs.KAFKA_TOPIC_SMS_HIGH, a.Envs.KAFKA_TOPIC_SMS, a.Envs.KAFKA_TOPIC_SMS_LOW))
+	// a provider outage degrades sending but the process can still queue work
+	a.Health.Register("provider_kavenegar", false, health.ProviderCheck(a.Envs, "kavenegar"))
+}
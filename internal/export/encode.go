@@ -0,0 +1,124 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"postchi/internal/privacy"
+	"postchi/pkg/db"
+)
+
+// Export formats.
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+func ValidFormat(format string) bool {
+	return format == FormatCSV || format == FormatNDJSON
+}
+
+func ContentType(format string) string {
+	if format == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// Filename names an export of one service's messages in [from, to).
+func Filename(serviceId uint, format string, from time.Time, to time.Time) string {
+	return fmt.Sprintf("service-%d-%s-%s.%s", serviceId,
+		from.UTC().Format("20060102"), to.UTC().Format("20060102"), format)
+}
+
+// Encoder writes messages in one export format, masked for one role.
+type Encoder struct {
+	masker privacy.MaskerInterface
+	role   string
+	csv    *csv.Writer
+	json   *json.Encoder
+}
+
+// NewEncoder writes the CSV header right away; NDJSON has none.
+func NewEncoder(w io.Writer, format string, masker privacy.MaskerInterface, role string) (*Encoder, error) {
+	e := &Encoder{masker: masker, role: role}
+	switch format {
+	case FormatCSV:
+		e.csv = csv.NewWriter(w)
+		if err := e.csv.Write(csvHeader); err != nil {
+			return nil, err
+		}
+	case FormatNDJSON:
+		e.json = json.NewEncoder(w)
+	default:
+		return nil, fmt.Errorf("export: unknown format %q", format)
+	}
+	return e, nil
+}
+
+var csvHeader = []string{"id", "created_at", "status", "receptor", "content", "otp", "cost", "provider", "message_id", "sent_time"}
+
+type exportedSms struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Status    string    `json:"status"`
+	Receptor  string    `json:"receptor"`
+	Content   string    `json:"content"`
+	Otp       bool      `json:"otp"`
+	Cost      uint      `json:"cost"`
+	Provider  string    `json:"provider"`
+	MessageId int       `json:"message_id"`
+	SentTime  int64     `json:"sent_time"`
+}
+
+func (e *Encoder) Write(rows []db.Sms) error {
+	for _, r := range rows {
+		m := exportedSms{
+			ID:        r.ID,
+			CreatedAt: r.CreatedAt.UTC(),
+			Status:    r.Status,
+			Receptor:  e.masker.Receptor(e.role, r.Receptor),
+			Content:   e.masker.Content(e.role, r.Content, r.Otp),
+			Otp:       r.Otp,
+			Cost:      r.Cost,
+			Provider:  r.ServiceProviderName,
+			MessageId: r.ServiceProviderMessageId,
+			SentTime:  r.SentTime,
+		}
+		if e.json != nil {
+			if err := e.json.Encode(m); err != nil {
+				return err
+			}
+			continue
+		}
+		err := e.csv.Write([]string{
+			strconv.FormatUint(uint64(m.ID), 10),
+			m.CreatedAt.Format(time.RFC3339),
+			m.Status,
+			m.Receptor,
+			m.Content,
+			strconv.FormatBool(m.Otp),
+			strconv.FormatUint(uint64(m.Cost), 10),
+			m.Provider,
+			strconv.Itoa(m.MessageId),
+			strconv.FormatInt(m.SentTime, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush pushes buffered CSV rows to the underlying writer.
+func (e *Encoder) Flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		return e.csv.Error()
+	}
+	return nil
+}
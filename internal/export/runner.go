@@ -0,0 +1,176 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"postchi/internal/privacy"
+	"postchi/pkg/db"
+	"postchi/pkg/logger"
+)
+
+// A running job renews its heartbeat every heartbeatInterval; one whose
+// heartbeat is older than leaseTTL was abandoned and is claimed again.
+const (
+	heartbeatInterval = 15 * time.Second
+	leaseTTL          = time.Minute
+)
+
+// Runner writes pending export jobs to files under Dir and removes files of
+// exports finished more than TTL ago. Jobs are claimed with SKIP LOCKED, so
+// every API replica can run one; Dir must then be shared between them.
+type Runner struct {
+	Logger   logger.LoggerInterface
+	Db       db.DataBaseInterface
+	Masker   privacy.MaskerInterface
+	Dir      string
+	Interval time.Duration
+	Batch    int
+	TTL      time.Duration
+}
+
+func RunnerInit(l logger.LoggerInterface, d db.DataBaseInterface, m privacy.MaskerInterface, dir string, interval time.Duration, batch int, ttl time.Duration) *Runner {
+	return &Runner{Logger: l, Db: d, Masker: m, Dir: dir, Interval: interval, Batch: batch, TTL: ttl}
+}
+
+// Start polls for pending exports every Interval until ctx is cancelled. A
+// job cut off by shutdown or a crash is left running and picked up again,
+// here or on another replica, once its lease expires.
+func (r *Runner) Start(ctx context.Context) {
+	r.Logger.Info("[export] runner started", logger.String("dir", r.Dir))
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		r.expire()
+		for ctx.Err() == nil && r.runNext(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			r.Logger.Info("[export] runner stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runNext runs one pending job and reports whether there was one.
+func (r *Runner) runNext(ctx context.Context) bool {
+	job, ok, err := r.Db.ClaimExportJob(time.Now().Add(-leaseTTL))
+	if err != nil {
+		r.Logger.Error("[export] claim failed", logger.Err(err))
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	file := fmt.Sprintf("%d-%s", job.ID, Filename(job.ServiceId, job.Format, job.From, job.To))
+	stop := r.heartbeat(job.ID)
+	rows, runErr := r.write(ctx, job, filepath.Join(r.Dir, file))
+	stop()
+	if ctx.Err() != nil {
+		// not the job's fault; leave it to be claimed again after shutdown
+		r.Logger.Info("[export] job interrupted by shutdown", logger.Uint("export_id", job.ID))
+		return false
+	}
+	if runErr != nil {
+		file = ""
+		r.Logger.Error("[export] job failed", logger.ServiceID(job.ServiceId), logger.Uint("export_id", job.ID), logger.Err(runErr))
+	} else {
+		r.Logger.Info("[export] job done", logger.ServiceID(job.ServiceId), logger.Uint("export_id", job.ID), logger.Int64("rows", rows))
+	}
+	if err := r.Db.FinishExportJob(job.ID, file, rows, runErr); err != nil {
+		r.Logger.Error("[export] finish failed", logger.Uint("export_id", job.ID), logger.Err(err))
+	}
+	return true
+}
+
+// heartbeat renews the lease of a running job until the returned func is
+// called.
+func (r *Runner) heartbeat(exportId uint) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := r.Db.HeartbeatExportJob(exportId); err != nil {
+					r.Logger.Warn("[export] heartbeat failed", logger.Uint("export_id", exportId), logger.Err(err))
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// write renders the job to path through a temporary file, so a download never
+// sees a partial export. The temporary name is unique, so a runner still
+// writing an export it lost the lease on cannot clobber the new owner's file.
+func (r *Runner) write(ctx context.Context, job db.ExportJob, path string) (int64, error) {
+	if err := os.MkdirAll(r.Dir, 0o750); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(r.Dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	defer f.Close()
+	if err := f.Chmod(0o640); err != nil {
+		return 0, err
+	}
+
+	buf := bufio.NewWriter(f)
+	enc, err := NewEncoder(buf, job.Format, r.Masker, job.Role)
+	if err != nil {
+		return 0, err
+	}
+	var rows int64
+	err = r.Db.WithContext(ctx).StreamSms(job.ServiceId, job.From, job.To, r.Batch, func(batch []db.Sms) error {
+		rows += int64(len(batch))
+		return enc.Write(batch)
+	})
+	if err == nil {
+		err = enc.Flush()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return rows, err
+	}
+	return rows, os.Rename(tmp, path)
+}
+
+func (r *Runner) expire() {
+	jobs, err := r.Db.ExpireExportJobs(time.Now().Add(-r.TTL), 100)
+	if err != nil {
+		r.Logger.Error("[export] expire failed", logger.Err(err))
+		return
+	}
+	for _, j := range jobs {
+		if j.File == "" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(r.Dir, j.File)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			r.Logger.Warn("[export] remove file failed", logger.Uint("export_id", j.ID), logger.Err(err))
+		}
+	}
+}
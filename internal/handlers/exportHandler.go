@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"postchi/internal/export"
+	"postchi/internal/handlers/requests"
+	"postchi/internal/helpers"
+	"postchi/internal/metrics"
+	"postchi/internal/privacy"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type ExportHandler struct {
+	Envs    *env.Envs
+	Logger  logger.LoggerInterface
+	Metrics *metrics.Metrics
+	Db      db.DataBaseInterface
+	Privacy privacy.MaskerInterface
+}
+
+type ExportHandlerInterface interface {
+	StreamExport(c *fiber.Ctx) error
+	CreateExport(c *fiber.Ctx) error
+	GetExport(c *fiber.Ctx) error
+	DownloadExport(c *fiber.Ctx) error
+}
+
+func ExportHandlerInit(l logger.LoggerInterface, e *env.Envs, m *metrics.Metrics, d db.DataBaseInterface, p privacy.MaskerInterface) ExportHandlerInterface {
+	return &ExportHandler{Envs: e, Logger: l, Metrics: m, Db: d, Privacy: p}
+}
+
+// GET /account/:user_id/services/:service_id/messages/export?format=csv&from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z
+// Streams every message created in [from, to) as CSV or NDJSON, EXPORT_BATCH
+// rows at a time, masked like the message listing. A database error after
+// the first bytes went out truncates the download; use an async export for
+// ranges that must be complete.
+func (h *ExportHandler) StreamExport(c *fiber.Ctx) error {
+	userID, serviceID, err := h.ownedService(c)
+	if err != nil {
+		return errorJSON(c, err)
+	}
+	format := c.Query("format", export.FormatCSV)
+	from, to, err := parseExportRange(c.Query("from"), c.Query("to"), format)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	role := h.Privacy.Role(c)
+	// the body is written after the handler returns, so it cannot use the
+	// request's context
+	ctx := context.WithoutCancel(c.UserContext())
+	log := h.Logger.Ctx(ctx)
+
+	// Attachment guesses a type from the extension, so ours goes after it
+	c.Attachment(export.Filename(serviceID, format, from, to))
+	c.Set(fiber.HeaderContentType, export.ContentType(format))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		enc, err := export.NewEncoder(w, format, h.Privacy, role)
+		if err != nil {
+			log.Error("StreamExport", logger.ServiceID(serviceID), logger.Err(err))
+			return
+		}
+		err = h.Db.WithContext(ctx).StreamSms(serviceID, from, to, h.Envs.EXPORT_BATCH, func(rows []db.Sms) error {
+			if err := enc.Write(rows); err != nil {
+				return err
+			}
+			if err := enc.Flush(); err != nil {
+				return err
+			}
+			// a failed flush means the client went away
+			return w.Flush()
+		})
+		if err != nil {
+			log.Error("StreamExport", logger.UserID(userID), logger.ServiceID(serviceID), logger.Err(err))
+		}
+	})
+	return nil
+}
+
+// POST /account/:user_id/services/:service_id/exports
+// body: { "format": "ndjson", "from": "2025-01-01T00:00:00Z", "to": "2025-02-01T00:00:00Z" }
+// Queues an export; poll GET .../exports/:export_id until its status is done,
+// then fetch download_url. Files are removed EXPORT_TTL seconds after.
+func (h *ExportHandler) CreateExport(c *fiber.Ctx) error {
+	userID, serviceID, err := h.ownedService(c)
+	if err != nil {
+		return errorJSON(c, err)
+	}
+	var req requests.CreateExportReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json"})
+	}
+	if req.Format == "" {
+		req.Format = export.FormatCSV
+	}
+	from, to, err := parseExportRange(req.From, req.To, req.Format)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	job := db.ExportJob{
+		UserId:    userID,
+		ServiceId: serviceID,
+		Format:    req.Format,
+		Role:      h.Privacy.Role(c),
+		From:      from,
+		To:        to,
+		Status:    db.ExportPending,
+	}
+	if err := h.Db.CreateExportJob(&job); err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("CreateExport", logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(exportResponse(c, job))
+}
+
+// GET /account/:user_id/services/:service_id/exports/:export_id
+func (h *ExportHandler) GetExport(c *fiber.Ctx) error {
+	job, err := h.exportJob(c)
+	if err != nil {
+		return errorJSON(c, err)
+	}
+	return c.JSON(exportResponse(c, job))
+}
+
+// GET /account/:user_id/services/:service_id/exports/:export_id/download
+func (h *ExportHandler) DownloadExport(c *fiber.Ctx) error {
+	job, err := h.exportJob(c)
+	if err != nil {
+		return errorJSON(c, err)
+	}
+	switch job.Status {
+	case db.ExportDone:
+	case db.ExportExpired:
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "export expired"})
+	default:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "export is " + string(job.Status)})
+	}
+	c.Attachment(export.Filename(job.ServiceId, job.Format, job.From, job.To))
+	if err := c.SendFile(filepath.Join(h.Envs.EXPORT_DIR, job.File)); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, export.ContentType(job.Format))
+	return nil
+}
+
+// ownedService parses the path ids and checks they name a service of the
+// user. Errors are *fiber.Error carrying the response status.
+func (h *ExportHandler) ownedService(c *fiber.Ctx) (uint, uint, error) {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return 0, 0, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
+	if err != nil {
+		return 0, 0, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	if _, err := h.Db.GetUserService(userID, serviceID); err != nil {
+		if errors.Is(err, db.ErrServiceNotFound) {
+			return 0, 0, fiber.NewError(fiber.StatusNotFound, "service not found")
+		}
+		h.Logger.Ctx(c.UserContext()).Error("GetUserService", logger.ServiceID(serviceID), logger.Err(err))
+		return 0, 0, fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	return userID, serviceID, nil
+}
+
+func (h *ExportHandler) exportJob(c *fiber.Ctx) (db.ExportJob, error) {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return db.ExportJob{}, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
+	if err != nil {
+		return db.ExportJob{}, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	exportID, err := helpers.ParseUintParam(c, "export_id")
+	if err != nil {
+		return db.ExportJob{}, fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	job, err := h.Db.GetExportJob(userID, serviceID, exportID)
+	if errors.Is(err, db.ErrExportNotFound) {
+		return job, fiber.NewError(fiber.StatusNotFound, "export not found")
+	}
+	if err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("GetExport", logger.ServiceID(serviceID), logger.Err(err))
+		return job, fiber.NewError(fiber.StatusInternalServerError, "db error")
+	}
+	return job, nil
+}
+
+// errorJSON answers with the status and message of a *fiber.Error.
+func errorJSON(c *fiber.Ctx, err error) error {
+	var fe *fiber.Error
+	if !errors.As(err, &fe) {
+		fe = fiber.ErrInternalServerError
+	}
+	return c.Status(fe.Code).JSON(fiber.Map{"error": fe.Message})
+}
+
+func exportResponse(c *fiber.Ctx, job db.ExportJob) fiber.Map {
+	resp := fiber.Map{
+		"id":           job.ID,
+		"service_id":   job.ServiceId,
+		"format":       job.Format,
+		"from":         job.From,
+		"to":           job.To,
+		"status":       job.Status,
+		"rows":         job.Rows,
+		"created_at":   job.CreatedAt,
+		"completed_at": job.CompletedAt,
+	}
+	if job.Error != "" {
+		resp["error"] = job.Error
+	}
+	if job.Status == db.ExportDone {
+		resp["download_url"] = fmt.Sprintf("%s/account/%d/services/%d/exports/%d/download",
+			c.BaseURL(), job.UserId, job.ServiceId, job.ID)
+	}
+	return resp
+}
+
+func parseExportRange(rawFrom string, rawTo string, format string) (time.Time, time.Time, error) {
+	if !export.ValidFormat(format) {
+		return time.Time{}, time.Time{}, errors.New("format must be csv or ndjson")
+	}
+	from, err := time.Parse(time.RFC3339, rawFrom)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("invalid from: expected RFC3339")
+	}
+	to, err := time.Parse(time.RFC3339, rawTo)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("invalid to: expected RFC3339")
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, errors.New("to must be after from")
+	}
+	return from, to, nil
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"postchi/internal/handlers/requests"
+	"postchi/internal/helpers"
+	"postchi/internal/metrics"
+	"postchi/internal/pricing"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type PriceHandler struct {
+	Envs    *env.Envs
+	Logger  logger.LoggerInterface
+	Metrics *metrics.Metrics
+	Db      db.DataBaseInterface
+	Pricer  pricing.PricerInterface
+}
+
+type PriceHandlerInterface interface {
+	ListPrices(c *fiber.Ctx) error
+	UpsertPrice(c *fiber.Ctx) error
+	DeletePrice(c *fiber.Ctx) error
+	PreviewCost(c *fiber.Ctx) error
+}
+
+func PriceHandlerInit(l logger.LoggerInterface, e *env.Envs, m *metrics.Metrics, d db.DataBaseInterface, p pricing.PricerInterface) PriceHandlerInterface {
+	return &PriceHandler{Envs: e, Logger: l, Metrics: m, Db: d, Pricer: p}
+}
+
+// GET /admin/prices
+func (h *PriceHandler) ListPrices(c *fiber.Ctx) error {
+	prices, err := h.Db.ListPrices()
+	if err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("ListPrices", logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+
+	resp := make([]fiber.Map, 0, len(prices))
+	for _, p := range prices {
+		resp = append(resp, fiber.Map{
+			"id":               p.ID,
+			"prefix":           p.Prefix,
+			"operator":         p.Operator,
+			"service_type":     p.ServiceType,
+			"provider":         p.Provider,
+			"cost_per_segment": p.CostPerSegment,
+		})
+	}
+	return c.JSON(fiber.Map{"prices": resp})
+}
+
+// POST /admin/prices
+// body: { "prefix": "98912", "operator": "MCI", "service_type": "express", "provider": "kavenegar", "cost_per_segment": 120 }
+func (h *PriceHandler) UpsertPrice(c *fiber.Ctx) error {
+	var req requests.UpsertPriceReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json"})
+	}
+	serviceType := strings.ToLower(strings.TrimSpace(req.ServiceType))
+	if serviceType != string(db.ServiceTypeExpress) && serviceType != string(db.ServiceTypeAsync) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "service_type must be 'express' or 'async'"})
+	}
+
+	price := &db.Price{
+		Prefix:         helpers.NormalizeReceptor(req.Prefix),
+		Operator:       strings.TrimSpace(req.Operator),
+		ServiceType:    db.ServiceType(serviceType),
+		Provider:       strings.TrimSpace(req.Provider),
+		CostPerSegment: req.CostPerSegment,
+	}
+	if err := h.Db.UpsertPrice(price); err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("UpsertPrice", logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to save price"})
+	}
+	if err := h.Pricer.Reload(); err != nil {
+		h.Logger.Ctx(c.UserContext()).Warn("UpsertPrice: price cache reload failed", logger.Err(err))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"id": price.ID, "message": "price saved"})
+}
+
+// DELETE /admin/prices/:price_id
+func (h *PriceHandler) DeletePrice(c *fiber.Ctx) error {
+	priceID, err := helpers.ParseUintParam(c, "price_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.Db.DeletePrice(priceID); err != nil {
+		if errors.Is(err, db.ErrPriceNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "price not found"})
+		}
+		h.Logger.Ctx(c.UserContext()).Error("DeletePrice", logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete price"})
+	}
+	if err := h.Pricer.Reload(); err != nil {
+		h.Logger.Ctx(c.UserContext()).Warn("DeletePrice: price cache reload failed", logger.Err(err))
+	}
+
+	return c.JSON(fiber.Map{"message": "price deleted"})
+}
+
+// POST /prices/preview
+// body: { "to": "09123456789", "text": "hello", "service_type": "async", "provider": "kavenegar" }
+func (h *PriceHandler) PreviewCost(c *fiber.Ctx) error {
+	var req requests.PreviewCostReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json"})
+	}
+	if req.To == "" || req.Text == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "'to' and 'text' are required"})
+	}
+	serviceType := db.ServiceTypeAsync
+	if strings.TrimSpace(req.ServiceType) != "" {
+		t, err := helpers.ToServiceType(req.ServiceType)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "service_type must be 'express' or 'async'"})
+		}
+		serviceType = t
+	}
+
+	quote, err := h.Pricer.Quote(req.To, req.Text, string(serviceType), req.Provider)
+	if err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("PreviewCost", logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "pricing unavailable"})
+	}
+	return c.JSON(quote)
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"strings"
+
+	"postchi/internal/handlers/requests"
+	"postchi/internal/helpers"
+	"postchi/internal/metrics"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type RateLimitHandler struct {
+	Envs    *env.Envs
+	Logger  logger.LoggerInterface
+	Metrics *metrics.Metrics
+	Db      db.DataBaseInterface
+}
+
+type RateLimitHandlerInterface interface {
+	ListRateLimits(c *fiber.Ctx) error
+	UpsertRateLimit(c *fiber.Ctx) error
+	DeleteRateLimit(c *fiber.Ctx) error
+}
+
+func RateLimitHandlerInit(l logger.LoggerInterface, e *env.Envs, m *metrics.Metrics, d db.DataBaseInterface) RateLimitHandlerInterface {
+	return &RateLimitHandler{Envs: e, Logger: l, Metrics: m, Db: d}
+}
+
+// GET /admin/rate-limits
+func (h *RateLimitHandler) ListRateLimits(c *fiber.Ctx) error {
+	limits, err := h.Db.ListRateLimits()
+	if err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("ListRateLimits", logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+
+	resp := make([]fiber.Map, 0, len(limits))
+	for _, l := range limits {
+		resp = append(resp, fiber.Map{
+			"id":              l.ID,
+			"provider":        l.Provider,
+			"sender":          l.Sender,
+			"rate_per_second": l.RatePerSecond,
+			"burst":           l.Burst,
+		})
+	}
+	return c.JSON(fiber.Map{"rate_limits": resp})
+}
+
+// POST /admin/rate-limits
+// body: { "provider": "kavenegar", "sender": "10004346", "rate_per_second": 20, "burst": 40 }
+// Workers pick up changes on their next reload, within 30 seconds. The rate
+// is the provider's total; each of SMS_WORKER_REPLICAS workers enforces its share.
+func (h *RateLimitHandler) UpsertRateLimit(c *fiber.Ctx) error {
+	var req requests.UpsertRateLimitReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json"})
+	}
+	req.Provider = strings.TrimSpace(req.Provider)
+	if req.Provider == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "provider is required"})
+	}
+	if req.RatePerSecond < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "rate_per_second must not be negative"})
+	}
+
+	limit := &db.ProviderRateLimit{
+		Provider:      req.Provider,
+		Sender:        strings.TrimSpace(req.Sender),
+		RatePerSecond: req.RatePerSecond,
+		Burst:         req.Burst,
+	}
+	if err := h.Db.UpsertRateLimit(limit); err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("UpsertRateLimit", logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to save rate limit"})
+	}
+	return c.JSON(fiber.Map{"id": limit.ID, "message": "rate limit saved"})
+}
+
+// DELETE /admin/rate-limits/:limit_id
+func (h *RateLimitHandler) DeleteRateLimit(c *fiber.Ctx) error {
+	limitID, err := helpers.ParseUintParam(c, "limit_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := h.Db.DeleteRateLimit(limitID); err != nil {
+		if err.Error() == "rate limit not found" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "rate limit not found"})
+		}
+		h.Logger.Ctx(c.UserContext()).Error("DeleteRateLimit", logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to delete rate limit"})
+	}
+	return c.JSON(fiber.Map{"message": "rate limit deleted"})
+}
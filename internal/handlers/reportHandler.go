@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"postchi/internal/helpers"
+	"postchi/internal/metrics"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxReportRange bounds a report's date range; hourly reports get a tenth of it.
+const maxReportRange = 366 * 24 * time.Hour
+
+type ReportHandler struct {
+	Envs    *env.Envs
+	Logger  logger.LoggerInterface
+	Metrics *metrics.Metrics
+	Db      db.DataBaseInterface
+}
+
+type ReportHandlerInterface interface {
+	GetReport(c *fiber.Ctx) error
+}
+
+func ReportHandlerInit(l logger.LoggerInterface, e *env.Envs, m *metrics.Metrics, d db.DataBaseInterface) ReportHandlerInterface {
+	return &ReportHandler{Envs: e, Logger: l, Metrics: m, Db: d}
+}
+
+// GET /account/:user_id/reports?from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z&interval=day&group_by=provider,status&service_id=3
+// Aggregates the user's messages from the hourly rollups. interval is hour,
+// day or empty for one total; group_by takes service, status, provider and
+// operator; service_id (comma-separated) narrows the services. The range
+// defaults to the last 30 days and is aligned to whole hours. Numbers lag the
+// sms table by up to REPORT_ROLLUP_INTERVAL seconds; refreshed_at says when
+// the rollups were last rebuilt.
+func (h *ReportHandler) GetReport(c *fiber.Ctx) error {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	q := db.ReportQuery{UserId: userID, Interval: c.Query("interval")}
+	switch q.Interval {
+	case "", db.IntervalHour, db.IntervalDay:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "interval must be hour or day"})
+	}
+
+	q.To = time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	if raw := c.Query("to"); raw != "" {
+		if q.To, err = time.Parse(time.RFC3339, raw); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid to: expected RFC3339"})
+		}
+	}
+	q.From = q.To.AddDate(0, 0, -30)
+	if raw := c.Query("from"); raw != "" {
+		if q.From, err = time.Parse(time.RFC3339, raw); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid from: expected RFC3339"})
+		}
+	}
+	q.From, q.To = q.From.UTC().Truncate(time.Hour), q.To.UTC().Truncate(time.Hour)
+	if !q.To.After(q.From) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "to must be at least an hour after from"})
+	}
+	maxRange := maxReportRange
+	if q.Interval == db.IntervalHour {
+		maxRange /= 10
+	}
+	if q.To.Sub(q.From) > maxRange {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "range too large"})
+	}
+
+	groups := map[string]bool{}
+	if raw := c.Query("group_by"); raw != "" {
+		for _, g := range strings.Split(raw, ",") {
+			g = strings.TrimSpace(g)
+			switch g {
+			case db.GroupService, db.GroupStatus, db.GroupProvider, db.GroupOperator:
+			default:
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "group_by takes service, status, provider and operator"})
+			}
+			if !groups[g] {
+				groups[g] = true
+				q.GroupBy = append(q.GroupBy, g)
+			}
+		}
+	}
+
+	if raw := c.Query("service_id"); raw != "" {
+		for _, s := range strings.Split(raw, ",") {
+			id, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid service_id"})
+			}
+			q.ServiceIds = append(q.ServiceIds, uint(id))
+		}
+	}
+
+	rows, err := h.Db.ReportSms(q)
+	if err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("GetReport", logger.UserID(userID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+	refreshedAt, err := h.Db.RollupRefreshedAt()
+	if err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("GetReport", logger.UserID(userID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+
+	resp := make([]fiber.Map, 0, len(rows))
+	for _, r := range rows {
+		row := fiber.Map{
+			"messages":  r.Messages,
+			"succeeded": r.Succeeded,
+			"failed":    r.Failed,
+			"cost":      r.Cost,
+		}
+		// share of settled sends that succeeded; absent while none settled
+		if settled := r.Succeeded + r.Failed; settled > 0 {
+			row["success_rate"] = float64(r.Succeeded) / float64(settled)
+		}
+		if r.Bucket != nil {
+			row["bucket"] = r.Bucket.UTC()
+		}
+		if groups[db.GroupService] {
+			row["service_id"] = r.ServiceId
+		}
+		if groups[db.GroupStatus] {
+			row["status"] = r.Status
+		}
+		if groups[db.GroupProvider] {
+			row["provider"] = r.Provider
+		}
+		if groups[db.GroupOperator] {
+			row["operator"] = r.Operator
+		}
+		resp = append(resp, row)
+	}
+
+	return c.JSON(fiber.Map{
+		"user_id":      userID,
+		"from":         q.From,
+		"to":           q.To,
+		"interval":     q.Interval,
+		"group_by":     q.GroupBy,
+		"refreshed_at": refreshedAt,
+		"rows":         resp,
+	})
+}
@@ -5,6 +5,34 @@ type SendSmsReq struct {
 	Text     string `json:"text" validate:"required"`
 	Ttl      int    `json:"ttl" validate:"required"`
 	Provider string `json:"provider,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	// Otp marks the text as a one-time code; codes are also detected from the text.
+	Otp bool `json:"otp,omitempty"`
+}
+
+type ServiceAlertsReq struct {
+	LowBalanceThreshold uint64 `json:"low_balance_threshold"`
+	Email               string `json:"email,omitempty"`
+	SmsReceptor         string `json:"sms_receptor,omitempty"`
+	WebhookUrl          string `json:"webhook_url,omitempty"`
+}
+
+type ServiceLimitsReq struct {
+	RequestsPerMinute uint   `json:"requests_per_minute"`
+	DailyQuota        uint64 `json:"daily_quota"`
+	MonthlyQuota      uint64 `json:"monthly_quota"`
+}
+
+type ServiceRetentionReq struct {
+	RetentionDays uint   `json:"retention_days"`
+	Action        string `json:"action,omitempty"`
+}
+
+type QuoteSmsReq struct {
+	To        string   `json:"to"`
+	Receptors []string `json:"receptors,omitempty"`
+	Text      string   `json:"text"`
+	Provider  string   `json:"provider,omitempty"`
 }
 
 type CreateUserReq struct {
@@ -20,3 +48,31 @@ type CreateServiceReq struct {
 type ChargeReq struct {
 	CreditAmount int64 `json:"credit_amount"`
 }
+
+type UpsertPriceReq struct {
+	Prefix         string `json:"prefix"`
+	Operator       string `json:"operator"`
+	ServiceType    string `json:"service_type"`
+	Provider       string `json:"provider"`
+	CostPerSegment uint   `json:"cost_per_segment"`
+}
+
+type PreviewCostReq struct {
+	To          string `json:"to"`
+	Text        string `json:"text"`
+	ServiceType string `json:"service_type"`
+	Provider    string `json:"provider,omitempty"`
+}
+
+type UpsertRateLimitReq struct {
+	Provider      string  `json:"provider"`
+	Sender        string  `json:"sender,omitempty"`
+	RatePerSecond float64 `json:"rate_per_second"`
+	Burst         uint    `json:"burst"`
+}
+
+type CreateExportReq struct {
+	Format string `json:"format"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
@@ -3,37 +3,53 @@ package handlers
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"strconv"
 	"time"
 
+	"postchi/internal/alerts"
 	"postchi/internal/handlers/requests"
 	"postchi/internal/helpers"
 	"postchi/internal/metrics"
+	"postchi/internal/pricing"
 	"postchi/internal/sms"
 	"postchi/pkg/db"
 	"postchi/pkg/env"
 	"postchi/pkg/kafka"
 	"postchi/pkg/logger"
+	"postchi/pkg/redact"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+const (
+	captureAttempts = 4
+	captureBackoff  = 200 * time.Millisecond
+)
+
 type SmsHandler struct {
 	Envs        *env.Envs
 	Metrics     *metrics.Metrics
 	Logger      logger.LoggerInterface
 	KafkaClient kafka.KafkaInterface
 	Db          db.DataBaseInterface
+	Pricer      pricing.PricerInterface
+	Alerts      alerts.NotifierInterface
 }
 
 type SmsHandlerInterface interface {
 	SendExpressSms(c *fiber.Ctx) error
 	SendAsyncSms(c *fiber.Ctx) error
+
+	// QuoteSms prices a single or bulk send without persisting or sending anything.
+	QuoteSms(c *fiber.Ctx) error
+
+	// CancelSms cancels a queued message and releases its reserved credit.
+	CancelSms(c *fiber.Ctx) error
 }
 
-func SmsHandlerInit(l logger.LoggerInterface, e *env.Envs, m *metrics.Metrics, k kafka.KafkaInterface, d db.DataBaseInterface) SmsHandlerInterface {
-	return &SmsHandler{Envs: e, Logger: l, Metrics: m, KafkaClient: k, Db: d}
+func SmsHandlerInit(l logger.LoggerInterface, e *env.Envs, m *metrics.Metrics, k kafka.KafkaInterface, d db.DataBaseInterface, p pricing.PricerInterface, a alerts.NotifierInterface) SmsHandlerInterface {
+	return &SmsHandler{Envs: e, Logger: l, Metrics: m, KafkaClient: k, Db: d, Pricer: p, Alerts: a}
 }
 
 func (h *SmsHandler) SendExpressSms(c *fiber.Ctx) error {
@@ -61,63 +77,122 @@ func (h *SmsHandler) SendExpressSms(c *fiber.Ctx) error {
 		}
 	}
 
+	// the stuck sweep fails and refunds rows left in sending for
+	// SMS_SENDING_TIMEOUT, so the provider call must end well before that
+	if maxTtl := h.Envs.SMS_SENDING_TIMEOUT / 2; req.Ttl < 1 || req.Ttl > maxTtl {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "ttl must be between 1 and " + strconv.Itoa(maxTtl) + " seconds"})
+	}
+
+	log := h.Logger.Ctx(c.UserContext()).With(
+		logger.UserID(uint(uid64)), logger.ServiceID(uint(sid64)), logger.Provider(req.Provider))
+
 	prov, err := sms.NewProvider(h.Envs, req.Provider)
 
 	if err != nil {
-		h.Logger.StdLog("error", fmt.Sprintf("[sms-express] provider init failed: %v", err))
+		log.Error("[sms-express] provider init failed", logger.Err(err))
 		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "provider unavailable"})
 	}
 
+	quote, err := h.Pricer.Quote(req.To, req.Text, "express", prov.GetName())
+	if err != nil {
+		log.Error("[sms-express] pricing failed", logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "pricing unavailable"})
+	}
+
+	// hold the credit before calling the provider so a send is never free; the
+	// row starts in sending so it cannot be cancelled while the provider has it
+	smsRecord := &db.Sms{
+		Content:                  req.Text,
+		Receptor:                 req.To,
+		Status:                   string(db.SmsStatusSending),
+		SentTime:                 time.Now().Unix(),
+		Cost:                     0,
+		ServiceProviderName:      prov.GetName(),
+		ServiceProviderMessageId: 0,
+		Operator:                 quote.Operator,
+		Otp:                      req.Otp || redact.LooksLikeOtp(req.Text),
+		ServiceId:                uint(sid64),
+	}
+	if err := h.Db.WithContext(c.UserContext()).CreateSmsAndReserveCredit(uint(uid64), uint(sid64), smsRecord, quote.Cost); err != nil {
+		log.Error("[sms-express] failed to persist SMS or reserve credit", logger.Err(err))
+		if errors.Is(err, db.ErrInsufficientCredits) {
+			return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{"error": "insufficient credits"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+	h.Alerts.CheckLowBalance(uint(sid64))
+	h.Metrics.Message(prov.GetName(), "express", metrics.StatusAccepted)
+
 	smsSerrvice := sms.NewService(prov)
 
 	start := time.Now()
 
-	ctx, cancel := context.WithTimeout(c.Context(), time.Second * time.Duration(req.Ttl))
+	ctx, cancel := context.WithTimeout(c.UserContext(), time.Second*time.Duration(req.Ttl))
 	defer cancel()
-	status, msgID, sendErr := smsSerrvice.Send(ctx,req.To, req.Text)
+	status, msgID, sendErr := smsSerrvice.Send(ctx, req.To, req.Text)
 
-	elapsed := time.Since(start).Seconds()
-	if h.Metrics != nil {
-		h.Metrics.SmsProviderResponseTimeHistogram.WithLabelValues(prov.GetName()).Observe(elapsed)
-	}
+	elapsed := time.Since(start)
 
 	if sendErr != nil {
-		// log and expose provider error metrics
-		if h.Metrics != nil {
-			h.Metrics.SmsProviderErrors.WithLabelValues(prov.GetName()).Inc()
+		result := metrics.ResultError
+		if errors.Is(sendErr, sms.ErrRateLimited) {
+			result = metrics.ResultRateLimited
+		}
+		h.Metrics.ProviderRequest(prov.GetName(), result, elapsed)
+		h.Metrics.Message(prov.GetName(), "express", metrics.StatusFailed)
+		log.Error("[sms-express] send failed", logger.SmsID(smsRecord.ID), logger.Err(sendErr))
+		if err := h.Db.WithContext(c.UserContext()).ReleaseSmsCredit(uint(uid64), uint(sid64), smsRecord.ID, db.SmsStatusFailed); err != nil {
+			log.Error("[sms-express] failed to release reserved credit", logger.SmsID(smsRecord.ID), logger.Err(err))
 		}
-		h.Logger.StdLog("error", fmt.Sprintf("[sms-express] send failed: %v", sendErr))
 		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
 			"status":  status,
 			"error":   sendErr.Error(),
 			"message": "send failed",
 		})
 	}
-	cost := helpers.CalculateCost(h.Envs, req.Text, "express")
 
-	smsRecord := &db.Sms{
-		Content:                  req.Text,
-		Receptor:                 req.To,
-		Status:                   "sent",
-		SentTime:                 time.Now().Unix(),
-		Cost:                     cost,
-		ServiceProviderName:      prov.GetName(),
-		ServiceProviderMessageId: msgID,
-		ServiceId:                uint(sid64),
-	}
-	if err := h.Db.CreateSmsAndSpendCredit(uint(uid64), uint(sid64), smsRecord, 1); err != nil {
-		h.Logger.StdLog("error", fmt.Sprintf("[sms-express] failed to persist SMS or deduct credit: %v", err))
-		if err.Error() == "insufficient credits" {
-			return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{"error": "insufficient credits"})
+	// the provider has the message now, so answer as sent even if the capture
+	// keeps failing; a 500 here would only invite the client to send it again.
+	// The row is parked as uncaptured so the stuck sweep charges it later
+	// instead of refunding it.
+	if err := h.captureSms(c.UserContext(), uint(uid64), uint(sid64), smsRecord.ID, prov.GetName(), msgID, quote.Cost); err != nil {
+		log.Error("[sms-express] failed to capture reserved credit", logger.SmsID(smsRecord.ID), logger.Err(err))
+		ctx := context.WithoutCancel(c.UserContext())
+		if err := h.Db.WithContext(ctx).MarkSmsUncaptured(uint(sid64), smsRecord.ID, msgID); err != nil && !errors.Is(err, db.ErrSmsNotQueued) {
+			log.Error("[sms-express] failed to park uncaptured message, reconcile manually",
+				logger.SmsID(smsRecord.ID), logger.Int("provider_message_id", msgID), logger.Err(err))
 		}
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
 	}
+	h.Metrics.ProviderRequest(prov.GetName(), metrics.ResultOK, elapsed)
+	h.Metrics.Message(prov.GetName(), "express", metrics.StatusSent)
+	h.Metrics.Spent(prov.GetName(), "express", quote.Cost)
 
 	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
-		"Status": "ok",
+		"Status":   "ok",
+		"encoding": quote.Encoding,
+		"segments": quote.Segments,
+		"cost":     quote.Cost,
 	})
 }
 
+// captureSms settles a delivered express message, retrying with backoff on a
+// context detached from the request so a transient DB error or a client that
+// hangs up does not strand the reservation.
+func (h *SmsHandler) captureSms(ctx context.Context, userId uint, serviceId uint, smsId uint, providerName string, msgID int, cost uint) error {
+	ctx = context.WithoutCancel(ctx)
+	wait := captureBackoff
+	var err error
+	for attempt := 1; attempt <= captureAttempts; attempt++ {
+		err = h.Db.WithContext(ctx).MarkSmsSent(userId, serviceId, smsId, providerName, msgID, cost)
+		if err == nil || errors.Is(err, db.ErrSmsNotQueued) || attempt == captureAttempts {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+	return err
+}
+
 // regular async messages
 func (h *SmsHandler) SendAsyncSms(c *fiber.Ctx) error {
 	userIdParam := c.Params("user_id")
@@ -130,21 +205,38 @@ func (h *SmsHandler) SendAsyncSms(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "'to' and 'text' are required"})
 	}
 
-	var smsRecordId uint
 	var serviceId int
 	var userId int
 
 	var err error
 
-	cost := uint(helpers.CalculateCost(h.Envs, req.Text, "async"))
-
 	serviceId, err = strconv.Atoi(serviceIdParam)
 	if err != nil {
-		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid service id param "})
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid service id param "})
 	}
 	userId, err = strconv.Atoi(userIdParam)
 	if err != nil {
-		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user id param "})
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid user id param "})
+	}
+
+	priority, err := helpers.ToPriority(req.Priority)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	// resolved before anything is reserved so an unknown provider is refused
+	// up front and only known names reach storage, the worker and metrics
+	prov, err := sms.NewProvider(h.Envs, req.Provider)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "unknown provider"})
+	}
+	providerName := prov.GetName()
+	log := h.Logger.Ctx(c.UserContext()).With(
+		logger.UserID(uint(userId)), logger.ServiceID(uint(serviceId)), logger.Provider(providerName))
+
+	quote, err := h.Pricer.Quote(req.To, req.Text, "async", providerName)
+	if err != nil {
+		log.Error("[sms-async] pricing failed", logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "pricing unavailable"})
 	}
 
 	smsRecord := &db.Sms{
@@ -153,36 +245,147 @@ func (h *SmsHandler) SendAsyncSms(c *fiber.Ctx) error {
 		Status:                   "queued",
 		SentTime:                 time.Now().Unix(),
 		Cost:                     0,
-		ServiceProviderName:      req.Provider,
+		ServiceProviderName:      providerName,
 		ServiceProviderMessageId: 0,
+		Operator:                 quote.Operator,
+		Otp:                      req.Otp || redact.LooksLikeOtp(req.Text),
 		ServiceId:                uint(serviceId),
 	}
-	if err := h.Db.CreateSmsAndSpendCredit(uint(userId), uint(serviceId), smsRecord, cost); err != nil {
-		h.Logger.StdLog("error", fmt.Sprintf("[sms-async] failed to persist queued SMS record: %v", err))
+	// the kafka message is written to the outbox in the same transaction and
+	// published by the relay, so a charged message is always enqueued
+	buildPayload := func(stored *db.Sms) ([]byte, error) {
+		return json.Marshal(kafka.SmsKafkaMessage{
+			To:        req.To,
+			Content:   req.Text,
+			Provider:  providerName,
+			UserId:    uint(userId),
+			ServiceId: uint(serviceId),
+			SmsId:     stored.ID,
+			Cost:      quote.Cost,
+			Priority:  priority,
+		})
+	}
+	topic := helpers.TopicForPriority(h.Envs, priority)
+	if err := h.Db.WithContext(c.UserContext()).CreateSmsAndEnqueue(uint(userId), uint(serviceId), smsRecord, quote.Cost, topic, providerName, buildPayload); err != nil {
+		log.Error("[sms-async] failed to persist queued SMS record", logger.Err(err))
+		if errors.Is(err, db.ErrInsufficientCredits) {
+			return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{"error": "insufficient credits"})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
 	}
-	smsRecordId = smsRecord.ID
+	h.Alerts.CheckLowBalance(uint(serviceId))
+	h.Metrics.Message(providerName, "async", metrics.StatusAccepted)
 
-	msgWithId := kafka.SmsKafkaMessage{
-		To:        req.To,
-		Content:   req.Text,
-		Provider:  req.Provider,
-		UserId:    uint(userId),
-		ServiceId: uint(serviceId),
-		SmsId:     smsRecordId,
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"status":   "queued",
+		"sms_id":   smsRecord.ID,
+		"priority": priority,
+		"to":       req.To,
+		"encoding": quote.Encoding,
+		"segments": quote.Segments,
+		"cost":     quote.Cost,
+	})
+}
+
+// POST /sms/:user_id/:service_id/quote
+// body: { "to": "0912...", "receptors": ["0912...", "0935..."], "text": "hello", "provider": "kavenegar" }
+// The service type decides whether express or async prices apply.
+func (h *SmsHandler) QuoteSms(c *fiber.Ctx) error {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-	kafkaValue, parseErr := json.Marshal(msgWithId)
-	if parseErr != nil {
-		h.Logger.StdLog("error", fmt.Sprintf("[sms-async] kafka message parser erro %s", parseErr))
+
+	var req requests.QuoteSmsReq
+	if err := c.BodyParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json body"})
 	}
-	if err := h.KafkaClient.Publish(c.Context(), req.Provider, kafkaValue); err != nil {
-		h.Logger.StdLog("error", "kafka publish failed: "+err.Error())
-		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "failed to enqueue"})
+	receptors := req.Receptors
+	if req.To != "" {
+		receptors = append([]string{req.To}, receptors...)
 	}
-	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
-		"status": "queued",
-		"topic":  "sms_send",
-		"to":     req.To,
+	if len(receptors) == 0 || req.Text == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "'to' or 'receptors' and 'text' are required"})
+	}
+
+	svc, err := h.Db.WithContext(c.UserContext()).GetUserService(userID, serviceID)
+	if errors.Is(err, db.ErrServiceNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "service not found"})
+	}
+	if err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("[sms-quote] service lookup failed", logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+	serviceType := "async"
+	if svc.Type == db.ServiceTypeExpress {
+		serviceType = "express"
+	}
+
+	normalized := make([]string, 0, len(receptors))
+	for _, r := range receptors {
+		normalized = append(normalized, helpers.NormalizeReceptor(r))
+	}
+	blocked, err := h.Db.WithContext(c.UserContext()).GetBlacklisted(serviceID, normalized)
+	if err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("[sms-quote] blacklist lookup failed", logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+	isBlocked := make(map[string]bool, len(blocked))
+	for _, b := range blocked {
+		isBlocked[b] = true
+	}
+
+	var total uint
+	messages := make([]pricing.Quote, 0, len(normalized))
+	for _, r := range normalized {
+		if isBlocked[r] {
+			continue
+		}
+		quote, err := h.Pricer.Quote(r, req.Text, serviceType, req.Provider)
+		if err != nil {
+			h.Logger.Ctx(c.UserContext()).Error("[sms-quote] pricing failed", logger.ServiceID(serviceID), logger.Err(err))
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "pricing unavailable"})
+		}
+		total += quote.Cost
+		messages = append(messages, quote)
+	}
+
+	return c.JSON(fiber.Map{
+		"service_id":        serviceID,
+		"service_type":      serviceType,
+		"messages":          messages,
+		"blacklisted":       blocked,
+		"total_cost":        total,
+		"credits":           svc.Credits,
+		"sufficient_credit": svc.Credits >= uint64(total),
 	})
 }
+
+// POST /sms/:user_id/:service_id/messages/:sms_id/cancel
+func (h *SmsHandler) CancelSms(c *fiber.Ctx) error {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	smsID, err := helpers.ParseUintParam(c, "sms_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := h.Db.WithContext(c.UserContext()).ReleaseSmsCredit(userID, serviceID, smsID, db.SmsStatusCancelled); err != nil {
+		if errors.Is(err, db.ErrSmsNotQueued) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "message is not queued"})
+		}
+		h.Logger.Ctx(c.UserContext()).Error("[sms-cancel] failed to release reserved credit", logger.ServiceID(serviceID), logger.SmsID(smsID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+	return c.JSON(fiber.Map{"status": db.SmsStatusCancelled, "sms_id": smsID})
+}
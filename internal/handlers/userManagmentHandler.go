@@ -1,12 +1,17 @@
 package handlers
 
 import (
+	"errors"
+	"net/mail"
 	"strconv"
 	"strings"
+	"time"
 
+	"postchi/internal/alerts"
 	"postchi/internal/handlers/requests"
 	"postchi/internal/helpers"
 	"postchi/internal/metrics"
+	"postchi/internal/privacy"
 	"postchi/pkg/db"
 	"postchi/pkg/env"
 	"postchi/pkg/logger"
@@ -19,6 +24,8 @@ type UserManagementHandler struct {
 	Logger  logger.LoggerInterface
 	Metrics *metrics.Metrics
 	Db      db.DataBaseInterface
+	Alerts  alerts.NotifierInterface
+	Privacy privacy.MaskerInterface
 }
 
 type UserHandlerInterface interface {
@@ -27,16 +34,31 @@ type UserHandlerInterface interface {
 	ChargeService(c *fiber.Ctx) error
 	GetUserServiceStatus(c *fiber.Ctx) error
 
+	// ConfigureServiceAlerts sets the low-balance threshold and where alerts are sent.
+	ConfigureServiceAlerts(c *fiber.Ctx) error
+
+	// ConfigureServiceLimits sets the API request rate and message quotas of a service.
+	ConfigureServiceLimits(c *fiber.Ctx) error
+
+	// ConfigureServiceRetention sets how long messages are kept and what
+	// happens to them afterwards.
+	ConfigureServiceRetention(c *fiber.Ctx) error
+
+	// GetServicePurges lists the retention batches purged from a service.
+	GetServicePurges(c *fiber.Ctx) error
+
 	// GetServiceMessages returns a paginated list of SMS messages for a user’s service.
 	GetServiceMessages(c *fiber.Ctx) error
 }
 
-func UserHandlerInit(l logger.LoggerInterface, envs *env.Envs, m *metrics.Metrics, db db.DataBaseInterface) UserHandlerInterface {
+func UserHandlerInit(l logger.LoggerInterface, envs *env.Envs, m *metrics.Metrics, db db.DataBaseInterface, a alerts.NotifierInterface, p privacy.MaskerInterface) UserHandlerInterface {
 	return &UserManagementHandler{
 		Envs:    envs,
 		Logger:  l,
 		Metrics: m,
 		Db:      db,
+		Alerts:  a,
+		Privacy: p,
 	}
 }
 
@@ -60,7 +82,7 @@ func (h *UserManagementHandler) CreateUser(c *fiber.Ctx) error {
 		})
 	}
 	if err := h.Db.CreateUser(req.Name, req.Password); err != nil {
-		h.Logger.StdLog("error", "CreateUser: "+err.Error())
+		h.Logger.Ctx(c.UserContext()).Error("CreateUser", logger.Err(err))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create user"})
 	}
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
@@ -86,7 +108,7 @@ func (h *UserManagementHandler) CreateServiceForUser(c *fiber.Ctx) error {
 	}
 	err = h.Db.CreateUserService(userID, serviceType, int(req.InitialCredit))
 	if err != nil {
-		h.Logger.StdLog("error", "CreateServiceForUser: "+err.Error())
+		h.Logger.Ctx(c.UserContext()).Error("CreateServiceForUser", logger.UserID(userID), logger.Err(err))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to create service"})
 	}
 
@@ -119,9 +141,10 @@ func (h *UserManagementHandler) ChargeService(c *fiber.Ctx) error {
 	}
 
 	if err := h.Db.UpdateServiceCredit(userID, serviceID, int(req.CreditAmount)); err != nil {
-		h.Logger.StdLog("error", "ChargeService: "+err.Error())
+		h.Logger.Ctx(c.UserContext()).Error("ChargeService", logger.UserID(userID), logger.ServiceID(serviceID), logger.Err(err))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update credits"})
 	}
+	h.Alerts.CheckLowBalance(serviceID)
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "charged",
@@ -137,17 +160,32 @@ func (h *UserManagementHandler) GetUserServiceStatus(c *fiber.Ctx) error {
 
 	svcs, err := h.Db.GetUserServices(userID)
 	if err != nil {
-		h.Logger.StdLog("error", "GetUserServiceStatus: "+err.Error())
+		h.Logger.Ctx(c.UserContext()).Error("GetUserServiceStatus", logger.UserID(userID), logger.Err(err))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
 	}
 
 	resp := make([]fiber.Map, 0, len(svcs))
 	for _, s := range svcs {
 		resp = append(resp, fiber.Map{
-			"id":      s.ID,
-			"type":    s.Type,
-			"status":  s.Status,
-			"credits": s.Credits,
+			"id":        s.ID,
+			"type":      s.Type,
+			"status":    s.Status,
+			"available": s.Credits,
+			"reserved":  s.Reserved,
+			"low_balance": fiber.Map{
+				"threshold": s.LowBalanceThreshold,
+				"below":     s.LowBalanceThreshold > 0 && s.Credits < s.LowBalanceThreshold,
+				"alerted":   s.LowBalanceAlerted,
+			},
+			"limits": fiber.Map{
+				"requests_per_minute": s.RequestsPerMinute,
+				"daily_quota":         s.DailyQuota,
+				"monthly_quota":       s.MonthlyQuota,
+			},
+			"retention": fiber.Map{
+				"days":   s.RetentionDays,
+				"action": s.RetentionAction,
+			},
 		})
 	}
 	return c.JSON(fiber.Map{
@@ -156,56 +194,234 @@ func (h *UserManagementHandler) GetUserServiceStatus(c *fiber.Ctx) error {
 	})
 }
 
+// POST /account/:user_id/services/:service_id/alerts
+// body: { "low_balance_threshold": 500, "email": "ops@example.com", "sms_receptor": "0912...", "webhook_url": "https://..." }
+// A zero threshold disables low-balance alerts.
+func (h *UserManagementHandler) ConfigureServiceAlerts(c *fiber.Ctx) error {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req requests.ServiceAlertsReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json"})
+	}
+	req.WebhookUrl = strings.TrimSpace(req.WebhookUrl)
+	if req.WebhookUrl != "" {
+		if err := alerts.CheckWebhookURL(c.UserContext(), req.WebhookUrl); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	// only a bare address is stored so it can never carry extra mail headers
+	email := strings.TrimSpace(req.Email)
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "email must be a valid address"})
+		}
+		email = addr.Address
+	}
+
+	err = h.Db.UpdateServiceAlerts(userID, serviceID, req.LowBalanceThreshold,
+		email, strings.TrimSpace(req.SmsReceptor), req.WebhookUrl)
+	if err != nil {
+		if err.Error() == "service not found" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "service not found"})
+		}
+		h.Logger.Ctx(c.UserContext()).Error("ConfigureServiceAlerts", logger.UserID(userID), logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update alerts"})
+	}
+	h.Alerts.CheckLowBalance(serviceID)
+
+	return c.JSON(fiber.Map{"message": "alerts updated"})
+}
+
+// POST /account/:user_id/services/:service_id/limits
+// body: { "requests_per_minute": 600, "daily_quota": 10000, "monthly_quota": 200000 }
+// Zero disables the corresponding limit.
+func (h *UserManagementHandler) ConfigureServiceLimits(c *fiber.Ctx) error {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req requests.ServiceLimitsReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json"})
+	}
+
+	if err := h.Db.UpdateServiceLimits(userID, serviceID, req.RequestsPerMinute, req.DailyQuota, req.MonthlyQuota); err != nil {
+		if err.Error() == "service not found" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "service not found"})
+		}
+		h.Logger.Ctx(c.UserContext()).Error("ConfigureServiceLimits", logger.UserID(userID), logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update limits"})
+	}
+
+	return c.JSON(fiber.Map{"message": "limits updated"})
+}
+
+// POST /account/:user_id/services/:service_id/retention
+// body: { "retention_days": 90, "action": "delete" | "anonymize" }
+// A retention of 0 keeps messages forever.
+func (h *UserManagementHandler) ConfigureServiceRetention(c *fiber.Ctx) error {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req requests.ServiceRetentionReq
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid json"})
+	}
+	action := db.RetentionAction(req.Action)
+	switch action {
+	case "":
+		action = db.RetentionDelete
+	case db.RetentionDelete, db.RetentionAnonymize:
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "action must be delete or anonymize"})
+	}
+
+	if err := h.Db.UpdateServiceRetention(userID, serviceID, req.RetentionDays, action); err != nil {
+		if err.Error() == "service not found" {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "service not found"})
+		}
+		h.Logger.Ctx(c.UserContext()).Error("ConfigureServiceRetention", logger.UserID(userID), logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to update retention"})
+	}
+
+	return c.JSON(fiber.Map{"message": "retention updated", "retention_days": req.RetentionDays, "action": action})
+}
+
+// GET /account/:user_id/services/:service_id/purges?limit=50
+func (h *UserManagementHandler) GetServicePurges(c *fiber.Ctx) error {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	limit := c.QueryInt("limit", 50)
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
+
+	if _, err := h.Db.GetUserService(userID, serviceID); err != nil {
+		if errors.Is(err, db.ErrServiceNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "service not found"})
+		}
+		h.Logger.Ctx(c.UserContext()).Error("GetServicePurges", logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+	records, err := h.Db.ListPurgeRecords(serviceID, limit)
+	if err != nil {
+		h.Logger.Ctx(c.UserContext()).Error("GetServicePurges", logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+
+	resp := make([]fiber.Map, 0, len(records))
+	for _, r := range records {
+		resp = append(resp, fiber.Map{
+			"id":           r.ID,
+			"purged_at":    r.CreatedAt,
+			"action":       r.Action,
+			"count":        r.Count,
+			"first_sms_id": r.FirstSmsId,
+			"last_sms_id":  r.LastSmsId,
+			"before":       r.Before,
+			"archive":      r.ArchiveURI,
+		})
+	}
+	return c.JSON(fiber.Map{"service_id": serviceID, "purges": resp})
+}
+
 // GetServiceMessages handles GET /account/:user_id/services/:service_id/messages
-// It returns a paginated list of SMS messages belonging to the specified service.
-// Query parameters `page` and `size` control pagination; defaults are page=1,
-// size=10. The response includes the message records sorted by creation time
-// descending.
+// It returns one page of the service's SMS messages, newest first. Pages are
+// keyed by message id: pass the previous response's `next_cursor` as `cursor`
+// to continue; `size` defaults to 10 and is capped at 100. Optional filters:
+// `status` (comma-separated), `receptor`, `provider`, `from`/`to` (RFC3339),
+// and `q` for a content substring. `total=true` adds the number of matching
+// messages. Receptors and one-time codes are masked unless the caller's
+// access token maps to a role in PII_UNMASKED_ROLES.
 func (h *UserManagementHandler) GetServiceMessages(c *fiber.Ctx) error {
 	// parse user and service IDs
 	userID, err := helpers.ParseUintParam(c, "user_id")
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-	serviceIDRaw := c.Params("service_id")
-	serviceID64, err := strconv.ParseUint(serviceIDRaw, 10, 64)
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invalid service_id"})
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-	serviceID := uint(serviceID64)
 
-	// parse pagination parameters
-	pageStr := c.Query("page", "1")
-	sizeStr := c.Query("size", "10")
-	page, err := strconv.Atoi(pageStr)
-	if err != nil || page < 1 {
-		page = 1
+	filter, err := parseSmsFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
-	size, err := strconv.Atoi(sizeStr)
-	if err != nil || size < 1 {
-		size = 10
+	filter.UserId = userID
+	filter.ServiceId = serviceID
+
+	// receptors and one-time codes are masked unless the caller's role may see them
+	role := h.Privacy.Role(c)
+
+	// a search must not reveal content the caller would only see masked
+	if filter.Search != "" {
+		allowed, excludeOtp := h.Privacy.SearchableContent(role)
+		if !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "content search is not allowed for this role"})
+		}
+		filter.ExcludeOtp = excludeOtp
 	}
-	// cap the size to a reasonable limit to prevent abuse
-	if size > 100 {
-		size = 100
+
+	if _, err := h.Db.GetUserService(userID, serviceID); err != nil {
+		if errors.Is(err, db.ErrServiceNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "service not found"})
+		}
+		h.Logger.Ctx(c.UserContext()).Error("GetServiceMessages", logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
 	}
-	offset := (page - 1) * size
 
-	// fetch messages from database
-	messages, err := h.Db.GetServiceSms(serviceID, offset, size)
+	page, err := h.Db.ListSms(filter)
 	if err != nil {
-		h.Logger.StdLog("error", "GetServiceMessages: "+err.Error())
+		if errors.Is(err, db.ErrTotalUnavailable) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		// encrypted rows exist but CONTENT_KEY_FILE is not set on this instance
+		if errors.Is(err, db.ErrNoContentKey) {
+			h.Logger.Ctx(c.UserContext()).Error("GetServiceMessages", logger.ServiceID(serviceID), logger.Err(err))
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "message content is encrypted and no content key is configured"})
+		}
+		h.Logger.Ctx(c.UserContext()).Error("GetServiceMessages", logger.ServiceID(serviceID), logger.Err(err))
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
 	}
+	messages := page.Messages
 
 	// build response list
-	resp := make([]fiber.Map, 0, len(messages))
+	list := make([]fiber.Map, 0, len(messages))
 	for _, m := range messages {
-		resp = append(resp, fiber.Map{
+		list = append(list, fiber.Map{
 			"id":         m.ID,
-			"content":    m.Content,
+			"content":    h.Privacy.Content(role, m.Content, m.Otp),
+			"otp":        m.Otp,
 			"status":     m.Status,
-			"receptor":   m.Receptor,
+			"receptor":   h.Privacy.Receptor(role, m.Receptor),
 			"sent_time":  m.SentTime,
 			"cost":       m.Cost,
 			"provider":   m.ServiceProviderName,
@@ -213,11 +429,79 @@ func (h *UserManagementHandler) GetServiceMessages(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(fiber.Map{
-		"user_id":    userID,
-		"service_id": serviceID,
-		"page":       page,
-		"size":       size,
-		"messages":   resp,
-	})
+	resp := fiber.Map{
+		"user_id":     userID,
+		"service_id":  serviceID,
+		"size":        filter.Limit,
+		"next_cursor": page.NextCursor,
+		"has_more":    page.NextCursor != 0,
+		"masked":      !h.Privacy.Unmasked(role),
+		"messages":    list,
+	}
+	if page.Total != nil {
+		resp["total"] = *page.Total
+	}
+	return c.JSON(resp)
+}
+
+// parseSmsFilter reads the paging and filter query parameters of a message
+// listing.
+func parseSmsFilter(c *fiber.Ctx) (db.SmsFilter, error) {
+	f := db.SmsFilter{
+		Receptor:  strings.TrimSpace(c.Query("receptor")),
+		Provider:  strings.TrimSpace(c.Query("provider")),
+		Search:    c.Query("q"),
+		WithTotal: c.QueryBool("total", false),
+	}
+
+	f.Limit = c.QueryInt("size", 10)
+	if f.Limit < 1 {
+		f.Limit = 10
+	}
+	// cap the size to a reasonable limit to prevent abuse
+	if f.Limit > 100 {
+		f.Limit = 100
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return f, errors.New("invalid cursor")
+		}
+		f.Cursor = uint(cursor)
+	}
+
+	if raw := c.Query("status"); raw != "" {
+		for _, s := range strings.Split(raw, ",") {
+			status := db.SmsStatus(strings.TrimSpace(s))
+			switch status {
+			case db.SmsStatusQueued, db.SmsStatusSending, db.SmsStatusSent,
+				db.SmsStatusDelivered, db.SmsStatusFailed, db.SmsStatusCancelled, db.SmsStatusUncaptured:
+				f.Statuses = append(f.Statuses, status)
+			default:
+				return f, errors.New("invalid status " + string(status))
+			}
+		}
+	}
+
+	var err error
+	if f.From, err = parseTimeQuery(c, "from"); err != nil {
+		return f, err
+	}
+	if f.To, err = parseTimeQuery(c, "to"); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func parseTimeQuery(c *fiber.Ctx, key string) (time.Time, error) {
+	raw := c.Query(key)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, errors.New("invalid " + key + ": expected RFC3339")
+	}
+	return t, nil
 }
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"postchi/internal/privacy"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// listingDb serves one service whose listing fails with listErr.
+type listingDb struct {
+	db.DataBaseInterface
+	listErr error
+}
+
+func (f *listingDb) GetUserService(userId uint, serviceId uint) (db.Service, error) {
+	return db.Service{}, nil
+}
+
+func (f *listingDb) ListSms(filter db.SmsFilter) (db.SmsPage, error) {
+	return db.SmsPage{}, f.listErr
+}
+
+func TestGetServiceMessagesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		listErr error
+		want    int
+	}{
+		{"listed", nil, fiber.StatusOK},
+		{"total with encrypted search", db.ErrTotalUnavailable, fiber.StatusBadRequest},
+		{"encrypted rows without a content key", db.ErrNoContentKey, fiber.StatusServiceUnavailable},
+	}
+
+	masker, err := privacy.MaskerInit(&env.Envs{PII_MASK_CONTENT: privacy.MaskContentOtp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &UserManagementHandler{
+				Logger:  &logger.Logger{Log: zap.NewNop()},
+				Db:      &listingDb{listErr: tt.listErr},
+				Privacy: masker,
+			}
+			app := fiber.New()
+			app.Get("/:user_id/:service_id", h.GetServiceMessages)
+
+			resp, err := app.Test(httptest.NewRequest("GET", "/1/7", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package health
+
+import (
+	"context"
+	"fmt"
+
+	"postchi/internal/sms"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/kafka"
+)
+
+func DatabaseCheck(d db.DataBaseInterface) CheckFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		return nil, d.Ping(ctx)
+	}
+}
+
+// KafkaCheck dials a broker and verifies the topics exist.
+func KafkaCheck(k kafka.KafkaInterface, topics ...string) CheckFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		partitions, err := k.Ping(ctx, topics...)
+		return map[string]interface{}{"partitions": partitions}, err
+	}
+}
+
+// ConsumerLagCheck fails when the lag of any lane exceeds maxLag; a zero
+// maxLag only reports the lag.
+func ConsumerLagCheck(lag func() map[string]int64, maxLag int64) CheckFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		lags := lag()
+		detail := map[string]interface{}{"lag": lags, "max_lag": maxLag}
+		if maxLag <= 0 {
+			return detail, nil
+		}
+		for lane, l := range lags {
+			if l > maxLag {
+				return detail, fmt.Errorf("lane %s lag %d exceeds %d", lane, l, maxLag)
+			}
+		}
+		return detail, nil
+	}
+}
+
+// ProviderCheck reports whether the provider's upstream API is reachable.
+func ProviderCheck(e *env.Envs, name string) CheckFunc {
+	return func(ctx context.Context) (interface{}, error) {
+		prov, err := sms.NewProvider(e, name)
+		if err != nil {
+			return nil, err
+		}
+		p, ok := prov.(sms.Pinger)
+		if !ok {
+			return map[string]interface{}{"checked": false}, nil
+		}
+		return nil, p.Ping(ctx)
+	}
+}
@@ -0,0 +1,163 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const checkTimeout = 3 * time.Second
+
+const (
+	StatusUp       = "up"
+	StatusDown     = "down"
+	StatusDegraded = "degraded"
+)
+
+// CheckFunc probes one dependency. The returned detail is included in the
+// readiness report whether or not the check failed.
+type CheckFunc func(ctx context.Context) (detail interface{}, err error)
+
+type Result struct {
+	Status    string      `json:"status"`
+	Critical  bool        `json:"critical"`
+	Detail    interface{} `json:"detail,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	LatencyMs int64       `json:"latency_ms"`
+	CheckedAt time.Time   `json:"checked_at"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type check struct {
+	critical bool
+	run      CheckFunc
+
+	mu     sync.Mutex
+	result Result
+}
+
+// Registry runs dependency checks for /readyz. Results are cached for the
+// configured TTL so frequent probes do not hammer the dependencies.
+type Registry struct {
+	ttl     time.Duration
+	started time.Time
+
+	mu     sync.RWMutex
+	checks map[string]*check
+}
+
+func RegistryInit(ttl time.Duration) *Registry {
+	return &Registry{ttl: ttl, started: time.Now(), checks: make(map[string]*check)}
+}
+
+// Register adds or replaces a check. A failing critical check makes the
+// process not ready; a failing non-critical one only degrades the report.
+func (r *Registry) Register(name string, critical bool, run CheckFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[name] = &check{critical: critical, run: run}
+}
+
+func (c *check) get(ctx context.Context, ttl time.Duration) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.result.CheckedAt.IsZero() && time.Since(c.result.CheckedAt) < ttl {
+		return c.result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	start := time.Now()
+	detail, err := c.run(ctx)
+
+	res := Result{
+		Status:    StatusUp,
+		Critical:  c.critical,
+		Detail:    detail,
+		LatencyMs: time.Since(start).Milliseconds(),
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		res.Status = StatusDown
+		res.Error = err.Error()
+	}
+	c.result = res
+	return res
+}
+
+// Readiness runs every check concurrently, honouring the cache.
+func (r *Registry) Readiness(ctx context.Context) Report {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.checks))
+	for name := range r.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]*check, len(names))
+	for i, name := range names {
+		checks[i] = r.checks[name]
+	}
+	r.mu.RUnlock()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			results[i] = c.get(ctx, r.ttl)
+		}(i, c)
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusUp, Checks: make(map[string]Result, len(names))}
+	for i, name := range names {
+		res := results[i]
+		report.Checks[name] = res
+		if res.Status == StatusUp {
+			continue
+		}
+		if res.Critical {
+			report.Status = StatusDown
+		} else if report.Status == StatusUp {
+			report.Status = StatusDegraded
+		}
+	}
+	return report
+}
+
+// LivenessHandler only reports that the process is serving; it never checks
+// dependencies so an outage elsewhere does not get the process restarted.
+func (r *Registry) LivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":         StatusUp,
+			"uptime_seconds": int64(time.Since(r.started).Seconds()),
+		})
+	}
+}
+
+// ReadinessHandler answers 503 when a critical dependency is down.
+func (r *Registry) ReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := r.Readiness(req.Context())
+		code := http.StatusOK
+		if report.Status == StatusDown {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, report)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
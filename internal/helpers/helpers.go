@@ -5,9 +5,9 @@ import (
 	"fmt"
 	"postchi/pkg/db"
 	"postchi/pkg/env"
+	"postchi/pkg/kafka"
 	"strconv"
 	"strings"
-	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -24,28 +24,78 @@ func ParseUintParam(c *fiber.Ctx, name string) (uint, error) {
 func ToServiceType(s string) (db.ServiceType, error) {
 	switch strings.ToLower(strings.TrimSpace(s)) {
 	case "express":
-		return db.ServiceType("express"), nil
-	case "indirect":
-		return db.ServiceType("indirect"), nil
+		return db.ServiceTypeExpress, nil
+	// "indirect" is the name the type had before it was stored as async
+	case "async", "indirect":
+		return db.ServiceTypeAsync, nil
 	default:
-		return "", errors.New("type must be 'express' or 'indirect'")
+		return "", errors.New("type must be 'express' or 'async'")
 	}
 }
 
-func CalculateCost(envs *env.Envs, s string, serviceType string) uint {
-	var costPerChar int
+// ToPriority validates a send priority; an empty value means normal.
+func ToPriority(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return kafka.PriorityNormal, nil
+	case kafka.PriorityHigh:
+		return kafka.PriorityHigh, nil
+	case kafka.PriorityNormal:
+		return kafka.PriorityNormal, nil
+	case kafka.PriorityLow:
+		return kafka.PriorityLow, nil
+	default:
+		return "", errors.New("priority must be 'high', 'normal' or 'low'")
+	}
+}
+
+// TopicForPriority returns the Kafka topic of a priority lane.
+func TopicForPriority(envs *env.Envs, priority string) string {
+	switch priority {
+	case kafka.PriorityHigh:
+		return envs.KAFKA_TOPIC_SMS_HIGH
+	case kafka.PriorityLow:
+		return envs.KAFKA_TOPIC_SMS_LOW
+	default:
+		return envs.KAFKA_TOPIC_SMS
+	}
+}
+
+// CalculateCost prices a message per billed segment for the given service type.
+func CalculateCost(envs *env.Envs, s string, serviceType string) (uint, SegmentInfo) {
+	var costPerSegment int
 	switch serviceType {
 	case "express":
-		costPerChar = envs.COST_PER_CHAR_EXPRESS
+		costPerSegment = envs.COST_PER_SEGMENT_EXPRESS
 
 	case "async":
-		costPerChar = envs.COST_PER_CHAR_ASYNC
+		costPerSegment = envs.COST_PER_SEGMENT_ASYNC
 
 	}
-	charCount := utf8.RuneCountInString(s)
-	if charCount < 0 {
-		charCount = 0
+	info := CountSegments(s)
+	if costPerSegment < 0 {
+		costPerSegment = 0
+	}
+	total := info.Segments * costPerSegment
+	return uint(total), info
+}
+
+// NormalizeReceptor converts a phone number to international digits without a
+// leading plus, e.g. "0912 345 6789" and "+989123456789" become "989123456789".
+func NormalizeReceptor(s string) string {
+	var b strings.Builder
+	for _, r := range strings.TrimSpace(s) {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	n := b.String()
+	switch {
+	case strings.HasPrefix(n, "00"):
+		return n[2:]
+	case strings.HasPrefix(n, "0"):
+		return "98" + n[1:]
+	default:
+		return n
 	}
-	total := charCount * costPerChar
-	return uint(total)
 }
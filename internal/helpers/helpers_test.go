@@ -0,0 +1,83 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+
+	"postchi/pkg/env"
+)
+
+func TestCalculateCost(t *testing.T) {
+	envs := &env.Envs{COST_PER_SEGMENT_EXPRESS: 3, COST_PER_SEGMENT_ASYNC: 1}
+
+	tests := []struct {
+		name        string
+		envs        *env.Envs
+		text        string
+		serviceType string
+		want        uint
+	}{
+		{"empty text is free", envs, "", "express", 0},
+		{"express single part", envs, strings.Repeat("a", 160), "express", 3},
+		{"express two parts", envs, strings.Repeat("a", 161), "express", 6},
+		{"async single part", envs, strings.Repeat("س", 70), "async", 1},
+		{"async two parts", envs, strings.Repeat("س", 71), "async", 2},
+		{"extension characters can add a part", envs, strings.Repeat("€", 80) + "a", "async", 2},
+		{"unknown service type has no price", envs, "hello", "indirect", 0},
+		{"negative price is clamped", &env.Envs{COST_PER_SEGMENT_EXPRESS: -5}, "hello", "express", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, info := CalculateCost(tt.envs, tt.text, tt.serviceType)
+			if got != tt.want {
+				t.Fatalf("got cost %d for %d segments, want %d", got, info.Segments, tt.want)
+			}
+		})
+	}
+}
+
+// The deprecated COST_PER_CHAR_* variables still set the price, which is now
+// charged per segment.
+func TestCalculateCostDeprecatedEnvs(t *testing.T) {
+	tests := []struct {
+		name        string
+		vars        map[string]string
+		serviceType string
+		want        uint
+		warnings    int
+	}{
+		{
+			name:        "per-char value is used per segment",
+			vars:        map[string]string{"COST_PER_CHAR_EXPRESS": "5", "COST_PER_SEGMENT_ASYNC": "1"},
+			serviceType: "express",
+			want:        10,
+			warnings:    1,
+		},
+		{
+			name:        "per-segment value wins over per-char",
+			vars:        map[string]string{"COST_PER_SEGMENT_EXPRESS": "3", "COST_PER_CHAR_EXPRESS": "5", "COST_PER_SEGMENT_ASYNC": "1", "COST_PER_CHAR_ASYNC": "9"},
+			serviceType: "async",
+			want:        2,
+			warnings:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SMS_WORKER_COUNT", "1")
+			for _, name := range []string{"COST_PER_SEGMENT_EXPRESS", "COST_PER_SEGMENT_ASYNC", "COST_PER_CHAR_EXPRESS", "COST_PER_CHAR_ASYNC"} {
+				t.Setenv(name, tt.vars[name])
+			}
+			envs := env.ReadEnvs()
+
+			got, _ := CalculateCost(&envs, strings.Repeat("a", 161), tt.serviceType)
+			if got != tt.want {
+				t.Fatalf("got cost %d, want %d", got, tt.want)
+			}
+			if len(envs.Warnings) != tt.warnings {
+				t.Fatalf("got warnings %q, want %d", envs.Warnings, tt.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package helpers
+
+import (
+	"unicode/utf16"
+)
+
+type SmsEncoding string
+
+const (
+	EncodingGSM7 SmsEncoding = "gsm7"
+	EncodingUCS2 SmsEncoding = "ucs2"
+)
+
+const (
+	gsm7SingleSegment = 160
+	gsm7MultiSegment  = 153
+	ucs2SingleSegment = 70
+	ucs2MultiSegment  = 67
+)
+
+// gsm7Basic is the GSM 03.38 default alphabet, each character costs one septet.
+var gsm7Basic = map[rune]bool{}
+
+// gsm7Extended characters are sent with an escape prefix and cost two septets.
+var gsm7Extended = map[rune]bool{
+	'\f': true, '^': true, '{': true, '}': true, '\\': true,
+	'[': true, '~': true, ']': true, '|': true, '€': true,
+}
+
+func init() {
+	const basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+		"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	for _, r := range basic {
+		gsm7Basic[r] = true
+	}
+}
+
+type SegmentInfo struct {
+	Encoding SmsEncoding `json:"encoding"`
+	Units    int         `json:"units"`
+	Segments int         `json:"segments"`
+}
+
+// DetectEncoding returns GSM-7 when every character of s is representable in
+// the GSM default or extension table, otherwise UCS-2.
+func DetectEncoding(s string) SmsEncoding {
+	for _, r := range s {
+		if !gsm7Basic[r] && !gsm7Extended[r] {
+			return EncodingUCS2
+		}
+	}
+	return EncodingGSM7
+}
+
+// CountSegments reports how many SMS parts an operator bills for s. Extended
+// GSM characters and UTF-16 surrogate pairs are never split across parts.
+func CountSegments(s string) SegmentInfo {
+	enc := DetectEncoding(s)
+
+	var widths []int
+	for _, r := range s {
+		switch {
+		case enc == EncodingGSM7 && gsm7Extended[r]:
+			widths = append(widths, 2)
+		case enc == EncodingUCS2:
+			widths = append(widths, len(utf16.Encode([]rune{r})))
+		default:
+			widths = append(widths, 1)
+		}
+	}
+
+	single, multi := gsm7SingleSegment, gsm7MultiSegment
+	if enc == EncodingUCS2 {
+		single, multi = ucs2SingleSegment, ucs2MultiSegment
+	}
+
+	units := 0
+	for _, w := range widths {
+		units += w
+	}
+	info := SegmentInfo{Encoding: enc, Units: units}
+	if units == 0 {
+		return info
+	}
+	if units <= single {
+		info.Segments = 1
+		return info
+	}
+
+	segments, used := 1, 0
+	for _, w := range widths {
+		if used+w > multi {
+			segments++
+			used = 0
+		}
+		used += w
+	}
+	info.Segments = segments
+	return info
+}
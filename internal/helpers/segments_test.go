@@ -0,0 +1,51 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCountSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		encoding SmsEncoding
+		units    int
+		segments int
+	}{
+		{"empty", "", EncodingGSM7, 0, 0},
+
+		{"gsm7 basic characters", "Hello @£$ Ñ¿ Δ_", EncodingGSM7, 15, 1},
+		{"gsm7 at single limit", strings.Repeat("a", 160), EncodingGSM7, 160, 1},
+		{"gsm7 one past single limit", strings.Repeat("a", 161), EncodingGSM7, 161, 2},
+		{"gsm7 at two parts", strings.Repeat("a", 306), EncodingGSM7, 306, 2},
+		{"gsm7 one past two parts", strings.Repeat("a", 307), EncodingGSM7, 307, 3},
+
+		{"extension characters count twice", "{}[]~|^€\\\f", EncodingGSM7, 20, 1},
+		{"extension at single limit", strings.Repeat("€", 80), EncodingGSM7, 160, 1},
+		{"extension one past single limit", strings.Repeat("€", 80) + "a", EncodingGSM7, 161, 2},
+		// a naive ceil(306/153) says 2, but the escape pair cannot straddle parts
+		{"extension never split across parts", strings.Repeat("a", 152) + "€" + strings.Repeat("a", 152), EncodingGSM7, 306, 3},
+
+		{"ucs2 for characters outside gsm7", "salam ç", EncodingUCS2, 7, 1},
+		{"ucs2 for persian", "سلام", EncodingUCS2, 4, 1},
+		{"ucs2 at single limit", strings.Repeat("س", 70), EncodingUCS2, 70, 1},
+		{"ucs2 one past single limit", strings.Repeat("س", 71), EncodingUCS2, 71, 2},
+		{"ucs2 at two parts", strings.Repeat("س", 134), EncodingUCS2, 134, 2},
+		{"ucs2 one past two parts", strings.Repeat("س", 135), EncodingUCS2, 135, 3},
+
+		{"surrogate pairs count twice", strings.Repeat("😀", 35), EncodingUCS2, 70, 1},
+		{"surrogate pairs one past single limit", strings.Repeat("😀", 35) + "س", EncodingUCS2, 71, 2},
+		{"surrogate pair never split across parts", strings.Repeat("س", 66) + "😀" + strings.Repeat("س", 66), EncodingUCS2, 134, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CountSegments(tt.text)
+			want := SegmentInfo{Encoding: tt.encoding, Units: tt.units, Segments: tt.segments}
+			if got != want {
+				t.Fatalf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
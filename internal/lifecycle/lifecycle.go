@@ -0,0 +1,88 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"postchi/pkg/logger"
+)
+
+const (
+	ExitOK      = 0
+	ExitFailure = 1
+)
+
+type stopper struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// Manager stops registered components in reverse registration order once the
+// process receives SIGINT/SIGTERM or a component reports a fatal error. All
+// stops share one deadline.
+type Manager struct {
+	Logger  logger.LoggerInterface
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	stoppers []stopper
+	failed   chan error
+	once     sync.Once
+}
+
+func ManagerInit(l logger.LoggerInterface, timeout time.Duration) *Manager {
+	return &Manager{Logger: l, Timeout: timeout, failed: make(chan error, 1)}
+}
+
+// Register adds a component; register dependencies before their users so
+// users are stopped first (e.g. the DB before the HTTP server).
+func (m *Manager) Register(name string, stop func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stoppers = append(m.stoppers, stopper{name: name, stop: stop})
+}
+
+// Fail triggers shutdown because a component can no longer run.
+func (m *Manager) Fail(name string, err error) {
+	m.once.Do(func() {
+		m.failed <- fmt.Errorf("%s: %w", name, err)
+	})
+}
+
+// Wait blocks until shutdown is requested, stops every component and returns
+// the process exit code.
+func (m *Manager) Wait() int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	code := ExitOK
+	select {
+	case <-ctx.Done():
+		m.Logger.Info("[lifecycle] shutdown requested")
+	case err := <-m.failed:
+		m.Logger.Error("[lifecycle] shutting down after failure", logger.Err(err))
+		code = ExitFailure
+	}
+
+	deadline, cancel := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancel()
+
+	m.mu.Lock()
+	stoppers := m.stoppers
+	m.mu.Unlock()
+	for i := len(stoppers) - 1; i >= 0; i-- {
+		s := stoppers[i]
+		start := time.Now()
+		if err := s.stop(deadline); err != nil {
+			m.Logger.Error("[lifecycle] stopping component failed", logger.String("component", s.name), logger.Err(err))
+			code = ExitFailure
+			continue
+		}
+		m.Logger.Info("[lifecycle] stopped component", logger.String("component", s.name), logger.Duration("elapsed", time.Since(start)))
+	}
+	return code
+}
@@ -2,45 +2,158 @@ package metrics
 
 import (
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+const namespace = "postchi"
+
+// Message outcomes recorded in SmsMessages. Delivered is reserved for
+// provider delivery reports.
+const (
+	StatusAccepted  = "accepted"
+	StatusSent      = "sent"
+	StatusFailed    = "failed"
+	StatusDelivered = "delivered"
+)
+
+// Provider call results recorded in ProviderRequestDuration.
+const (
+	ResultOK          = "ok"
+	ResultError       = "error"
+	ResultRateLimited = "rate_limited"
+)
+
+// UnknownProvider labels messages whose provider name was not recognised, so
+// free-form input never becomes a label value.
+const UnknownProvider = "unknown"
+
 type Metrics struct {
-	SmsProviderErrors             *prometheus.CounterVec
-	SmsProviderResponseTimeHistogram    *prometheus.HistogramVec
+	SmsMessages             *prometheus.CounterVec
+	CreditsSpent            *prometheus.CounterVec
+	ProviderRequestDuration *prometheus.HistogramVec
+	QueueDepth              *prometheus.GaugeVec
+	ConsumerLag             *prometheus.GaugeVec
+	WorkerInFlight          prometheus.Gauge
+	HttpRequestDuration     *prometheus.HistogramVec
 }
 
 func InitMetrics() *Metrics {
 
 	m := &Metrics{
-		SmsProviderErrors: prometheus.NewCounterVec(
+		SmsMessages: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
-				Namespace: "katana",
-				Name:      "ceph_uploaded",
-				Help:      "Number of files uploaded by katana in minio",
-			}, []string{"status", "channel"},
+				Namespace: namespace,
+				Name:      "sms_messages_total",
+				Help:      "Number of SMS messages by provider, service type and outcome.",
+			}, []string{"provider", "service_type", "status"},
 		),
-		SmsProviderResponseTimeHistogram: prometheus.NewHistogramVec(
+		CreditsSpent: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "sms_credits_spent_total",
+				Help:      "Credits captured for sent SMS messages.",
+			}, []string{"provider", "service_type"},
+		),
+		ProviderRequestDuration: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
-				Namespace: "katana",
-				Name:      "katana_http_response_time_index",
-				Help:      "Histogram of response times for index HTTP requests.",
+				Namespace: namespace,
+				Name:      "sms_provider_request_duration_seconds",
+				Help:      "Duration of send requests to SMS providers.",
 				Buckets:   prometheus.DefBuckets,
+			}, []string{"provider", "result"},
+		),
+		QueueDepth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "worker_queue_depth",
+				Help:      "Messages fetched from Kafka and waiting for a worker, per priority lane.",
+			}, []string{"lane"},
+		),
+		ConsumerLag: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "kafka_consumer_lag",
+				Help:      "Kafka consumer lag per priority lane.",
+			}, []string{"lane"},
+		),
+		WorkerInFlight: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "worker_in_flight",
+				Help:      "Messages currently being processed by workers.",
 			},
-			[]string{"status_code", "channel"},
 		),
-
+		HttpRequestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "http_request_duration_seconds",
+				Help:      "Duration of HTTP requests by route.",
+				Buckets:   prometheus.DefBuckets,
+			}, []string{"method", "route", "status_code"},
+		),
 	}
-	prometheus.MustRegister(m.SmsProviderErrors)
-	prometheus.MustRegister(m.SmsProviderResponseTimeHistogram)
+	prometheus.MustRegister(
+		m.SmsMessages,
+		m.CreditsSpent,
+		m.ProviderRequestDuration,
+		m.QueueDepth,
+		m.ConsumerLag,
+		m.WorkerInFlight,
+		m.HttpRequestDuration,
+	)
 
 	return m
 }
 
-func StartMetricsServer(addr string) {
-	http.Handle("/metrics", promhttp.Handler())
-	if err := http.ListenAndServe("0.0.0.0:"+addr, nil); err != nil {
-		panic(err)
+func (m *Metrics) Message(provider, serviceType, status string) {
+	m.SmsMessages.WithLabelValues(provider, serviceType, status).Inc()
+}
+
+func (m *Metrics) Spent(provider, serviceType string, credits uint) {
+	m.CreditsSpent.WithLabelValues(provider, serviceType).Add(float64(credits))
+}
+
+func (m *Metrics) ProviderRequest(provider, result string, elapsed time.Duration) {
+	m.ProviderRequestDuration.WithLabelValues(provider, result).Observe(elapsed.Seconds())
+}
+
+// FiberMiddleware records request latency labelled by the matched route
+// pattern rather than the raw path, so ids do not explode the cardinality.
+func (m *Metrics) FiberMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			if fe, ok := err.(*fiber.Error); ok {
+				status = fe.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+		m.HttpRequestDuration.WithLabelValues(c.Method(), c.Route().Path, strconv.Itoa(status)).
+			Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// NewMetricsServer builds the server exposing /metrics, /health and the
+// given probe handlers (e.g. /livez, /readyz); the caller runs
+// ListenAndServe and stops it with Shutdown.
+func NewMetricsServer(addr string, probes map[string]http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("UP"))
+	})
+	for path, h := range probes {
+		mux.Handle(path, h)
 	}
+	return &http.Server{Addr: "0.0.0.0:" + addr, Handler: mux}
 }
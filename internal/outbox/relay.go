@@ -0,0 +1,61 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"postchi/pkg/db"
+	"postchi/pkg/kafka"
+	"postchi/pkg/logger"
+)
+
+const (
+	batchSize    = 100
+	pollInterval = 500 * time.Millisecond
+	errorBackoff = 2 * time.Second
+)
+
+// Relay publishes pending outbox rows to Kafka. Rows are marked dispatched
+// only after the broker acknowledged them, so each row is published at least
+// once even if the process dies mid-batch.
+type Relay struct {
+	Logger      logger.LoggerInterface
+	Db          db.DataBaseInterface
+	KafkaClient kafka.KafkaInterface
+}
+
+func RelayInit(l logger.LoggerInterface, d db.DataBaseInterface, k kafka.KafkaInterface) *Relay {
+	return &Relay{Logger: l, Db: d, KafkaClient: k}
+}
+
+// Start runs the relay until ctx is cancelled. It finishes the batch in
+// progress before returning.
+func (r *Relay) Start(ctx context.Context) {
+	r.Logger.Info("[outbox] relay started")
+	for {
+		wait := pollInterval
+
+		n, err := r.Db.DispatchOutbox(batchSize, func(msg db.OutboxMessage) error {
+			// continue the trace of the request that enqueued the message
+			pubCtx := kafka.ContextFromHeaders(context.WithoutCancel(ctx), msg.Headers)
+			if msg.Topic == "" {
+				return r.KafkaClient.Publish(pubCtx, msg.Key, msg.Payload)
+			}
+			return r.KafkaClient.PublishTopic(pubCtx, msg.Topic, msg.Key, msg.Payload)
+		})
+		if err != nil {
+			r.Logger.Error("[outbox] dispatch failed", logger.Err(err))
+			wait = errorBackoff
+		} else if n == batchSize {
+			// a full batch means there is likely more waiting
+			wait = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			r.Logger.Info("[outbox] relay stopped")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package pricing
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"postchi/internal/helpers"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+)
+
+// cacheTTL bounds how long an instance serves prices changed by another replica.
+const cacheTTL = time.Minute
+
+type Quote struct {
+	Receptor       string              `json:"receptor"`
+	Prefix         string              `json:"prefix"`
+	Operator       string              `json:"operator"`
+	Encoding       helpers.SmsEncoding `json:"encoding"`
+	Segments       int                 `json:"segments"`
+	CostPerSegment uint                `json:"cost_per_segment"`
+	Cost           uint                `json:"cost"`
+}
+
+type PricerInterface interface {
+	Quote(receptor string, text string, serviceType string, provider string) (Quote, error)
+	Reload() error
+}
+
+type Pricer struct {
+	Envs *env.Envs
+	Db   db.DataBaseInterface
+
+	mu       sync.RWMutex
+	routes   map[string][]db.Price
+	loadedAt time.Time
+}
+
+func PricerInit(e *env.Envs, d db.DataBaseInterface) PricerInterface {
+	return &Pricer{Envs: e, Db: d}
+}
+
+func routeKey(serviceType string, provider string) string {
+	return serviceType + "|" + provider
+}
+
+// Reload replaces the in-memory price table with the rows stored in the database.
+func (p *Pricer) Reload() error {
+	prices, err := p.Db.ListPrices()
+	if err != nil {
+		return err
+	}
+	routes := make(map[string][]db.Price)
+	for _, pr := range prices {
+		k := routeKey(string(pr.ServiceType), pr.Provider)
+		routes[k] = append(routes[k], pr)
+	}
+	// longest prefix first so the first match in lookup is the most specific
+	for k := range routes {
+		sort.Slice(routes[k], func(i, j int) bool {
+			return len(routes[k][i].Prefix) > len(routes[k][j].Prefix)
+		})
+	}
+
+	p.mu.Lock()
+	p.routes = routes
+	p.loadedAt = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Pricer) lookup(receptor string, serviceType string, provider string) (db.Price, bool, error) {
+	p.mu.RLock()
+	stale := p.routes == nil || time.Since(p.loadedAt) > cacheTTL
+	p.mu.RUnlock()
+	if stale {
+		if err := p.Reload(); err != nil {
+			return db.Price{}, false, err
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	// a provider-specific table wins over the provider-agnostic one
+	for _, prov := range []string{provider, ""} {
+		for _, pr := range p.routes[routeKey(serviceType, prov)] {
+			if strings.HasPrefix(receptor, pr.Prefix) {
+				return pr, true, nil
+			}
+		}
+	}
+	return db.Price{}, false, nil
+}
+
+// Quote prices text sent to receptor. Destinations without a matching price row
+// fall back to the flat per-segment cost configured for the service type.
+func (p *Pricer) Quote(receptor string, text string, serviceType string, provider string) (Quote, error) {
+	normalized := helpers.NormalizeReceptor(receptor)
+	fallbackCost, info := helpers.CalculateCost(p.Envs, text, serviceType)
+
+	q := Quote{
+		Receptor: normalized,
+		Encoding: info.Encoding,
+		Segments: info.Segments,
+		Cost:     fallbackCost,
+	}
+	if info.Segments > 0 {
+		q.CostPerSegment = fallbackCost / uint(info.Segments)
+	}
+
+	price, ok, err := p.lookup(normalized, serviceType, provider)
+	if err != nil {
+		return q, err
+	}
+	if ok {
+		q.Prefix = price.Prefix
+		q.Operator = price.Operator
+		q.CostPerSegment = price.CostPerSegment
+		q.Cost = price.CostPerSegment * uint(info.Segments)
+	}
+	return q, nil
+}
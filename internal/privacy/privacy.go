@@ -0,0 +1,128 @@
+package privacy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+
+	"postchi/pkg/env"
+	"postchi/pkg/redact"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AccessTokenHeader carries the token that maps a caller to a role.
+const AccessTokenHeader = "X-Access-Token"
+
+// RoleCustomer is the role of callers without a recognised token.
+const RoleCustomer = "customer"
+
+// Content masking modes for PII_MASK_CONTENT.
+const (
+	MaskContentNone = "none"
+	MaskContentOtp  = "otp"
+	MaskContentAll  = "all"
+)
+
+type MaskerInterface interface {
+	// Role resolves the caller's role from its access token.
+	Role(c *fiber.Ctx) string
+	// Unmasked reports whether role may see personal data in clear.
+	Unmasked(role string) bool
+	Receptor(role string, receptor string) string
+	Content(role string, content string, otp bool) string
+	// SearchableContent reports whether role may search message content and
+	// whether OTP messages, whose content it sees masked, must be left out.
+	SearchableContent(role string) (allowed bool, excludeOtp bool)
+}
+
+// Masker hides receptors and message bodies from roles that are not listed
+// in PII_UNMASKED_ROLES. Roles are assigned by ROLE_TOKENS
+// ("role:token,role:token").
+type Masker struct {
+	tokens      map[string]string
+	unmasked    map[string]bool
+	maskContent string
+}
+
+func MaskerInit(e *env.Envs) (MaskerInterface, error) {
+	m := &Masker{
+		tokens:      make(map[string]string),
+		unmasked:    make(map[string]bool),
+		maskContent: e.PII_MASK_CONTENT,
+	}
+	switch m.maskContent {
+	case MaskContentNone, MaskContentOtp, MaskContentAll:
+	default:
+		return nil, fmt.Errorf("privacy: invalid PII_MASK_CONTENT %q", m.maskContent)
+	}
+	for _, pair := range strings.Split(e.ROLE_TOKENS, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		role, token, ok := strings.Cut(pair, ":")
+		if !ok || role == "" || token == "" {
+			return nil, fmt.Errorf("privacy: invalid ROLE_TOKENS entry %q", pair)
+		}
+		m.tokens[token] = role
+	}
+	for _, role := range strings.Split(e.PII_UNMASKED_ROLES, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			m.unmasked[role] = true
+		}
+	}
+	return m, nil
+}
+
+func (m *Masker) Role(c *fiber.Ctx) string {
+	given := c.Get(AccessTokenHeader)
+	if given == "" {
+		return RoleCustomer
+	}
+	for token, role := range m.tokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			return role
+		}
+	}
+	return RoleCustomer
+}
+
+func (m *Masker) Unmasked(role string) bool {
+	return m.unmasked[role]
+}
+
+func (m *Masker) Receptor(role string, receptor string) string {
+	if m.Unmasked(role) {
+		return receptor
+	}
+	return redact.Phone(receptor)
+}
+
+func (m *Masker) Content(role string, content string, otp bool) string {
+	if m.Unmasked(role) {
+		return content
+	}
+	switch m.maskContent {
+	case MaskContentAll:
+		return redact.Hidden
+	case MaskContentOtp:
+		if otp {
+			return redact.Hidden
+		}
+	}
+	return content
+}
+
+func (m *Masker) SearchableContent(role string) (bool, bool) {
+	if m.Unmasked(role) {
+		return true, false
+	}
+	switch m.maskContent {
+	case MaskContentAll:
+		return false, false
+	case MaskContentOtp:
+		return true, true
+	}
+	return true, false
+}
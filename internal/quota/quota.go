@@ -0,0 +1,199 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"postchi/internal/helpers"
+	"postchi/pkg/db"
+	"postchi/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// limitsTTL bounds how long a changed service limit takes to apply.
+const limitsTTL = 30 * time.Second
+
+type LimiterInterface interface {
+	// Requests enforces the per-minute request rate of the service in the route.
+	Requests() fiber.Handler
+	// Messages enforces the request rate plus the daily and monthly message
+	// quotas; a request answered with an error does not use up quota.
+	Messages() fiber.Handler
+}
+
+type limits struct {
+	requestsPerMinute uint
+	daily             uint64
+	monthly           uint64
+	loadedAt          time.Time
+}
+
+// limitsKey identifies a cached service by its owner too, so a request naming
+// someone else's service is looked up, and refused, rather than served from
+// the owner's cache entry.
+type limitsKey struct {
+	userID    uint
+	serviceID uint
+}
+
+type Limiter struct {
+	Logger logger.LoggerInterface
+	Db     db.DataBaseInterface
+	Store  CounterStore
+
+	mu     sync.Mutex
+	cached map[limitsKey]limits
+	now    func() time.Time
+}
+
+func LimiterInit(l logger.LoggerInterface, d db.DataBaseInterface, s CounterStore) LimiterInterface {
+	return &Limiter{Logger: l, Db: d, Store: s, cached: make(map[limitsKey]limits), now: time.Now}
+}
+
+func (q *Limiter) limitsFor(userID uint, serviceID uint) (limits, error) {
+	key := limitsKey{userID, serviceID}
+	q.mu.Lock()
+	lim, ok := q.cached[key]
+	q.mu.Unlock()
+	if ok && q.now().Sub(lim.loadedAt) < limitsTTL {
+		return lim, nil
+	}
+
+	svc, err := q.Db.GetUserService(userID, serviceID)
+	if err != nil {
+		return limits{}, err
+	}
+	lim = limits{
+		requestsPerMinute: svc.RequestsPerMinute,
+		daily:             svc.DailyQuota,
+		monthly:           svc.MonthlyQuota,
+		loadedAt:          q.now(),
+	}
+	q.mu.Lock()
+	q.cached[key] = lim
+	q.mu.Unlock()
+	return lim, nil
+}
+
+func (q *Limiter) Requests() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return q.handle(c, false)
+	}
+}
+
+func (q *Limiter) Messages() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return q.handle(c, true)
+	}
+}
+
+func (q *Limiter) handle(c *fiber.Ctx, countMessage bool) error {
+	userID, err := helpers.ParseUintParam(c, "user_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	serviceID, err := helpers.ParseUintParam(c, "service_id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	lim, err := q.limitsFor(userID, serviceID)
+	if errors.Is(err, db.ErrServiceNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "service not found"})
+	}
+	if err != nil {
+		q.Logger.Ctx(c.UserContext()).Error("[quota] service lookup failed", logger.ServiceID(serviceID), logger.Err(err))
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "db error"})
+	}
+
+	ctx := c.UserContext()
+	now := q.now().UTC()
+
+	if lim.requestsPerMinute > 0 {
+		windowEnd := now.Truncate(time.Minute).Add(time.Minute)
+		key := fmt.Sprintf("rate:%d:%d", serviceID, now.Unix()/60)
+		n, err := q.Store.IncrBy(ctx, key, 1, time.Minute)
+		if err != nil {
+			// fail open: losing the counter store must not take the API down
+			q.Logger.Ctx(c.UserContext()).Error("[quota] rate counter failed", logger.ServiceID(serviceID), logger.Err(err))
+		} else {
+			setLimitHeaders(c, "X-RateLimit", uint64(lim.requestsPerMinute), n)
+			if n > int64(lim.requestsPerMinute) {
+				return tooMany(c, windowEnd.Sub(now), "rate limit exceeded")
+			}
+		}
+	}
+
+	if !countMessage || (lim.daily == 0 && lim.monthly == 0) {
+		return c.Next()
+	}
+
+	type window struct {
+		header string
+		key    string
+		limit  uint64
+		end    time.Time
+	}
+	dayEnd := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	monthEnd := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	windows := []window{
+		{"X-Quota-Daily", fmt.Sprintf("quota:d:%d:%s", serviceID, now.Format("20060102")), lim.daily, dayEnd},
+		{"X-Quota-Monthly", fmt.Sprintf("quota:m:%d:%s", serviceID, now.Format("200601")), lim.monthly, monthEnd},
+	}
+
+	var counted []window
+	refund := func() {
+		for _, w := range counted {
+			if _, err := q.Store.IncrBy(ctx, w.key, -1, w.end.Sub(now)); err != nil {
+				q.Logger.Ctx(c.UserContext()).Error("[quota] quota refund failed", logger.ServiceID(serviceID), logger.Err(err))
+			}
+		}
+	}
+	for _, w := range windows {
+		if w.limit == 0 {
+			continue
+		}
+		n, err := q.Store.IncrBy(ctx, w.key, 1, w.end.Sub(now))
+		if err != nil {
+			q.Logger.Ctx(c.UserContext()).Error("[quota] quota counter failed", logger.ServiceID(serviceID), logger.Err(err))
+			continue
+		}
+		counted = append(counted, w)
+		setLimitHeaders(c, w.header, w.limit, n)
+		if n > int64(w.limit) {
+			refund()
+			return tooMany(c, w.end.Sub(now), "message quota exceeded")
+		}
+	}
+
+	if err := c.Next(); err != nil {
+		refund()
+		return err
+	}
+	if c.Response().StatusCode() >= fiber.StatusBadRequest {
+		refund()
+	}
+	return nil
+}
+
+func setLimitHeaders(c *fiber.Ctx, prefix string, limit uint64, used int64) {
+	remaining := int64(limit) - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	c.Set(prefix+"-Limit", strconv.FormatUint(limit, 10))
+	c.Set(prefix+"-Remaining", strconv.FormatInt(remaining, 10))
+}
+
+func tooMany(c *fiber.Ctx, retryAfter time.Duration, msg string) error {
+	seconds := int(retryAfter.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": msg, "retry_after": seconds})
+}
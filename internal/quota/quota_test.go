@@ -0,0 +1,206 @@
+package quota
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"postchi/pkg/db"
+	"postchi/pkg/logger"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+)
+
+// fakeDb serves one service and counts how often its limits are loaded.
+type fakeDb struct {
+	db.DataBaseInterface
+	svc   db.Service
+	loads int
+}
+
+func (f *fakeDb) GetUserService(userId uint, serviceId uint) (db.Service, error) {
+	f.loads++
+	if userId != f.svc.UserID || serviceId != f.svc.ID {
+		return db.Service{}, db.ErrServiceNotFound
+	}
+	return f.svc, nil
+}
+
+// newTestApp routes /:user_id/:service_id through the message limiter to a
+// handler answering with *status, on a clock read from *now.
+func newTestApp(d *fakeDb, now *time.Time, status *int) *fiber.App {
+	q := LimiterInit(&logger.Logger{Log: zap.NewNop()}, d, NewMemoryStore()).(*Limiter)
+	q.now = func() time.Time { return *now }
+	q.Store.(*MemoryStore).now = func() time.Time { return *now }
+
+	app := fiber.New()
+	app.Post("/:user_id/:service_id", q.Messages(), func(c *fiber.Ctx) error {
+		return c.SendStatus(*status)
+	})
+	return app
+}
+
+func TestLimiterWindows(t *testing.T) {
+	type step struct {
+		at         time.Time
+		status     int // answered by the route
+		want       int
+		retryAfter string
+	}
+	tests := []struct {
+		name  string
+		svc   db.Service
+		steps []step
+	}{
+		{
+			name: "minute window",
+			svc:  db.Service{RequestsPerMinute: 2},
+			steps: []step{
+				{at: time.Date(2024, 3, 1, 10, 0, 10, 0, time.UTC), want: 200},
+				{at: time.Date(2024, 3, 1, 10, 0, 20, 0, time.UTC), want: 200},
+				{at: time.Date(2024, 3, 1, 10, 0, 30, 0, time.UTC), want: 429, retryAfter: "30"},
+				{at: time.Date(2024, 3, 1, 10, 1, 0, 0, time.UTC), want: 200},
+			},
+		},
+		{
+			name: "day window",
+			svc:  db.Service{DailyQuota: 2},
+			steps: []step{
+				{at: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), want: 200},
+				{at: time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC), want: 200},
+				{at: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), want: 429, retryAfter: "43200"},
+				{at: time.Date(2024, 3, 2, 0, 0, 1, 0, time.UTC), want: 200},
+			},
+		},
+		{
+			name: "month window",
+			svc:  db.Service{MonthlyQuota: 2},
+			steps: []step{
+				{at: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), want: 200},
+				{at: time.Date(2024, 2, 28, 0, 0, 0, 0, time.UTC), want: 200},
+				{at: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), want: 429, retryAfter: "86400"},
+				{at: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), want: 200},
+			},
+		},
+		{
+			name: "failed requests do not use quota",
+			svc:  db.Service{DailyQuota: 1, MonthlyQuota: 1},
+			steps: []step{
+				{at: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), status: 400, want: 400},
+				{at: time.Date(2024, 3, 1, 10, 0, 1, 0, time.UTC), status: 502, want: 502},
+				{at: time.Date(2024, 3, 1, 10, 0, 2, 0, time.UTC), want: 200},
+				{at: time.Date(2024, 3, 1, 10, 0, 3, 0, time.UTC), want: 429, retryAfter: "50397"},
+			},
+		},
+		{
+			name: "zero disables every limit",
+			svc:  db.Service{},
+			steps: []step{
+				{at: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), want: 200},
+				{at: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), want: 200},
+				{at: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), want: 200},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.svc.ID = 7
+			tt.svc.UserID = 1
+			d := &fakeDb{svc: tt.svc}
+			var now time.Time
+			var status int
+			app := newTestApp(d, &now, &status)
+
+			for i, s := range tt.steps {
+				now, status = s.at, s.status
+				if status == 0 {
+					status = 200
+				}
+				resp, err := app.Test(httptest.NewRequest("POST", "/1/7", nil))
+				if err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if resp.StatusCode != s.want {
+					t.Fatalf("step %d: got status %d, want %d", i, resp.StatusCode, s.want)
+				}
+				if s.retryAfter != "" && resp.Header.Get(fiber.HeaderRetryAfter) != s.retryAfter {
+					t.Fatalf("step %d: got Retry-After %q, want %q", i, resp.Header.Get(fiber.HeaderRetryAfter), s.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterCachesLimits(t *testing.T) {
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	d := &fakeDb{svc: db.Service{DailyQuota: 1}}
+	d.svc.ID = 7
+	d.svc.UserID = 1
+	now := start
+	status := 200
+	app := newTestApp(d, &now, &status)
+
+	send := func() int {
+		resp, err := app.Test(httptest.NewRequest("POST", "/1/7", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	tests := []struct {
+		name      string
+		after     time.Duration
+		want      int
+		wantLoads int
+	}{
+		{"first request loads limits", 0, 200, 1},
+		{"raised limit is not seen within the ttl", 29 * time.Second, 429, 1},
+		{"raised limit applies once the ttl passed", limitsTTL, 200, 2},
+		{"reloaded limits are cached again", limitsTTL + time.Second, 200, 2},
+	}
+	for i, tt := range tests {
+		if i == 1 {
+			d.svc.DailyQuota = 10
+		}
+		now = start.Add(tt.after)
+		if got := send(); got != tt.want {
+			t.Fatalf("%s: got status %d, want %d", tt.name, got, tt.want)
+		}
+		if d.loads != tt.wantLoads {
+			t.Fatalf("%s: got %d loads, want %d", tt.name, d.loads, tt.wantLoads)
+		}
+	}
+}
+
+func TestLimiterUnknownService(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"owner is served", "/1/7", fiber.StatusOK},
+		{"unknown service", "/1/8", fiber.StatusNotFound},
+		// the owner's request above cached the service's limits
+		{"another user's service", "/2/7", fiber.StatusNotFound},
+	}
+
+	d := &fakeDb{}
+	d.svc.ID = 7
+	d.svc.UserID = 1
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	status := 200
+	app := newTestApp(d, &now, &status)
+
+	for _, tt := range tests {
+		resp, err := app.Test(httptest.NewRequest("POST", tt.path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Fatalf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
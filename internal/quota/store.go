@@ -0,0 +1,138 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+)
+
+// Counter store backends for QUOTA_STORE.
+const (
+	StoreMemory = "memory"
+	StoreDb     = "db"
+)
+
+// CounterStore holds expiring counters. The semantics follow Redis INCRBY +
+// EXPIRE.
+type CounterStore interface {
+	// IncrBy adds delta to key and returns the new value. The ttl is only
+	// applied when the key is created.
+	IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	Get(ctx context.Context, key string) (int64, error)
+}
+
+type memoryEntry struct {
+	value     int64
+	expiresAt time.Time
+}
+
+func NewStore(e *env.Envs, l logger.LoggerInterface, d db.DataBaseInterface) (CounterStore, error) {
+	switch e.QUOTA_STORE {
+	case StoreMemory:
+		return NewMemoryStore(), nil
+	case StoreDb:
+		return NewDbStore(l, d), nil
+	default:
+		return nil, fmt.Errorf("quota: unknown counter store %q", e.QUOTA_STORE)
+	}
+}
+
+// MemoryStore is a single-node CounterStore; with several API instances each
+// one enforces the full limits on its own.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	sweepAt time.Time
+	now     func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*memoryEntry), now: time.Now}
+}
+
+func (s *MemoryStore) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	e, ok := s.entries[key]
+	if !ok || now.After(e.expiresAt) {
+		e = &memoryEntry{expiresAt: now.Add(ttl)}
+		s.entries[key] = e
+	}
+	e.value += delta
+	return e.value, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok || s.now().After(e.expiresAt) {
+		return 0, nil
+	}
+	return e.value, nil
+}
+
+// sweep drops expired keys at most once a minute so the map does not grow
+// with every past window.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Before(s.sweepAt) {
+		return
+	}
+	for k, e := range s.entries {
+		if now.After(e.expiresAt) {
+			delete(s.entries, k)
+		}
+	}
+	s.sweepAt = now.Add(time.Minute)
+}
+
+// DbStore keeps the counters in the database, so every API instance counts
+// against the same limits.
+type DbStore struct {
+	Logger logger.LoggerInterface
+	Db     db.DataBaseInterface
+
+	mu      sync.Mutex
+	sweepAt time.Time
+	now     func() time.Time
+}
+
+func NewDbStore(l logger.LoggerInterface, d db.DataBaseInterface) *DbStore {
+	return &DbStore{Logger: l, Db: d, now: time.Now}
+}
+
+func (s *DbStore) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.sweep(ctx)
+	return s.Db.WithContext(ctx).IncrCounter(key, delta, ttl)
+}
+
+func (s *DbStore) Get(ctx context.Context, key string) (int64, error) {
+	return s.Db.WithContext(ctx).GetCounter(key)
+}
+
+// sweep deletes expired counters at most once a minute per instance. They
+// would start over anyway; this only keeps the table from growing with every
+// past window.
+func (s *DbStore) sweep(ctx context.Context) {
+	now := s.now()
+	s.mu.Lock()
+	if now.Before(s.sweepAt) {
+		s.mu.Unlock()
+		return
+	}
+	s.sweepAt = now.Add(time.Minute)
+	s.mu.Unlock()
+
+	if _, err := s.Db.WithContext(ctx).DeleteExpiredCounters(); err != nil {
+		s.Logger.Ctx(ctx).Error("[quota] counter sweep failed", logger.Err(err))
+	}
+}
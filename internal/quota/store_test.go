@@ -0,0 +1,151 @@
+package quota
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"postchi/pkg/db"
+	"postchi/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+func TestMemoryStore(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	type op struct {
+		after time.Duration // since start
+		get   bool
+		delta int64
+		ttl   time.Duration
+		want  int64
+	}
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{
+			name: "missing key reads zero",
+			ops:  []op{{get: true, want: 0}},
+		},
+		{
+			name: "increments accumulate within the ttl",
+			ops: []op{
+				{delta: 1, ttl: time.Minute, want: 1},
+				{after: 10 * time.Second, delta: 2, ttl: time.Minute, want: 3},
+				{after: 59 * time.Second, get: true, want: 3},
+			},
+		},
+		{
+			name: "negative delta refunds",
+			ops: []op{
+				{delta: 1, ttl: time.Minute, want: 1},
+				{delta: 1, ttl: time.Minute, want: 2},
+				{delta: -1, ttl: time.Minute, want: 1},
+			},
+		},
+		{
+			name: "ttl is only set on create",
+			ops: []op{
+				{delta: 1, ttl: time.Minute, want: 1},
+				{after: 30 * time.Second, delta: 1, ttl: time.Hour, want: 2},
+				{after: 61 * time.Second, get: true, want: 0},
+			},
+		},
+		{
+			name: "expired key starts over",
+			ops: []op{
+				{delta: 5, ttl: time.Minute, want: 5},
+				{after: 2 * time.Minute, delta: 1, ttl: time.Minute, want: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			for i, o := range tt.ops {
+				s.now = func() time.Time { return start.Add(o.after) }
+				var got int64
+				var err error
+				if o.get {
+					got, err = s.Get(context.Background(), "k")
+				} else {
+					got, err = s.IncrBy(context.Background(), "k", o.delta, o.ttl)
+				}
+				if err != nil {
+					t.Fatalf("op %d: unexpected error: %v", i, err)
+				}
+				if got != o.want {
+					t.Fatalf("op %d: got %d, want %d", i, got, o.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryStoreSweepsExpiredKeys(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s := NewMemoryStore()
+	s.now = func() time.Time { return start }
+	s.IncrBy(context.Background(), "old", 1, time.Second)
+
+	s.now = func() time.Time { return start.Add(2 * time.Minute) }
+	s.IncrBy(context.Background(), "new", 1, time.Minute)
+
+	if _, ok := s.entries["old"]; ok {
+		t.Fatal("expired key was not swept")
+	}
+	if len(s.entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(s.entries))
+	}
+}
+
+// counterDb records the counter calls DbStore makes.
+type counterDb struct {
+	db.DataBaseInterface
+	incrs  int
+	sweeps int
+}
+
+func (c *counterDb) WithContext(ctx context.Context) db.DataBaseInterface { return c }
+
+func (c *counterDb) IncrCounter(name string, delta int64, ttl time.Duration) (int64, error) {
+	c.incrs++
+	return int64(c.incrs), nil
+}
+
+func (c *counterDb) DeleteExpiredCounters() (int, error) {
+	c.sweeps++
+	return 0, nil
+}
+
+func TestDbStoreSweepsOncePerMinute(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	d := &counterDb{}
+	s := NewDbStore(&logger.Logger{Log: zap.NewNop()}, d)
+
+	tests := []struct {
+		after      time.Duration // since start
+		wantSweeps int
+	}{
+		{0, 1},
+		{30 * time.Second, 1},
+		{59 * time.Second, 1},
+		{time.Minute, 2},
+		{90 * time.Second, 2},
+	}
+	for i, tt := range tests {
+		s.now = func() time.Time { return start.Add(tt.after) }
+		if _, err := s.IncrBy(context.Background(), "k", 1, time.Minute); err != nil {
+			t.Fatalf("op %d: unexpected error: %v", i, err)
+		}
+		if d.sweeps != tt.wantSweeps {
+			t.Fatalf("op %d: got %d sweeps, want %d", i, d.sweeps, tt.wantSweeps)
+		}
+	}
+	if d.incrs != len(tests) {
+		t.Fatalf("got %d increments, want %d", d.incrs, len(tests))
+	}
+}
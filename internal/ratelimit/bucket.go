@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Bucket is a token bucket refilled at rate tokens per second up to burst.
+// A non-positive rate means unlimited. After the upstream signals throttling
+// the bucket is closed for an exponentially growing backoff period.
+type Bucket struct {
+	mu           sync.Mutex
+	rate         float64
+	burst        float64
+	tokens       float64
+	last         time.Time
+	backoff      time.Duration
+	blockedUntil time.Time
+	now          func() time.Time
+}
+
+func NewBucket(rate float64, burst int) *Bucket {
+	b := &Bucket{last: time.Now(), now: time.Now}
+	b.SetLimit(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// SetLimit changes the rate and burst without resetting accumulated tokens.
+func (b *Bucket) SetLimit(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (b *Bucket) Wait(ctx context.Context) error {
+	for {
+		wait := b.reserve()
+		if wait == 0 {
+			return nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (b *Bucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if now.Before(b.blockedUntil) {
+		return b.blockedUntil.Sub(now)
+	}
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Throttled closes the bucket for the next backoff period, doubling it on
+// every consecutive call up to maxBackoff.
+func (b *Bucket) Throttled() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.backoff == 0:
+		b.backoff = minBackoff
+	case b.backoff < maxBackoff:
+		b.backoff *= 2
+		if b.backoff > maxBackoff {
+			b.backoff = maxBackoff
+		}
+	}
+	b.blockedUntil = b.now().Add(b.backoff)
+	b.tokens = 0
+	return b.backoff
+}
+
+// Succeeded resets the adaptive backoff after an accepted send.
+func (b *Bucket) Succeeded() {
+	b.mu.Lock()
+	b.backoff = 0
+	b.mu.Unlock()
+}
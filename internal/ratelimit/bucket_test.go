@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBucket(rate float64, burst int, now *time.Time) *Bucket {
+	b := NewBucket(rate, burst)
+	b.now = func() time.Time { return *now }
+	b.last = *now
+	return b
+}
+
+func TestBucketRefill(t *testing.T) {
+	type step struct {
+		after time.Duration // since the previous step
+		want  time.Duration // wait reserve reports, 0 for a token taken
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{
+			name:  "burst is available at once",
+			rate:  1,
+			burst: 3,
+			steps: []step{{0, 0}, {0, 0}, {0, 0}, {0, time.Second}},
+		},
+		{
+			name:  "tokens refill at the rate",
+			rate:  2,
+			burst: 1,
+			steps: []step{{0, 0}, {0, 500 * time.Millisecond}, {250 * time.Millisecond, 250 * time.Millisecond}, {250 * time.Millisecond, 0}},
+		},
+		{
+			name:  "refill never exceeds the burst",
+			rate:  10,
+			burst: 2,
+			steps: []step{{0, 0}, {0, 0}, {time.Hour, 0}, {0, 0}, {0, 100 * time.Millisecond}},
+		},
+		{
+			name:  "burst below one is raised to one",
+			rate:  1,
+			burst: 0,
+			steps: []step{{0, 0}, {0, time.Second}},
+		},
+		{
+			name:  "zero rate is unlimited",
+			rate:  0,
+			burst: 1,
+			steps: []step{{0, 0}, {0, 0}, {0, 0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			b := newTestBucket(tt.rate, tt.burst, &now)
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				if got := b.reserve(); got != s.want {
+					t.Fatalf("step %d: got wait %v, want %v", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketSetLimitClampsTokens(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newTestBucket(1, 10, &now)
+	b.SetLimit(1, 2)
+	for i := 0; i < 2; i++ {
+		if got := b.reserve(); got != 0 {
+			t.Fatalf("token %d: got wait %v, want none", i, got)
+		}
+	}
+	if got := b.reserve(); got != time.Second {
+		t.Fatalf("got wait %v, want 1s after the lowered burst", got)
+	}
+}
+
+func TestBucketBackoff(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	b := newTestBucket(0, 1, &now)
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for i, w := range want {
+		if got := b.Throttled(); got != w {
+			t.Fatalf("throttle %d: got backoff %v, want %v", i, got, w)
+		}
+	}
+
+	// the bucket stays closed until the backoff has passed
+	if got := b.reserve(); got != time.Minute {
+		t.Fatalf("got wait %v, want the full backoff", got)
+	}
+	now = now.Add(time.Minute)
+	if got := b.reserve(); got != 0 {
+		t.Fatalf("got wait %v after the backoff, want none", got)
+	}
+
+	b.Succeeded()
+	if got := b.Throttled(); got != time.Second {
+		t.Fatalf("got backoff %v after a success, want it reset to 1s", got)
+	}
+}
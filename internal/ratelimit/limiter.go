@@ -0,0 +1,132 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+)
+
+const reloadInterval = 30 * time.Second
+
+type ProviderLimiterInterface interface {
+	// Wait blocks until both the provider and the sender line may send.
+	Wait(ctx context.Context, provider string, sender string) error
+	Throttled(provider string) time.Duration
+	Succeeded(provider string)
+	Reload() error
+	Start(ctx context.Context)
+}
+
+// ProviderLimiter keeps one bucket per provider and one per configured
+// provider sender number. Limits live in the database so they can be changed
+// at runtime; every worker picks them up on its next reload. A limit is the
+// provider's total, and each of the SMS_WORKER_REPLICAS worker processes
+// enforces its share of it, so the sum stays within the limit as long as
+// the setting matches the number of workers running.
+type ProviderLimiter struct {
+	Envs   *env.Envs
+	Logger logger.LoggerInterface
+	Db     db.DataBaseInterface
+
+	mu      sync.Mutex
+	buckets map[string]*Bucket
+}
+
+func ProviderLimiterInit(l logger.LoggerInterface, e *env.Envs, d db.DataBaseInterface) ProviderLimiterInterface {
+	return &ProviderLimiter{Envs: e, Logger: l, Db: d, buckets: make(map[string]*Bucket)}
+}
+
+func bucketKey(provider string, sender string) string {
+	if sender == "" {
+		return provider
+	}
+	return provider + "/" + sender
+}
+
+// share returns this process's part of a limit shared by every worker
+// replica. The burst never drops below one, so a send can always start.
+func (p *ProviderLimiter) share(rate float64, burst int) (float64, int) {
+	replicas := max(p.Envs.SMS_WORKER_REPLICAS, 1)
+	return rate / float64(replicas), max(burst/replicas, 1)
+}
+
+func (p *ProviderLimiter) bucket(key string, create bool) *Bucket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, ok := p.buckets[key]
+	if !ok && create {
+		b = NewBucket(p.share(float64(p.Envs.SMS_PROVIDER_DEFAULT_RATE), p.Envs.SMS_PROVIDER_DEFAULT_RATE))
+		p.buckets[key] = b
+	}
+	return b
+}
+
+func (p *ProviderLimiter) Wait(ctx context.Context, provider string, sender string) error {
+	if err := p.bucket(bucketKey(provider, ""), true).Wait(ctx); err != nil {
+		return err
+	}
+	if sender == "" {
+		return nil
+	}
+	// sender lines are only limited when explicitly configured
+	if b := p.bucket(bucketKey(provider, sender), false); b != nil {
+		return b.Wait(ctx)
+	}
+	return nil
+}
+
+func (p *ProviderLimiter) Throttled(provider string) time.Duration {
+	return p.bucket(bucketKey(provider, ""), true).Throttled()
+}
+
+func (p *ProviderLimiter) Succeeded(provider string) {
+	p.bucket(bucketKey(provider, ""), true).Succeeded()
+}
+
+// Reload applies the limits stored in the database. Buckets keep their state,
+// only rate and burst change.
+func (p *ProviderLimiter) Reload() error {
+	limits, err := p.Db.ListRateLimits()
+	if err != nil {
+		return err
+	}
+	configured := make(map[string]bool, len(limits))
+	for _, l := range limits {
+		key := bucketKey(l.Provider, l.Sender)
+		configured[key] = true
+		p.bucket(key, true).SetLimit(p.share(l.RatePerSecond, int(l.Burst)))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, b := range p.buckets {
+		switch {
+		case configured[key]:
+		case strings.Contains(key, "/"):
+			delete(p.buckets, key)
+		default:
+			b.SetLimit(p.share(float64(p.Envs.SMS_PROVIDER_DEFAULT_RATE), p.Envs.SMS_PROVIDER_DEFAULT_RATE))
+		}
+	}
+	return nil
+}
+
+func (p *ProviderLimiter) Start(ctx context.Context) {
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+	for {
+		if err := p.Reload(); err != nil {
+			p.Logger.Error("[ratelimit] reload failed", logger.Err(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"testing"
+
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/logger"
+
+	"go.uber.org/zap"
+)
+
+type fakeDb struct {
+	db.DataBaseInterface
+	limits []db.ProviderRateLimit
+}
+
+func (f *fakeDb) ListRateLimits() ([]db.ProviderRateLimit, error) {
+	return f.limits, nil
+}
+
+func TestLimiterSharesLimitsAcrossReplicas(t *testing.T) {
+	tests := []struct {
+		name      string
+		replicas  int
+		limit     db.ProviderRateLimit
+		wantRate  float64
+		wantBurst float64
+	}{
+		{"single worker gets the whole limit", 1, db.ProviderRateLimit{Provider: "kavenegar", RatePerSecond: 20, Burst: 40}, 20, 40},
+		{"unset replicas count as one", 0, db.ProviderRateLimit{Provider: "kavenegar", RatePerSecond: 20, Burst: 40}, 20, 40},
+		{"limit is split between workers", 4, db.ProviderRateLimit{Provider: "kavenegar", RatePerSecond: 20, Burst: 40}, 5, 10},
+		{"burst share never drops below one", 4, db.ProviderRateLimit{Provider: "kavenegar", RatePerSecond: 2, Burst: 2}, 0.5, 1},
+		{"sender limits are split too", 2, db.ProviderRateLimit{Provider: "kavenegar", Sender: "1000", RatePerSecond: 6, Burst: 6}, 3, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envs := &env.Envs{SMS_WORKER_REPLICAS: tt.replicas}
+			l := ProviderLimiterInit(&logger.Logger{Log: zap.NewNop()}, envs, &fakeDb{limits: []db.ProviderRateLimit{tt.limit}}).(*ProviderLimiter)
+			if err := l.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			b := l.bucket(bucketKey(tt.limit.Provider, tt.limit.Sender), false)
+			if b == nil {
+				t.Fatal("no bucket for the configured limit")
+			}
+			if b.rate != tt.wantRate || b.burst != tt.wantBurst {
+				t.Fatalf("got rate %v burst %v, want %v and %v", b.rate, b.burst, tt.wantRate, tt.wantBurst)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package reports
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"postchi/pkg/db"
+	"postchi/pkg/logger"
+)
+
+// backfillHours caps how many hours one pass rebuilds, so the first pass over
+// a large history is spread across several ticks.
+const backfillHours = 168
+
+// Job keeps the hourly sms rollups current. Hours inside Window, or holding a
+// message that is not settled yet, are rebuilt on every pass since their
+// messages may still change status; older settled hours are frozen.
+type Job struct {
+	Logger   logger.LoggerInterface
+	Db       db.DataBaseInterface
+	Interval time.Duration
+	Window   time.Duration
+}
+
+func JobInit(l logger.LoggerInterface, d db.DataBaseInterface, interval time.Duration, window time.Duration) *Job {
+	return &Job{Logger: l, Db: d, Interval: interval, Window: window}
+}
+
+// Start refreshes the rollups every Interval until ctx is cancelled.
+func (j *Job) Start(ctx context.Context) {
+	j.Logger.Info("[reports] rollup job started", logger.Duration("interval", j.Interval), logger.Duration("window", j.Window))
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		n, err := j.Db.WithContext(ctx).RefreshRollups(j.Window, backfillHours)
+		switch {
+		case errors.Is(err, db.ErrRollupBusy):
+			j.Logger.Debug("[reports] rollup pass skipped, another replica is running one")
+		case err != nil && ctx.Err() == nil:
+			j.Logger.Error("[reports] rollup pass failed", logger.Err(err))
+		case err == nil:
+			j.Logger.Debug("[reports] rollups refreshed", logger.Int("hours", n))
+		}
+		select {
+		case <-ctx.Done():
+			j.Logger.Info("[reports] rollup job stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package retention
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/envelope"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Archive backends for RETENTION_ARCHIVE.
+const (
+	ArchiveNone  = "none"
+	ArchiveLocal = "local"
+	ArchiveS3    = "s3"
+)
+
+// StoreInterface keeps archive files and returns where each one was put.
+type StoreInterface interface {
+	Put(ctx context.Context, name string, data []byte) (uri string, err error)
+}
+
+func NewStore(e *env.Envs) (StoreInterface, error) {
+	switch e.RETENTION_ARCHIVE {
+	case ArchiveNone:
+		return nil, nil
+	case ArchiveLocal:
+		return &LocalStore{Dir: e.RETENTION_ARCHIVE_DIR}, nil
+	case ArchiveS3:
+		client, err := minio.New(e.S3_ENDPOINT, &minio.Options{
+			Creds:  credentials.NewStaticV4(e.S3_ACCESS_KEY, e.S3_SECRET_KEY, ""),
+			Secure: e.S3_USE_SSL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &S3Store{Client: client, Bucket: e.S3_BUCKET}, nil
+	default:
+		return nil, fmt.Errorf("retention: unknown archive backend %q", e.RETENTION_ARCHIVE)
+	}
+}
+
+type LocalStore struct {
+	Dir string
+}
+
+func (l *LocalStore) Put(ctx context.Context, name string, data []byte) (string, error) {
+	path := filepath.Join(l.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return "", err
+	}
+	// write then rename, so a crash never leaves a truncated archive behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return "file://" + path, nil
+}
+
+// S3Store writes to any S3-compatible object store.
+type S3Store struct {
+	Client *minio.Client
+	Bucket string
+}
+
+func (s *S3Store) Put(ctx context.Context, name string, data []byte) (string, error) {
+	_, err := s.Client.PutObject(ctx, s.Bucket, name, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/x-ndjson", ContentEncoding: "gzip"})
+	if err != nil {
+		return "", err
+	}
+	return "s3://" + s.Bucket + "/" + name, nil
+}
+
+// archivedSms is one line of an archive file. With an archive key, Content is
+// base64 ciphertext whose data key is wrapped by ContentKeyID of
+// RETENTION_ARCHIVE_KEY_FILE.
+type archivedSms struct {
+	ID                uint      `json:"id"`
+	ServiceId         uint      `json:"service_id"`
+	CreatedAt         time.Time `json:"created_at"`
+	Status            string    `json:"status"`
+	Receptor          string    `json:"receptor"`
+	Content           string    `json:"content"`
+	ContentKeyID      string    `json:"content_key_id,omitempty"`
+	ContentDataKey    []byte    `json:"content_data_key,omitempty"`
+	Otp               bool      `json:"otp"`
+	Cost              uint      `json:"cost"`
+	Provider          string    `json:"provider"`
+	ProviderMessageId int       `json:"provider_message_id"`
+	SentTime          int64     `json:"sent_time"`
+}
+
+// encodeArchive renders rows, whose content is plaintext, as gzip-compressed
+// JSON lines, sealing each content under sealer when one is given.
+func encodeArchive(ctx context.Context, rows []db.Sms, sealer *envelope.Sealer) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, r := range rows {
+		line := archivedSms{
+			ID:                r.ID,
+			ServiceId:         r.ServiceId,
+			CreatedAt:         r.CreatedAt,
+			Status:            r.Status,
+			Receptor:          r.Receptor,
+			Content:           r.Content,
+			Otp:               r.Otp,
+			Cost:              r.Cost,
+			Provider:          r.ServiceProviderName,
+			ProviderMessageId: r.ServiceProviderMessageId,
+			SentTime:          r.SentTime,
+		}
+		if sealer != nil {
+			sealed, err := sealer.Seal(ctx, []byte(r.Content))
+			if err != nil {
+				return nil, err
+			}
+			line.Content = base64.StdEncoding.EncodeToString(sealed.Ciphertext)
+			line.ContentKeyID = sealed.KeyID
+			line.ContentDataKey = sealed.DataKey
+		}
+		if err := enc.Encode(line); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,83 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"postchi/pkg/db"
+	"postchi/pkg/envelope"
+	"postchi/pkg/logger"
+)
+
+// Job purges messages past their service's retention period. Each batch is
+// archived first, when an archive store is configured, and then deleted or
+// anonymized; every batch leaves a PurgeRecord. Archived content is sealed
+// under Sealer, the archive key, when one is set.
+type Job struct {
+	Logger   logger.LoggerInterface
+	Db       db.DataBaseInterface
+	Store    StoreInterface
+	Sealer   *envelope.Sealer
+	Interval time.Duration
+	Batch    int
+}
+
+func JobInit(l logger.LoggerInterface, d db.DataBaseInterface, s StoreInterface, sealer *envelope.Sealer, interval time.Duration, batch int) *Job {
+	return &Job{Logger: l, Db: d, Store: s, Sealer: sealer, Interval: interval, Batch: batch}
+}
+
+// Start runs a purge pass every Interval until ctx is cancelled.
+func (j *Job) Start(ctx context.Context) {
+	j.Logger.Info("[retention] job started", logger.Duration("interval", j.Interval))
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		j.runOnce(ctx)
+		select {
+		case <-ctx.Done():
+			j.Logger.Info("[retention] job stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *Job) runOnce(ctx context.Context) {
+	svcs, err := j.Db.ListRetentionServices()
+	if err != nil {
+		j.Logger.Error("[retention] list services failed", logger.Err(err))
+		return
+	}
+	for _, svc := range svcs {
+		before := time.Now().AddDate(0, 0, -int(svc.RetentionDays))
+		for ctx.Err() == nil {
+			rec, err := j.Db.PurgeSms(svc.ID, before, svc.RetentionAction, j.Batch, func(rows []db.Sms) (string, error) {
+				return j.archive(ctx, svc.ID, rows)
+			})
+			if err != nil {
+				j.Logger.Error("[retention] purge failed", logger.ServiceID(svc.ID), logger.Err(err))
+				break
+			}
+			if rec.Count == 0 {
+				break
+			}
+			j.Logger.Info("[retention] purged messages", logger.ServiceID(svc.ID),
+				logger.String("action", string(rec.Action)), logger.Int("count", rec.Count),
+				logger.String("archive", rec.ArchiveURI))
+		}
+	}
+}
+
+func (j *Job) archive(ctx context.Context, serviceId uint, rows []db.Sms) (string, error) {
+	if j.Store == nil {
+		return "", nil
+	}
+	data, err := encodeArchive(ctx, rows, j.Sealer)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("sms/service-%d/%s/%d-%d.jsonl.gz", serviceId,
+		time.Now().UTC().Format("2006/01/02"), rows[0].ID, rows[len(rows)-1].ID)
+	return j.Store.Put(ctx, name, data)
+}
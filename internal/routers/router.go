@@ -2,24 +2,49 @@ package router
 
 import (
 	"postchi/internal/handlers"
+	"postchi/internal/health"
+	"postchi/internal/quota"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 )
 
-func SetupRoutes(app *fiber.App, userH handlers.UserHandlerInterface, smsH handlers.SmsHandlerInterface) {
+func SetupRoutes(app *fiber.App, userH handlers.UserHandlerInterface, smsH handlers.SmsHandlerInterface, priceH handlers.PriceHandlerInterface, rateH handlers.RateLimitHandlerInterface, exportH handlers.ExportHandlerInterface, reportH handlers.ReportHandlerInterface, quotaL quota.LimiterInterface, healthR *health.Registry) {
 
 	app.Get("/health", func(c *fiber.Ctx) error {
 		err := c.SendString("API is UP!")
 		return err
 	})
+	app.Get("/livez", adaptor.HTTPHandler(healthR.LivenessHandler()))
+	app.Get("/readyz", adaptor.HTTPHandler(healthR.ReadinessHandler()))
 
 	app.Get("/account/createuser", userH.CreateUser)
 	app.Get("/account/:user_id/services/status", userH.GetUserServiceStatus)
+	app.Get("/account/:user_id/reports", reportH.GetReport)
 	app.Get("/account/:user_id/services/create", userH.CreateServiceForUser)
 	app.Post("/account/:user_id/services/charge", userH.ChargeService)
+	app.Post("/account/:user_id/services/:service_id/alerts", userH.ConfigureServiceAlerts)
+	app.Post("/account/:user_id/services/:service_id/limits", userH.ConfigureServiceLimits)
+	app.Post("/account/:user_id/services/:service_id/retention", userH.ConfigureServiceRetention)
+	app.Get("/account/:user_id/services/:service_id/purges", userH.GetServicePurges)
 	app.Get("/account/:user_id/services/:service_id/messages", userH.GetServiceMessages)
+	app.Get("/account/:user_id/services/:service_id/messages/export", exportH.StreamExport)
+	app.Post("/account/:user_id/services/:service_id/exports", exportH.CreateExport)
+	app.Get("/account/:user_id/services/:service_id/exports/:export_id", exportH.GetExport)
+	app.Get("/account/:user_id/services/:service_id/exports/:export_id/download", exportH.DownloadExport)
 
-	app.Post("/sms/:user_id/:service_id/express/send", smsH.SendExpressSms)
-	app.Post("/sms/:user_id/:service_id/async/send", smsH.SendAsyncSms)
+	app.Post("/sms/:user_id/:service_id/express/send", quotaL.Messages(), smsH.SendExpressSms)
+	app.Post("/sms/:user_id/:service_id/async/send", quotaL.Messages(), smsH.SendAsyncSms)
+	app.Post("/sms/:user_id/:service_id/quote", quotaL.Requests(), smsH.QuoteSms)
+	app.Post("/sms/:user_id/:service_id/messages/:sms_id/cancel", quotaL.Requests(), smsH.CancelSms)
+
+	app.Post("/prices/preview", priceH.PreviewCost)
+	app.Get("/admin/prices", priceH.ListPrices)
+	app.Post("/admin/prices", priceH.UpsertPrice)
+	app.Delete("/admin/prices/:price_id", priceH.DeletePrice)
+
+	app.Get("/admin/rate-limits", rateH.ListRateLimits)
+	app.Post("/admin/rate-limits", rateH.UpsertRateLimit)
+	app.Delete("/admin/rate-limits/:limit_id", rateH.DeleteRateLimit)
 
 }
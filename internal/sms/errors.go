@@ -0,0 +1,6 @@
+package sms
+
+import "postchi/internal/sms/providers"
+
+// ErrRateLimited is returned, wrapped, when a provider throttled a send.
+var ErrRateLimited = providers.ErrRateLimited
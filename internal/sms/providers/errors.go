@@ -0,0 +1,7 @@
+package providers
+
+import "errors"
+
+// ErrRateLimited is wrapped by providers when the upstream rejected a send
+// because too many requests were made.
+var ErrRateLimited = errors.New("sms: provider rate limited")
@@ -2,19 +2,38 @@ package kavenegar
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"postchi/internal/sms/providers"
 
 	"github.com/kavenegar/kavenegar-go"
 )
 
+const apiBaseURL = "https://api.kavenegar.com/"
+
 type SmsProvider struct {
 	ApiKey     string
 	FromNumber string
 }
 
+// contextTransport attaches ctx to every request, since the Kavenegar client
+// builds its requests without one and would otherwise ignore deadlines.
+type contextTransport struct {
+	ctx context.Context
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return http.DefaultTransport.RoundTrip(req.WithContext(t.ctx))
+}
+
 func (p *SmsProvider) SendSMS(ctx context.Context, to string, message string) (int, int, error) {
-	api := kavenegar.New(p.ApiKey)
+	client := kavenegar.NewClient(p.ApiKey)
+	client.BaseClient = &http.Client{Transport: contextTransport{ctx: ctx}}
+	api := kavenegar.NewWithClient(client)
 	if res, err := api.Message.Send(p.FromNumber, []string{to}, message, nil); err != nil {
-		return 0, 0, err
+		return 0, 0, classify(err)
 	} else {
 		return int(res[0].Status), res[0].MessageID, nil
 	}
@@ -23,3 +42,34 @@ func (p *SmsProvider) SendSMS(ctx context.Context, to string, message string) (i
 func (p *SmsProvider) GetName() string {
 	return "kavenegar"
 }
+
+func (p *SmsProvider) GetSender() string {
+	return p.FromNumber
+}
+
+// Ping checks that the Kavenegar API answers HTTP at all; any status code
+// counts as reachable since no credentials are sent.
+func (p *SmsProvider) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, apiBaseURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func classify(err error) error {
+	var apiErr *kavenegar.APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %v", providers.ErrRateLimited, err)
+	}
+	var httpErr *kavenegar.HTTPError
+	if errors.As(err, &httpErr) && httpErr.Status == http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %v", providers.ErrRateLimited, err)
+	}
+	return err
+}
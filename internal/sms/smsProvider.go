@@ -6,3 +6,14 @@ type SmsProvider interface {
 	SendSMS(ctx context.Context, to string, message string) (int, int, error)
 	GetName() string
 }
+
+// SenderAware providers report the number they send from, so limits can be
+// applied per sender line.
+type SenderAware interface {
+	GetSender() string
+}
+
+// Pinger providers can report whether their upstream API is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
@@ -1,6 +1,13 @@
 package sms
 
-import "context"
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
 
 type Service struct {
 	provider SmsProvider
@@ -11,5 +18,16 @@ func NewService(provider SmsProvider) *Service {
 }
 
 func (s *Service) Send(ctx context.Context, to string, message string) (int, int, error) {
-	return s.provider.SendSMS(ctx, to, message)
+	ctx, span := otel.Tracer("postchi/sms").Start(ctx, "sms.provider.send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("postchi.provider", s.provider.GetName())))
+	defer span.End()
+
+	status, msgID, err := s.provider.SendSMS(ctx, to, message)
+	span.SetAttributes(attribute.Int("postchi.provider_status", status))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return status, msgID, err
 }
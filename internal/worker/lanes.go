@@ -0,0 +1,44 @@
+package worker
+
+import (
+	"postchi/internal/helpers"
+	"postchi/pkg/env"
+	"postchi/pkg/kafka"
+)
+
+// Lane is one priority class of SMS traffic with its own topic and consumer.
+// Weight is how many messages the dispatcher takes from the lane per round.
+type Lane struct {
+	Priority string
+	Topic    string
+	Weight   int
+	Client   kafka.KafkaInterface
+
+	ch chan job
+	// rebalances is the reader's rebalance count when the lane last fetched
+	rebalances int64
+}
+
+// LanesInit builds the high, normal and low lanes in dispatch order.
+func LanesInit(e *env.Envs) ([]*Lane, error) {
+	weights := map[string]int{
+		kafka.PriorityHigh:   e.SMS_LANE_WEIGHT_HIGH,
+		kafka.PriorityNormal: e.SMS_LANE_WEIGHT_NORMAL,
+		kafka.PriorityLow:    e.SMS_LANE_WEIGHT_LOW,
+	}
+
+	lanes := make([]*Lane, 0, len(weights))
+	for _, p := range []string{kafka.PriorityHigh, kafka.PriorityNormal, kafka.PriorityLow} {
+		topic := helpers.TopicForPriority(e, p)
+		client, err := kafka.Init(e.KAFKA_BROKERS, topic)
+		if err != nil {
+			return nil, err
+		}
+		weight := weights[p]
+		if weight < 1 {
+			weight = 1
+		}
+		lanes = append(lanes, &Lane{Priority: p, Topic: topic, Weight: weight, Client: client})
+	}
+	return lanes, nil
+}
@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"sync"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// offsetTracker lets concurrent workers finish messages in any order while
+// only committing, per partition, the highest offset below which every
+// fetched message has been processed.
+type offsetTracker struct {
+	mu         sync.Mutex
+	gen        uint64
+	partitions map[partitionKey]*partitionOffsets
+}
+
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+type partitionOffsets struct {
+	// gen identifies this assignment of the partition; acks carrying an older
+	// gen belong to a previous assignment and are ignored
+	gen     uint64
+	last    int64
+	pending []int64
+	done    map[int64]kafkago.Message
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{partitions: make(map[partitionKey]*partitionOffsets)}
+}
+
+// track registers a fetched message and returns the generation to pass to
+// done. Messages of one partition must be tracked in fetch order; an offset at
+// or below the last tracked one means the partition was reassigned and is
+// being read again from its committed offset, so its state starts over.
+func (t *offsetTracker) track(msg kafkago.Message) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := partitionKey{topic: msg.Topic, partition: msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok || msg.Offset <= p.last {
+		t.gen++
+		p = &partitionOffsets{gen: t.gen, done: make(map[int64]kafkago.Message)}
+		t.partitions[key] = p
+	}
+	p.last = msg.Offset
+	p.pending = append(p.pending, msg.Offset)
+	return p.gen
+}
+
+// reset forgets every partition of topic, after a consumer group rebalance
+// may have moved them to another member.
+func (t *offsetTracker) reset(topic string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.partitions {
+		if key.topic == topic {
+			delete(t.partitions, key)
+		}
+	}
+}
+
+// done marks msg processed and returns the message whose offset can now be
+// committed, if the contiguous processed prefix of its partition advanced.
+func (t *offsetTracker) done(msg kafkago.Message, gen uint64) (kafkago.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.partitions[partitionKey{topic: msg.Topic, partition: msg.Partition}]
+	if !ok || p.gen != gen {
+		return kafkago.Message{}, false
+	}
+	p.done[msg.Offset] = msg
+
+	var commit kafkago.Message
+	advanced := false
+	for len(p.pending) > 0 {
+		m, ok := p.done[p.pending[0]]
+		if !ok {
+			break
+		}
+		delete(p.done, p.pending[0])
+		p.pending = p.pending[1:]
+		commit, advanced = m, true
+	}
+	return commit, advanced
+}
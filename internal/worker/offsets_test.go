@@ -0,0 +1,129 @@
+package worker
+
+import (
+	"testing"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+func message(partition int, offset int64) kafkago.Message {
+	return kafkago.Message{Topic: "sms", Partition: partition, Offset: offset}
+}
+
+func TestOffsetTracker(t *testing.T) {
+	type ack struct {
+		partition int
+		offset    int64
+		// commit is the offset that may be committed after the ack, -1 for none
+		commit int64
+	}
+	tests := []struct {
+		name    string
+		fetched map[int][]int64
+		acks    []ack
+	}{
+		{
+			name:    "in order acks commit each message",
+			fetched: map[int][]int64{0: {10, 11, 12}},
+			acks:    []ack{{0, 10, 10}, {0, 11, 11}, {0, 12, 12}},
+		},
+		{
+			name:    "out of order acks commit once the prefix is done",
+			fetched: map[int][]int64{0: {10, 11, 12}},
+			acks:    []ack{{0, 12, -1}, {0, 11, -1}, {0, 10, 12}},
+		},
+		{
+			name:    "a gap blocks the commit",
+			fetched: map[int][]int64{0: {10, 11, 12, 13}},
+			acks:    []ack{{0, 10, 10}, {0, 12, -1}, {0, 13, -1}, {0, 11, 13}},
+		},
+		{
+			name:    "partitions commit independently",
+			fetched: map[int][]int64{0: {10, 11}, 1: {5, 6}},
+			acks:    []ack{{0, 11, -1}, {1, 5, 5}, {0, 10, 11}, {1, 6, 6}},
+		},
+		{
+			name:    "offsets need not be contiguous",
+			fetched: map[int][]int64{0: {10, 14, 20}},
+			acks:    []ack{{0, 20, -1}, {0, 10, 10}, {0, 14, 20}},
+		},
+		{
+			name:    "a duplicate ack commits nothing",
+			fetched: map[int][]int64{0: {10, 11}},
+			acks:    []ack{{0, 10, 10}, {0, 10, -1}, {0, 11, 11}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newOffsetTracker()
+			gens := map[int]uint64{}
+			for partition, offsets := range tt.fetched {
+				for _, offset := range offsets {
+					gens[partition] = tr.track(message(partition, offset))
+				}
+			}
+			for _, a := range tt.acks {
+				commit, ok := tr.done(message(a.partition, a.offset), gens[a.partition])
+				if a.commit < 0 {
+					if ok {
+						t.Fatalf("ack %d/%d committed %d, want nothing", a.partition, a.offset, commit.Offset)
+					}
+					continue
+				}
+				if !ok || commit.Offset != a.commit || commit.Partition != a.partition {
+					t.Fatalf("ack %d/%d committed %d (%v), want %d", a.partition, a.offset, commit.Offset, ok, a.commit)
+				}
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerRebalance(t *testing.T) {
+	t.Run("reset drops acks of the previous generation", func(t *testing.T) {
+		tr := newOffsetTracker()
+		oldGen := tr.track(message(0, 10))
+		tr.track(message(0, 11))
+
+		tr.reset("sms")
+		newGen := tr.track(message(0, 11))
+		if newGen == oldGen {
+			t.Fatal("generation did not change after reset")
+		}
+
+		// the old assignment's message 10 finishing must not commit for the new owner
+		if commit, ok := tr.done(message(0, 10), oldGen); ok {
+			t.Fatalf("stale ack committed %d", commit.Offset)
+		}
+		if commit, ok := tr.done(message(0, 11), newGen); !ok || commit.Offset != 11 {
+			t.Fatalf("got %d (%v), want 11", commit.Offset, ok)
+		}
+	})
+
+	t.Run("reset only touches its topic", func(t *testing.T) {
+		tr := newOffsetTracker()
+		gen := tr.track(message(0, 10))
+		tr.reset("sms_high")
+		if commit, ok := tr.done(message(0, 10), gen); !ok || commit.Offset != 10 {
+			t.Fatalf("got %d (%v), want 10", commit.Offset, ok)
+		}
+	})
+
+	t.Run("reading an offset again starts a new generation", func(t *testing.T) {
+		tr := newOffsetTracker()
+		oldGen := tr.track(message(0, 10))
+		tr.track(message(0, 11))
+
+		// the partition came back and is read again from its committed offset
+		newGen := tr.track(message(0, 10))
+		if newGen == oldGen {
+			t.Fatal("generation did not change when the offset went back")
+		}
+		if _, ok := tr.done(message(0, 11), oldGen); ok {
+			t.Fatal("stale ack committed")
+		}
+		if commit, ok := tr.done(message(0, 10), newGen); !ok || commit.Offset != 10 {
+			t.Fatalf("got %d (%v), want 10", commit.Offset, ok)
+		}
+	})
+}
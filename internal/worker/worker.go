@@ -0,0 +1,531 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"postchi/internal/helpers"
+	"postchi/internal/metrics"
+	"postchi/internal/ratelimit"
+	"postchi/internal/sms"
+	"postchi/pkg/db"
+	"postchi/pkg/env"
+	"postchi/pkg/kafka"
+	"postchi/pkg/logger"
+	"sync"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxSendAttempts is how many times a message is tried before its reserved
+// credit is released and it is marked failed.
+const maxSendAttempts = 3
+
+// retryBackoff and maxRetryBackoff bound the waits between in-place retries of
+// a step that failed on the database or the broker. Such a step holds its
+// message until it succeeds or the worker shuts down.
+const (
+	retryBackoff    = 200 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+)
+
+// handoffTimeout bounds publishing a delivered message's result at shutdown.
+const handoffTimeout = 5 * time.Second
+
+// rateLimitedRetries is how many extra tries a throttled send gets.
+const rateLimitedRetries = 5
+
+// sendRetryDelay is how long the first retry of a failed send waits; it
+// doubles with every attempt so a provider outage does not use up all of a
+// message's attempts in seconds. The waiting message holds its worker.
+const sendRetryDelay = 15 * time.Second
+
+// sendTimeout bounds one provider call. A call is not cancelled on shutdown,
+// since the provider may already have the message, so this also bounds how
+// long a shutdown waits for it.
+const sendTimeout = 10 * time.Second
+
+// stuckSweepInterval is how often messages stuck in sending are reconciled.
+const stuckSweepInterval = time.Minute
+
+// queueSampleInterval is how often lane depth and consumer lag are exported.
+const queueSampleInterval = 5 * time.Second
+
+type job struct {
+	sms  kafka.SmsKafkaMessage
+	raw  kafkago.Message
+	gen  uint64
+	lane *Lane
+}
+
+type Worker struct {
+	Envs        *env.Envs
+	Metrics     *metrics.Metrics
+	Logger      logger.LoggerInterface
+	KafkaClinet kafka.KafkaInterface
+	Db          db.DataBaseInterface
+	Lanes       []*Lane
+	Limiter     ratelimit.ProviderLimiterInterface
+
+	offsets  *offsetTracker
+	tracer   trace.Tracer
+	ready    chan struct{}
+	wg       sync.WaitGroup
+	stopping context.Context
+	cancel   context.CancelFunc
+}
+
+func WorkerHandlerInit(l logger.LoggerInterface, e *env.Envs, m *metrics.Metrics, k kafka.KafkaInterface, lanes []*Lane, d db.DataBaseInterface, rl ratelimit.ProviderLimiterInterface) *Worker {
+	return &Worker{Envs: e, Logger: l, Metrics: m, KafkaClinet: k, Db: d, Lanes: lanes, Limiter: rl, offsets: newOffsetTracker(), tracer: otel.Tracer("postchi/worker"), ready: make(chan struct{}, 1)}
+}
+
+// Start begins consuming the lanes and returns; Shutdown stops it.
+func (w *Worker) Start() error {
+
+	const queueSize = 1000
+
+	for _, lane := range w.Lanes {
+		if err := lane.Client.UseReader(w.Envs.KAFKA_CONSUMER_GROUP); err != nil {
+			w.Logger.Error("[worker] kafka reader init failed", logger.String("lane", lane.Priority), logger.Err(err))
+			return err
+		}
+		lane.ch = make(chan job, queueSize/len(w.Lanes))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w.stopping, w.cancel = ctx, cancel
+
+	workers := w.Envs.SMS_WORKER_COUNT
+	// unbuffered so the dispatcher, not a shared backlog, decides what runs next
+	jobs := make(chan job)
+
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go w.workerLoop(jobs, &w.wg)
+	}
+	w.Logger.Info("[worker] started workers", logger.Int("workers", workers))
+
+	go w.reconcileStuck(ctx)
+	go w.sampleQueues(ctx)
+	go w.Limiter.Start(ctx)
+
+	for _, lane := range w.Lanes {
+		go w.fetchLane(ctx, lane)
+	}
+	go w.dispatch(ctx, jobs)
+	return nil
+}
+
+// Lag returns the last observed consumer lag of every lane.
+func (w *Worker) Lag() map[string]int64 {
+	lags := make(map[string]int64, len(w.Lanes))
+	for _, lane := range w.Lanes {
+		lags[lane.Priority] = lane.Client.Lag()
+	}
+	return lags
+}
+
+// Shutdown stops fetching, lets in-flight jobs finish until ctx expires and
+// then closes the Kafka readers and the retry writer. Messages that did not
+// finish are left uncommitted and are redelivered to the next consumer.
+func (w *Worker) Shutdown(ctx context.Context) error {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.Logger.Info("[worker] waiting for in-flight jobs")
+
+	drained := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("worker: in-flight jobs not finished: %w", ctx.Err())
+	}
+
+	for _, lane := range w.Lanes {
+		if e := lane.Client.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if e := w.KafkaClinet.Close(); e != nil && err == nil {
+		err = e
+	}
+	w.Logger.Info("[worker] exit")
+	return err
+}
+
+// fetchLane reads one lane's topic into its buffer until ctx is cancelled.
+func (w *Worker) fetchLane(ctx context.Context, lane *Lane) {
+	for {
+		msg, err := lane.Client.FetchMessage(ctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				w.Logger.Info("[worker] shutdown requested, lane stopped", logger.String("lane", lane.Priority))
+				return
+			}
+			w.Logger.Warn("[worker] read error", logger.String("lane", lane.Priority), logger.Err(err))
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+
+		// partitions may have moved to another member; their in-flight messages
+		// must not commit on behalf of the new owner
+		if n := lane.Client.Rebalances(); n != lane.rebalances {
+			lane.rebalances = n
+			w.offsets.reset(lane.Topic)
+			w.Logger.Info("[worker] consumer group rebalanced, offsets reset", logger.String("lane", lane.Priority))
+		}
+		gen := w.offsets.track(*msg)
+
+		var j kafka.SmsKafkaMessage
+		if err := json.Unmarshal(msg.Value, &j); err != nil {
+			w.Logger.Ctx(kafka.ExtractContext(ctx, *msg)).Error("[worker] json decode failed", logger.String("lane", lane.Priority), logger.Err(err))
+			w.ack(lane, *msg, gen)
+			continue
+		}
+
+		select {
+		case lane.ch <- job{sms: j, raw: *msg, gen: gen, lane: lane}:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case w.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dispatch feeds workers by weighted round robin over the lanes, taking up to
+// Weight buffered messages from each lane per round in priority order, so high
+// priority traffic is drained first while lower lanes still make progress.
+func (w *Worker) dispatch(ctx context.Context, jobs chan<- job) {
+	defer close(jobs)
+	for {
+		sent := 0
+		for _, lane := range w.Lanes {
+		drain:
+			for i := 0; i < lane.Weight; i++ {
+				select {
+				case jb := <-lane.ch:
+					select {
+					case jobs <- jb:
+						sent++
+					case <-ctx.Done():
+						return
+					}
+				default:
+					break drain
+				}
+			}
+		}
+		if sent > 0 {
+			continue
+		}
+		select {
+		case <-w.ready:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Worker) workerLoop(jobs <-chan job, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for jb := range jobs {
+		// continue the trace started by the request that enqueued the message.
+		// The job context outlives shutdown so a delivered message can still be
+		// recorded; the steps that may wait long use untilStopping instead.
+		ctx, span := w.tracer.Start(kafka.ExtractContext(context.Background(), jb.raw), jb.raw.Topic+" process",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				semconv.MessagingSystemKafka,
+				semconv.MessagingDestinationName(jb.raw.Topic),
+				attribute.Int64("postchi.sms_id", int64(jb.sms.SmsId)),
+				attribute.Int64("postchi.service_id", int64(jb.sms.ServiceId)),
+				attribute.String("postchi.priority", jb.lane.Priority),
+				attribute.Int("postchi.attempts", jb.sms.Attempts),
+			))
+		w.Metrics.WorkerInFlight.Inc()
+		ok := w.process(ctx, jb.sms)
+		w.Metrics.WorkerInFlight.Dec()
+		span.End()
+		if ok {
+			w.ack(jb.lane, jb.raw, jb.gen)
+		}
+	}
+}
+
+// reconcileStuck periodically fails messages whose worker died between
+// claiming them and recording the provider's answer, and charges express
+// messages whose capture failed after the provider accepted them.
+func (w *Worker) reconcileStuck(ctx context.Context) {
+	ticker := time.NewTicker(stuckSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cutoff := time.Now().Add(-time.Duration(w.Envs.SMS_SENDING_TIMEOUT) * time.Second)
+			n, err := w.Db.FailStuckSending(cutoff, 100)
+			if err != nil {
+				w.Logger.Error("[worker] stuck sending sweep failed", logger.Err(err))
+				continue
+			}
+			if n > 0 {
+				w.Logger.Warn("[worker] failed messages stuck in sending", logger.Int("count", n))
+			}
+			n, err = w.Db.CaptureUncaptured(100)
+			if err != nil {
+				w.Logger.Error("[worker] uncaptured sweep failed", logger.Err(err))
+				continue
+			}
+			if n > 0 {
+				w.Logger.Warn("[worker] captured uncaptured messages", logger.Int("count", n))
+			}
+		}
+	}
+}
+
+// sampleQueues periodically exports each lane's buffered messages and
+// consumer lag.
+func (w *Worker) sampleQueues(ctx context.Context) {
+	ticker := time.NewTicker(queueSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, lane := range w.Lanes {
+				w.Metrics.QueueDepth.WithLabelValues(lane.Priority).Set(float64(len(lane.ch)))
+				w.Metrics.ConsumerLag.WithLabelValues(lane.Priority).Set(float64(lane.Client.Lag()))
+			}
+		}
+	}
+}
+
+// ack marks msg processed and commits the partition offset once every earlier
+// message of that partition is processed too.
+func (w *Worker) ack(lane *Lane, msg kafkago.Message, gen uint64) {
+	commit, ok := w.offsets.done(msg, gen)
+	if !ok {
+		return
+	}
+	if err := lane.Client.CommitMessages(context.Background(), commit); err != nil {
+		w.Logger.Error("[worker] offset commit failed", logger.String("lane", lane.Priority), logger.Err(err))
+	}
+}
+
+// retry runs step until it succeeds, backing off between failures. It gives
+// up only once the worker is shutting down and then returns the last error.
+func (w *Worker) retry(log logger.LoggerInterface, what string, step func() error) error {
+	wait := retryBackoff
+	for {
+		err := step()
+		if err == nil {
+			return nil
+		}
+		log.Error("[worker] "+what+" failed", logger.Duration("backoff", wait), logger.Err(err))
+		select {
+		case <-w.stopping.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait = min(wait*2, maxRetryBackoff)
+	}
+}
+
+// untilStopping returns a copy of ctx that is also cancelled once the worker
+// starts shutting down.
+func (w *Worker) untilStopping(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(w.stopping, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// process handles one message and reports whether its offset may be committed.
+// It is false when the worker shut down before the message was sent or while
+// a step was still failing.
+func (w *Worker) process(ctx context.Context, j kafka.SmsKafkaMessage) bool {
+	log := w.Logger.Ctx(ctx).With(logger.UserID(j.UserId), logger.ServiceID(j.ServiceId),
+		logger.SmsID(j.SmsId), logger.Provider(j.Provider))
+
+	if j.Delivered {
+		return w.capture(ctx, log, j, j.Provider, j.ProviderMessageId)
+	}
+
+	if wait := time.Until(time.UnixMilli(j.NotBefore)); j.NotBefore > 0 && wait > 0 {
+		select {
+		case <-w.stopping.Done():
+			return false
+		case <-time.After(wait):
+		}
+	}
+
+	var claimed bool
+	err := w.retry(log, "claim sms", func() error {
+		var err error
+		claimed, err = w.Db.WithContext(ctx).ClaimSmsForSending(j.ServiceId, j.SmsId)
+		return err
+	})
+	if err != nil {
+		return false
+	}
+	if !claimed {
+		// already sent, cancelled or being sent by another worker
+		log.Info("[worker] skipping sms not in queued state")
+		return true
+	}
+
+	prov, err := sms.NewProvider(w.Envs, j.Provider)
+	if err != nil {
+		log.Error("[worker] init provider failed", logger.Err(err))
+		w.Metrics.Message(metrics.UnknownProvider, "async", metrics.StatusFailed)
+		if err := w.Db.WithContext(ctx).ReleaseSmsCredit(j.UserId, j.ServiceId, j.SmsId, db.SmsStatusFailed); err != nil {
+			log.Error("[worker] failed to release reserved credit", logger.Err(err))
+		}
+		return true
+	}
+	svc := sms.NewService(prov)
+	sender := ""
+	if sa, ok := prov.(sms.SenderAware); ok {
+		sender = sa.GetSender()
+	}
+
+	var status, msgID int
+	var sendErr error
+	var elapsed time.Duration
+	waitCtx, stopWait := w.untilStopping(ctx)
+	defer stopWait()
+	// throttling by the provider is not the message's fault, so it is retried
+	// here behind the limiter's backoff without using up a send attempt
+	for try := 0; try <= rateLimitedRetries; try++ {
+		if err := w.Limiter.Wait(waitCtx, prov.GetName(), sender); err != nil {
+			if w.stopping.Err() != nil {
+				// nothing was sent; hand the message to the next consumer
+				_ = w.retry(log, "requeue sms", func() error {
+					return w.Db.WithContext(ctx).RequeueSms(j.ServiceId, j.SmsId)
+				})
+				return false
+			}
+			sendErr = err
+			break
+		}
+		start := time.Now()
+		sendCtx, cancelSend := context.WithTimeout(ctx, sendTimeout)
+		status, msgID, sendErr = svc.Send(sendCtx, j.To, j.Content)
+		cancelSend()
+		elapsed = time.Since(start)
+		if !errors.Is(sendErr, sms.ErrRateLimited) {
+			break
+		}
+		w.Metrics.ProviderRequest(prov.GetName(), metrics.ResultRateLimited, elapsed)
+		backoff := w.Limiter.Throttled(prov.GetName())
+		log.Warn("[worker] provider throttled, backing off", logger.Duration("backoff", backoff))
+	}
+	if sendErr == nil {
+		w.Limiter.Succeeded(prov.GetName())
+	}
+
+	if sendErr != nil {
+		if !errors.Is(sendErr, sms.ErrRateLimited) && elapsed > 0 {
+			w.Metrics.ProviderRequest(prov.GetName(), metrics.ResultError, elapsed)
+		}
+		log.Error("[worker] send failed", logger.Int("attempts", j.Attempts+1), logger.Err(sendErr))
+		j.Attempts++
+		if j.Attempts >= maxSendAttempts {
+			w.Metrics.Message(prov.GetName(), "async", metrics.StatusFailed)
+			if err := w.Db.WithContext(ctx).ReleaseSmsCredit(j.UserId, j.ServiceId, j.SmsId, db.SmsStatusFailed); err != nil {
+				log.Error("[worker] failed to release reserved credit", logger.Err(err))
+			}
+			return true
+		}
+		// a row left in sending would make the retry skip it
+		err := w.retry(log, "requeue sms", func() error {
+			return w.Db.WithContext(ctx).RequeueSms(j.ServiceId, j.SmsId)
+		})
+		if err != nil {
+			return false
+		}
+		j.NotBefore = time.Now().Add(sendRetryDelay << (j.Attempts - 1)).UnixMilli()
+		kafkaValue, parseErr := json.Marshal(j)
+		if parseErr != nil {
+			log.Error("[worker] retry message encode failed", logger.Err(parseErr))
+			return true
+		}
+		topic := helpers.TopicForPriority(w.Envs, j.Priority)
+		err = w.retry(log, "retry publish", func() error {
+			return w.KafkaClinet.PublishTopic(ctx, topic, j.Provider, kafkaValue)
+		})
+		// on shutdown keep the original offset uncommitted so the retry is not lost
+		return err == nil
+	}
+
+	w.Metrics.ProviderRequest(prov.GetName(), metrics.ResultOK, elapsed)
+	w.Metrics.Message(prov.GetName(), "async", metrics.StatusSent)
+	log.Info("[worker] sent OK",
+		logger.String("to", j.To),
+		logger.Int("status", status),
+		logger.Int("provider_msg_id", msgID),
+		logger.Duration("elapsed", elapsed))
+	return w.capture(ctx, log, j, prov.GetName(), msgID)
+}
+
+// capture records a delivered message as sent and charges its reservation,
+// reporting whether its offset may be committed. If the worker shuts down
+// before that succeeds, the result is published as a Delivered message so the
+// next consumer captures it; otherwise the redelivered original would find the
+// row in sending, skip it, and the stuck sweep would refund a delivered send.
+func (w *Worker) capture(ctx context.Context, log logger.LoggerInterface, j kafka.SmsKafkaMessage, providerName string, msgID int) bool {
+	err := w.retry(log, "capture credit", func() error {
+		err := w.Db.WithContext(ctx).MarkSmsSent(j.UserId, j.ServiceId, j.SmsId, providerName, msgID, j.Cost)
+		if errors.Is(err, db.ErrSmsNotQueued) {
+			log.Warn("[worker] sms already settled, nothing to capture")
+			return nil
+		}
+		if err == nil {
+			w.Metrics.Spent(providerName, "async", j.Cost)
+		}
+		return err
+	})
+	if err == nil {
+		return true
+	}
+	if j.Delivered {
+		// already a handoff; leave it uncommitted for the next consumer
+		return false
+	}
+
+	j.Delivered = true
+	j.Provider = providerName
+	j.ProviderMessageId = msgID
+	value, encErr := json.Marshal(j)
+	if encErr != nil {
+		log.Error("[worker] capture handoff encode failed", logger.Err(encErr))
+		return false
+	}
+	pubCtx, cancel := context.WithTimeout(ctx, handoffTimeout)
+	defer cancel()
+	if pubErr := w.KafkaClinet.PublishTopic(pubCtx, helpers.TopicForPriority(w.Envs, j.Priority), j.Provider, value); pubErr != nil {
+		log.Error("[worker] capture handoff failed, sms may be refunded by the stuck sweep", logger.Err(pubErr))
+		return false
+	}
+	return true
+}
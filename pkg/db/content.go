@@ -0,0 +1,111 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"postchi/pkg/envelope"
+)
+
+var ErrNoContentKey = errors.New("sms content is encrypted but no key provider is configured")
+
+// sealSms replaces s.Content with its ciphertext and returns the plaintext,
+// which restoreContent puts back once the row is written.
+func (d *DataBaseWrapper) sealSms(s *Sms) (string, error) {
+	plaintext := s.Content
+	if d.Sealer == nil {
+		return plaintext, nil
+	}
+	sealed, err := d.Sealer.Seal(d.DBConn.Statement.Context, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	s.Content = base64.StdEncoding.EncodeToString(sealed.Ciphertext)
+	s.ContentKeyID = sealed.KeyID
+	s.ContentDataKey = sealed.DataKey
+	return plaintext, nil
+}
+
+func (d *DataBaseWrapper) restoreContent(s *Sms, plaintext string) {
+	s.Content = plaintext
+}
+
+// openSms decrypts s.Content in place. Rows stored before encryption was
+// enabled are returned as they are.
+func (d *DataBaseWrapper) openSms(s *Sms) error {
+	if s.ContentKeyID == "" {
+		return nil
+	}
+	if d.Sealer == nil {
+		return ErrNoContentKey
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(s.Content)
+	if err != nil {
+		return err
+	}
+	plaintext, err := d.Sealer.Open(d.DBConn.Statement.Context, envelope.Sealed{
+		KeyID:      s.ContentKeyID,
+		DataKey:    s.ContentDataKey,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return err
+	}
+	s.Content = string(plaintext)
+	return nil
+}
+
+func (d *DataBaseWrapper) RewrapSmsContent(limit int) (int, error) {
+	if d.Sealer == nil {
+		return 0, ErrNoContentKey
+	}
+	ctx := d.DBConn.Statement.Context
+	current := d.Sealer.Provider.CurrentKeyID()
+
+	var rows []Sms
+	err := d.DBConn.Unscoped().
+		Select("id", "content", "content_key_id", "content_data_key").
+		Where("content_key_id <> ?", current).
+		Order("id").
+		Limit(limit).
+		Find(&rows).Error
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, row := range rows {
+		var sealed envelope.Sealed
+		if row.ContentKeyID == "" {
+			sealed, err = d.Sealer.Seal(ctx, []byte(row.Content))
+		} else {
+			ciphertext, decodeErr := base64.StdEncoding.DecodeString(row.Content)
+			if decodeErr != nil {
+				return changed, decodeErr
+			}
+			// only the data key is rewrapped, the content ciphertext is kept
+			sealed, err = d.Sealer.Rewrap(ctx, envelope.Sealed{
+				KeyID:      row.ContentKeyID,
+				DataKey:    row.ContentDataKey,
+				Ciphertext: ciphertext,
+			})
+		}
+		if err != nil {
+			return changed, err
+		}
+
+		// matching the old key id skips rows rewritten concurrently
+		result := d.DBConn.Unscoped().Model(&Sms{}).
+			Where("id = ? AND content_key_id = ?", row.ID, row.ContentKeyID).
+			Updates(map[string]interface{}{
+				"content":          base64.StdEncoding.EncodeToString(sealed.Ciphertext),
+				"content_key_id":   sealed.KeyID,
+				"content_data_key": sealed.DataKey,
+			})
+		if result.Error != nil {
+			return changed, result.Error
+		}
+		changed += int(result.RowsAffected)
+	}
+	return changed, nil
+}
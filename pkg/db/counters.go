@@ -0,0 +1,54 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IncrCounter adds delta to the counter called name and returns its new
+// value. A missing or expired counter starts over at delta and expires ttl
+// from now; a live one keeps its expiry.
+func (d *DataBaseWrapper) IncrCounter(name string, delta int64, ttl time.Duration) (int64, error) {
+	now := time.Now().UTC()
+	var value int64
+	err := d.DBConn.Transaction(func(tx *gorm.DB) error {
+		// value is assigned first: mysql evaluates the assignments in order,
+		// so both must still see the old expires_at
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "name"}},
+			DoUpdates: clause.Set{
+				{Column: clause.Column{Name: "value"}, Value: gorm.Expr(
+					"CASE WHEN quota_counters.expires_at <= ? THEN ? ELSE quota_counters.value + ? END", now, delta, delta)},
+				{Column: clause.Column{Name: "expires_at"}, Value: gorm.Expr(
+					"CASE WHEN quota_counters.expires_at <= ? THEN ? ELSE quota_counters.expires_at END", now, now.Add(ttl))},
+			},
+		}).Create(&QuotaCounter{Name: name, Value: delta, ExpiresAt: now.Add(ttl)}).Error
+		if err != nil {
+			return err
+		}
+		// the upsert holds the row lock until commit, so this reads our write
+		return tx.Model(&QuotaCounter{}).Where("name = ?", name).Select("value").Scan(&value).Error
+	})
+	return value, err
+}
+
+// GetCounter returns the value of the counter called name, zero when it is
+// missing or expired.
+func (d *DataBaseWrapper) GetCounter(name string) (int64, error) {
+	var c QuotaCounter
+	err := d.DBConn.Where("name = ? AND expires_at > ?", name, time.Now().UTC()).First(&c).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	return c.Value, err
+}
+
+// DeleteExpiredCounters drops counters that expired before now and returns
+// how many it removed.
+func (d *DataBaseWrapper) DeleteExpiredCounters() (int, error) {
+	res := d.DBConn.Where("expires_at <= ?", time.Now().UTC()).Delete(&QuotaCounter{})
+	return int(res.RowsAffected), res.Error
+}
@@ -1,38 +1,147 @@
 package db
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"time"
 
+	"postchi/pkg/db/migrations"
+	"postchi/pkg/envelope"
+	"postchi/pkg/kafka"
+
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type DataBaseInterface interface {
 	DB() *gorm.DB
+	// WithContext returns a copy whose queries run with ctx, so they are
+	// cancelled with it and traced as its children.
+	WithContext(ctx context.Context) DataBaseInterface
+	Ping(ctx context.Context) error
+	Close() error
 	CreateUser(name string, password string) error
 	GetUserServices(userID uint) ([]Service, error)
 	CreateUserService(userID uint, ServiceType ServiceType, intialCredit int) error
 	UpdateServiceCredit(userId uint, serviceId uint, creditAmount int) error
 	CreateSmsRecord(s *Sms) error
 	SpendServiceCredit(userId uint, serviceId uint, cost int) error
-	GetServiceSms(serviceId uint, offset int, limit int) ([]Sms, error)
-	CreateSmsAndSpendCredit(userId uint, serviceId uint, sms *Sms, cost uint) error
-	MarkSmsSent(userId uint, serviceId uint, smsId uint, providerName string, providerMsgID int) error
+	// ListSms returns one page of a service's messages, newest first.
+	ListSms(f SmsFilter) (SmsPage, error)
+	CreateSmsAndReserveCredit(userId uint, serviceId uint, sms *Sms, cost uint) error
+	CreateSmsAndEnqueue(userId uint, serviceId uint, sms *Sms, cost uint, topic string, key string, payload func(sms *Sms) ([]byte, error)) error
+	DispatchOutbox(limit int, publish func(msg OutboxMessage) error) (int, error)
+	MarkSmsSent(userId uint, serviceId uint, smsId uint, providerName string, providerMsgID int, cost uint) error
+	ReleaseSmsCredit(userId uint, serviceId uint, smsId uint, status SmsStatus) error
+	GetSms(serviceId uint, smsId uint) (Sms, error)
+	ClaimSmsForSending(serviceId uint, smsId uint) (bool, error)
+	RequeueSms(serviceId uint, smsId uint) error
+	FailStuckSending(olderThan time.Time, limit int) (int, error)
+	// MarkSmsUncaptured parks a message the provider accepted but whose
+	// capture failed, so the stuck sweep charges it instead of refunding it.
+	MarkSmsUncaptured(serviceId uint, smsId uint, providerMsgID int) error
+	// CaptureUncaptured charges up to limit uncaptured messages their
+	// reserved cost and returns how many it settled.
+	CaptureUncaptured(limit int) (int, error)
+	UpdateServiceAlerts(userId uint, serviceId uint, threshold uint64, email string, smsReceptor string, webhookUrl string) error
+	ClaimLowBalanceAlert(serviceId uint) (Service, bool, error)
+	UpdateServiceLimits(userId uint, serviceId uint, requestsPerMinute uint, dailyQuota uint64, monthlyQuota uint64) error
+	ListPrices() ([]Price, error)
+	UpsertPrice(p *Price) error
+	DeletePrice(priceId uint) error
+	GetUserService(userId uint, serviceId uint) (Service, error)
+	GetBlacklisted(serviceId uint, receptors []string) ([]string, error)
+	ListRateLimits() ([]ProviderRateLimit, error)
+	UpsertRateLimit(l *ProviderRateLimit) error
+	DeleteRateLimit(limitId uint) error
+	// IncrCounter adds delta to a shared quota counter and returns its new
+	// value; the ttl only applies when the counter starts over.
+	IncrCounter(name string, delta int64, ttl time.Duration) (int64, error)
+	GetCounter(name string) (int64, error)
+	DeleteExpiredCounters() (int, error)
+	// RewrapSmsContent moves up to limit messages not yet under the current
+	// content key onto it, encrypting plaintext rows, and returns how many it
+	// changed. Call it until it returns 0.
+	RewrapSmsContent(limit int) (int, error)
+	UpdateServiceRetention(userId uint, serviceId uint, days uint, action RetentionAction) error
+	ListRetentionServices() ([]Service, error)
+	// PurgeSms archives and then deletes or anonymizes up to limit settled
+	// messages of a service created before the cutoff; archive is given the
+	// rows with their content decrypted. Nothing is purged if archive fails.
+	// A zero Count means nothing was left to purge, or that another replica
+	// purged the batch first.
+	PurgeSms(serviceId uint, before time.Time, action RetentionAction, limit int, archive func(rows []Sms) (string, error)) (PurgeRecord, error)
+	ListPurgeRecords(serviceId uint, limit int) ([]PurgeRecord, error)
+	StreamSms(serviceId uint, from time.Time, to time.Time, batch int, fn func(rows []Sms) error) error
+	CreateExportJob(j *ExportJob) error
+	GetExportJob(userId uint, serviceId uint, exportId uint) (ExportJob, error)
+	// ClaimExportJob moves the oldest pending export to running, or takes over
+	// a running one whose heartbeat is older than staleBefore; false means none
+	// was waiting.
+	ClaimExportJob(staleBefore time.Time) (ExportJob, bool, error)
+	HeartbeatExportJob(exportId uint) error
+	FinishExportJob(exportId uint, file string, rows int64, runErr error) error
+	ExpireExportJobs(before time.Time, limit int) ([]ExportJob, error)
+	RefreshRollups(window time.Duration, maxHours int) (int, error)
+	RollupRefreshedAt() (*time.Time, error)
+	ReportSms(q ReportQuery) ([]ReportRow, error)
 }
 
+var (
+	ErrInsufficientCredits = errors.New("insufficient credits or service not found")
+	ErrSmsNotQueued        = errors.New("sms record not found or already settled")
+	ErrServiceNotFound     = errors.New("service not found")
+	ErrPriceNotFound       = errors.New("price not found")
+)
+
+// unsettledStatuses are the states in which a message still holds a credit reservation.
+var unsettledStatuses = []SmsStatus{SmsStatusQueued, SmsStatusSending, SmsStatusUncaptured}
+
+// releasableStatuses are the unsettled states whose reservation may be
+// refunded; an uncaptured message was delivered and must be charged.
+var releasableStatuses = []SmsStatus{SmsStatusQueued, SmsStatusSending}
+
 type DataBaseWrapper struct {
 	DBConn *gorm.DB
+	// Sealer encrypts Sms.Content; nil stores new content in plaintext.
+	Sealer *envelope.Sealer
 }
 
 func (d *DataBaseWrapper) DB() *gorm.DB { return d.DBConn }
 
-func Init(dsn string) (DataBaseInterface, error) {
+func (d *DataBaseWrapper) WithContext(ctx context.Context) DataBaseInterface {
+	return &DataBaseWrapper{DBConn: d.DBConn.WithContext(ctx), Sealer: d.Sealer}
+}
+
+func (d *DataBaseWrapper) Ping(ctx context.Context) error {
+	sqlDB, err := d.DBConn.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+func (d *DataBaseWrapper) Close() error {
+	sqlDB, err := d.DBConn.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// Open connects to dsn with driver, or the driver DetectDriver picks when it
+// is empty. It does not look at the schema.
+func Open(driver string, dsn string) (*gorm.DB, error) {
 	if dsn == "" {
 		return nil, errors.New("db: empty DSN")
 	}
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	dialect, err := dialector(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := gorm.Open(dialect, &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
@@ -48,11 +157,30 @@ func Init(dsn string) (DataBaseInterface, error) {
 	if err := sqlDB.Ping(); err != nil {
 		return nil, err
 	}
+	if err := db.Use(newTracingPlugin()); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
 
-	if err := db.AutoMigrate(&User{}, &Service{}, &Sms{}); err != nil {
+// Init opens the database and refuses to use it unless every migration of
+// this build is applied; the schema is changed only by cmd/migrate.
+func Init(driver string, dsn string, sealer *envelope.Sealer) (DataBaseInterface, error) {
+	db, err := Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	runner, err := migrations.New(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := runner.Check(context.Background()); err != nil {
+		if sqlDB, dbErr := db.DB(); dbErr == nil {
+			sqlDB.Close()
+		}
 		return nil, err
 	}
-	return &DataBaseWrapper{DBConn: db}, nil
+	return &DataBaseWrapper{DBConn: db, Sealer: sealer}, nil
 }
 
 func (d *DataBaseWrapper) GetUserServices(userID uint) ([]Service, error) {
@@ -61,6 +189,15 @@ func (d *DataBaseWrapper) GetUserServices(userID uint) ([]Service, error) {
 	return svcs, err
 }
 
+func (d *DataBaseWrapper) GetUserService(userId uint, serviceId uint) (Service, error) {
+	var svc Service
+	err := d.DBConn.Where("id = ? AND user_id = ?", serviceId, userId).First(&svc).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return svc, ErrServiceNotFound
+	}
+	return svc, err
+}
+
 func (d *DataBaseWrapper) CreateUserService(userID uint, serviceType ServiceType, intialCredit int) error {
 	s := &Service{
 		UserID:  userID,
@@ -93,6 +230,11 @@ func (d *DataBaseWrapper) UpdateServiceCredit(userId uint, serviceId uint, credi
 }
 
 func (d *DataBaseWrapper) CreateSmsRecord(s *Sms) error {
+	plaintext, err := d.sealSms(s)
+	if err != nil {
+		return err
+	}
+	defer d.restoreContent(s, plaintext)
 	return d.DBConn.Create(s).Error
 }
 
@@ -110,52 +252,469 @@ func (d *DataBaseWrapper) SpendServiceCredit(userId uint, serviceId uint, cost i
 	return nil
 }
 
-func (d *DataBaseWrapper) CreateSmsAndSpendCredit(userId uint, serviceId uint, sms *Sms, cost uint) error {
+func (d *DataBaseWrapper) reserveAndCreateSms(tx *gorm.DB, userId uint, serviceId uint, sms *Sms, cost uint) error {
+	result := tx.Model(&Service{}).
+		Where("id = ? AND user_id = ? AND credits >= ?", serviceId, userId, cost).
+		Updates(map[string]interface{}{
+			"credits":  gorm.Expr("credits - ?", cost),
+			"reserved": gorm.Expr("reserved + ?", cost),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInsufficientCredits
+	}
+	sms.ServiceId = serviceId
+	sms.ReservedCost = cost
+	plaintext, err := d.sealSms(sms)
+	if err != nil {
+		return err
+	}
+	defer d.restoreContent(sms, plaintext)
+	return tx.Create(sms).Error
+}
+
+// CreateSmsAndReserveCredit stores sms and moves cost from the service's
+// available credits into its reserved balance until the send is settled.
+func (d *DataBaseWrapper) CreateSmsAndReserveCredit(userId uint, serviceId uint, sms *Sms, cost uint) error {
+	return d.DBConn.Transaction(func(tx *gorm.DB) error {
+		return d.reserveAndCreateSms(tx, userId, serviceId, sms, cost)
+	})
+}
+
+// CreateSmsAndEnqueue is CreateSmsAndReserveCredit plus an outbox row built
+// from the stored sms, all in one transaction, so a message is never charged
+// without also being queued for the relay.
+func (d *DataBaseWrapper) CreateSmsAndEnqueue(userId uint, serviceId uint, sms *Sms, cost uint, topic string, key string, payload func(sms *Sms) ([]byte, error)) error {
 	return d.DBConn.Transaction(func(tx *gorm.DB) error {
-		result := tx.Model(&Service{}).
-			Where("id = ? AND user_id = ? AND credits >= ?", serviceId, userId, cost).
-			Update("credits", gorm.Expr("credits - ?", cost))
-		if result.Error != nil {
-			return result.Error
+		if err := d.reserveAndCreateSms(tx, userId, serviceId, sms, cost); err != nil {
+			return err
 		}
-		if result.RowsAffected == 0 {
-			return errors.New("insufficient credits or service not found")
+		value, err := payload(sms)
+		if err != nil {
+			return err
 		}
-		sms.ServiceId = serviceId
-		if err := tx.Create(sms).Error; err != nil {
+		return tx.Create(&OutboxMessage{
+			Topic:   topic,
+			Key:     key,
+			Payload: value,
+			Headers: kafka.InjectHeaders(tx.Statement.Context),
+			Status:  OutboxStatusPending,
+		}).Error
+	})
+}
+
+// outboxLease is how long a relay owns the rows it claimed. Rows of a relay
+// that died mid-batch are claimed again once it runs out.
+const outboxLease = 2 * time.Minute
+
+// DispatchOutbox claims up to limit pending outbox rows, hands them to publish
+// in insertion order and marks each published row dispatched. Rows claimed by
+// another relay are skipped. The claim is a short transaction of its own, so
+// no row lock or connection is held while the broker is slow. It stops at the
+// first publish error, records the attempt on that row, gives the rest of the
+// batch back and returns the error.
+func (d *DataBaseWrapper) DispatchOutbox(limit int, publish func(msg OutboxMessage) error) (int, error) {
+	var pending []OutboxMessage
+	err := d.DBConn.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND (claimed_until IS NULL OR claimed_until < ?)", OutboxStatusPending, now).
+			Order("id").
+			Limit(limit).
+			Find(&pending).Error
+		if err != nil || len(pending) == 0 {
 			return err
 		}
+		ids := make([]uint, len(pending))
+		for i, msg := range pending {
+			ids[i] = msg.ID
+		}
+		return tx.Model(&OutboxMessage{}).Where("id IN ?", ids).
+			Update("claimed_until", now.Add(outboxLease)).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, msg := range pending {
+		if pubErr := publish(msg); pubErr != nil {
+			lastErr := pubErr.Error()
+			if len(lastErr) > 512 {
+				lastErr = lastErr[:512]
+			}
+			err := d.DBConn.Model(&OutboxMessage{}).Where("id = ?", msg.ID).
+				Updates(map[string]interface{}{
+					"attempts":      gorm.Expr("attempts + 1"),
+					"last_error":    lastErr,
+					"claimed_until": nil,
+				}).Error
+			if err == nil {
+				err = d.unclaimOutbox(pending[i+1:])
+			}
+			if err != nil {
+				return i, err
+			}
+			// the failed attempt is recorded; report it so the caller backs off
+			return i, fmt.Errorf("publish outbox message: %w", pubErr)
+		}
+		now := time.Now()
+		err := d.DBConn.Model(&OutboxMessage{}).Where("id = ?", msg.ID).
+			Updates(map[string]interface{}{
+				"status":        OutboxStatusDispatched,
+				"attempts":      gorm.Expr("attempts + 1"),
+				"dispatched_at": &now,
+				"claimed_until": nil,
+			}).Error
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(pending), nil
+}
+
+// unclaimOutbox gives rows back to the relays, so the next pass publishes them
+// in order after the row that failed.
+func (d *DataBaseWrapper) unclaimOutbox(rows []OutboxMessage) error {
+	if len(rows) == 0 {
 		return nil
+	}
+	ids := make([]uint, len(rows))
+	for i, msg := range rows {
+		ids[i] = msg.ID
+	}
+	return d.DBConn.Model(&OutboxMessage{}).Where("id IN ?", ids).
+		Update("claimed_until", nil).Error
+}
+
+// MarkSmsSent captures the reservation of an unsettled message. Only up to the
+// reserved amount is charged; any remainder goes back to available credits.
+func (d *DataBaseWrapper) MarkSmsSent(userId uint, serviceId uint, smsId uint, providerName string, providerMsgID int, cost uint) error {
+	return d.DBConn.Transaction(func(tx *gorm.DB) error {
+		var record Sms
+		if err := tx.Where("id = ? AND service_id = ? AND status IN ?", smsId, serviceId, unsettledStatuses).
+			First(&record).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrSmsNotQueued
+			}
+			return err
+		}
+		reserved := record.ReservedCost
+		if cost > reserved {
+			cost = reserved
+		}
+
+		smsResult := tx.Model(&Sms{}).
+			Where("id = ? AND status IN ?", smsId, unsettledStatuses).
+			Updates(map[string]interface{}{
+				"status":                      SmsStatusSent,
+				"service_provider_name":       providerName,
+				"service_provider_message_id": providerMsgID,
+				"sent_time":                   time.Now().Unix(),
+				"cost":                        cost,
+				"reserved_cost":               0,
+			})
+		if smsResult.Error != nil {
+			return smsResult.Error
+		}
+		if smsResult.RowsAffected == 0 {
+			return ErrSmsNotQueued
+		}
+
+		return tx.Model(&Service{}).
+			Where("id = ? AND user_id = ?", serviceId, userId).
+			Updates(map[string]interface{}{
+				"reserved": gorm.Expr("reserved - ?", reserved),
+				"credits":  gorm.Expr("credits + ?", reserved-cost),
+			}).Error
 	})
 }
 
-func (d *DataBaseWrapper) MarkSmsSent(userId uint, serviceId uint, smsId uint, providerName string, providerMsgID int) error {
-	now := time.Now().Unix()
-	update := map[string]interface{}{
-		"status":                      "sent",
-		"service_provider_message_id": providerMsgID,
-		"sent_time":                   now,
+// ReleaseSmsCredit returns the reservation of an unsettled message to the
+// service's available credits and moves the message to status. Only queued
+// messages can be cancelled; one already handed to a worker cannot. An
+// uncaptured message is never released.
+func (d *DataBaseWrapper) ReleaseSmsCredit(userId uint, serviceId uint, smsId uint, status SmsStatus) error {
+	from := releasableStatuses
+	if status == SmsStatusCancelled {
+		from = []SmsStatus{SmsStatusQueued}
 	}
-	smsResult := d.DBConn.Model(&Sms{}).
-		Where("id = ? AND service_id = ?", smsId, serviceId).
-		Updates(update)
+	return d.DBConn.Transaction(func(tx *gorm.DB) error {
+		return releaseSms(tx, userId, serviceId, smsId, from, status)
+	})
+}
+
+func releaseSms(tx *gorm.DB, userId uint, serviceId uint, smsId uint, from []SmsStatus, to SmsStatus) error {
+	var record Sms
+	if err := tx.Where("id = ? AND service_id = ? AND status IN ?", smsId, serviceId, from).
+		First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSmsNotQueued
+		}
+		return err
+	}
+
+	smsResult := tx.Model(&Sms{}).
+		Where("id = ? AND status IN ?", smsId, from).
+		Updates(map[string]interface{}{
+			"status":        to,
+			"reserved_cost": 0,
+		})
 	if smsResult.Error != nil {
 		return smsResult.Error
 	}
 	if smsResult.RowsAffected == 0 {
-		return errors.New("sms record not found for update")
+		return ErrSmsNotQueued
 	}
-	return nil
 
+	return tx.Model(&Service{}).
+		Where("id = ? AND user_id = ?", serviceId, userId).
+		Updates(map[string]interface{}{
+			"reserved": gorm.Expr("reserved - ?", record.ReservedCost),
+			"credits":  gorm.Expr("credits + ?", record.ReservedCost),
+		}).Error
+}
+
+// ClaimSmsForSending atomically moves a queued message to sending. Only one
+// worker can win the claim, so a redelivered Kafka message is never sent twice.
+func (d *DataBaseWrapper) ClaimSmsForSending(serviceId uint, smsId uint) (bool, error) {
+	result := d.DBConn.Model(&Sms{}).
+		Where("id = ? AND service_id = ? AND status = ?", smsId, serviceId, SmsStatusQueued).
+		Update("status", SmsStatusSending)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// RequeueSms hands a claimed message back to the queue after a failed attempt.
+func (d *DataBaseWrapper) RequeueSms(serviceId uint, smsId uint) error {
+	return d.DBConn.Model(&Sms{}).
+		Where("id = ? AND service_id = ? AND status = ?", smsId, serviceId, SmsStatusSending).
+		Update("status", SmsStatusQueued).Error
 }
 
-func (d *DataBaseWrapper) GetServiceSms(serviceId uint, offset int, limit int) ([]Sms, error) {
-	var messages []Sms
-	result := d.DBConn.
-		Where("service_id = ?", serviceId).
-		Order("created_at DESC").
-		Offset(offset).
+// FailStuckSending fails messages left in sending since before olderThan,
+// typically by a worker that died mid-send, and releases their credit. The
+// provider may or may not have delivered them, so they are not retried.
+func (d *DataBaseWrapper) FailStuckSending(olderThan time.Time, limit int) (int, error) {
+	var stuck []Sms
+	err := d.DBConn.Preload("Service").
+		Where("status = ? AND updated_at < ?", SmsStatusSending, olderThan).
+		Order("id").
 		Limit(limit).
-		Find(&messages)
-	return messages, result.Error
+		Find(&stuck).Error
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for _, record := range stuck {
+		err := d.DBConn.Transaction(func(tx *gorm.DB) error {
+			return releaseSms(tx, record.Service.UserID, record.ServiceId, record.ID,
+				[]SmsStatus{SmsStatusSending}, SmsStatusFailed)
+		})
+		if errors.Is(err, ErrSmsNotQueued) {
+			continue
+		}
+		if err != nil {
+			return failed, err
+		}
+		failed++
+	}
+	return failed, nil
+}
+
+func (d *DataBaseWrapper) MarkSmsUncaptured(serviceId uint, smsId uint, providerMsgID int) error {
+	result := d.DBConn.Model(&Sms{}).
+		Where("id = ? AND service_id = ? AND status = ?", smsId, serviceId, SmsStatusSending).
+		Updates(map[string]interface{}{
+			"status":                      SmsStatusUncaptured,
+			"service_provider_message_id": providerMsgID,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSmsNotQueued
+	}
+	return nil
+}
+
+func (d *DataBaseWrapper) CaptureUncaptured(limit int) (int, error) {
+	var uncaptured []Sms
+	err := d.DBConn.Preload("Service").
+		Where("status = ?", SmsStatusUncaptured).
+		Order("id").
+		Limit(limit).
+		Find(&uncaptured).Error
+	if err != nil {
+		return 0, err
+	}
+
+	captured := 0
+	for _, record := range uncaptured {
+		err := d.MarkSmsSent(record.Service.UserID, record.ServiceId, record.ID,
+			record.ServiceProviderName, record.ServiceProviderMessageId, record.ReservedCost)
+		if errors.Is(err, ErrSmsNotQueued) {
+			continue
+		}
+		if err != nil {
+			return captured, err
+		}
+		captured++
+	}
+	return captured, nil
+}
+
+func (d *DataBaseWrapper) GetSms(serviceId uint, smsId uint) (Sms, error) {
+	var record Sms
+	if err := d.DBConn.Where("id = ? AND service_id = ?", smsId, serviceId).First(&record).Error; err != nil {
+		return record, err
+	}
+	return record, d.openSms(&record)
+}
+
+func (d *DataBaseWrapper) ListPrices() ([]Price, error) {
+	var prices []Price
+	err := d.DBConn.Order("service_type, provider, prefix").Find(&prices).Error
+	return prices, err
+}
+
+func (d *DataBaseWrapper) UpsertPrice(p *Price) error {
+	var existing Price
+	err := d.DBConn.
+		Where("prefix = ? AND service_type = ? AND provider = ?", p.Prefix, p.ServiceType, p.Provider).
+		First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return d.DBConn.Create(p).Error
+	}
+	if err != nil {
+		return err
+	}
+	p.ID = existing.ID
+	return d.DBConn.Model(&existing).Updates(map[string]interface{}{
+		"operator":         p.Operator,
+		"cost_per_segment": p.CostPerSegment,
+	}).Error
+}
+
+func (d *DataBaseWrapper) DeletePrice(priceId uint) error {
+	result := d.DBConn.Unscoped().Delete(&Price{}, priceId)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPriceNotFound
+	}
+	return nil
+}
+
+func (d *DataBaseWrapper) GetBlacklisted(serviceId uint, receptors []string) ([]string, error) {
+	var blocked []string
+	if len(receptors) == 0 {
+		return blocked, nil
+	}
+	err := d.DBConn.Model(&BlacklistedNumber{}).
+		Where("receptor IN ? AND service_id IN ?", receptors, []uint{0, serviceId}).
+		Distinct().
+		Pluck("receptor", &blocked).Error
+	return blocked, err
+}
+
+func (d *DataBaseWrapper) UpdateServiceAlerts(userId uint, serviceId uint, threshold uint64, email string, smsReceptor string, webhookUrl string) error {
+	result := d.DBConn.Model(&Service{}).
+		Where("id = ? AND user_id = ?", serviceId, userId).
+		Updates(map[string]interface{}{
+			"low_balance_threshold": threshold,
+			"low_balance_alerted":   false,
+			"alert_email":           email,
+			"alert_sms_receptor":    smsReceptor,
+			"alert_webhook_url":     webhookUrl,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("service not found")
+	}
+	return nil
+}
+
+func (d *DataBaseWrapper) UpdateServiceLimits(userId uint, serviceId uint, requestsPerMinute uint, dailyQuota uint64, monthlyQuota uint64) error {
+	result := d.DBConn.Model(&Service{}).
+		Where("id = ? AND user_id = ?", serviceId, userId).
+		Updates(map[string]interface{}{
+			"requests_per_minute": requestsPerMinute,
+			"daily_quota":         dailyQuota,
+			"monthly_quota":       monthlyQuota,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("service not found")
+	}
+	return nil
+}
+
+// ClaimLowBalanceAlert re-arms the alert of a service whose credits are back
+// above its threshold, then atomically claims the alert if credits are below
+// it. The returned bool is true for exactly one caller per crossing.
+func (d *DataBaseWrapper) ClaimLowBalanceAlert(serviceId uint) (Service, bool, error) {
+	var svc Service
+	err := d.DBConn.Model(&Service{}).
+		Where("id = ? AND low_balance_alerted = ? AND credits >= low_balance_threshold", serviceId, true).
+		Update("low_balance_alerted", false).Error
+	if err != nil {
+		return svc, false, err
+	}
+
+	result := d.DBConn.Model(&Service{}).
+		Where("id = ? AND low_balance_threshold > 0 AND credits < low_balance_threshold AND low_balance_alerted = ?", serviceId, false).
+		Update("low_balance_alerted", true)
+	if result.Error != nil {
+		return svc, false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return svc, false, nil
+	}
+	if err := d.DBConn.First(&svc, serviceId).Error; err != nil {
+		return svc, false, err
+	}
+	return svc, true, nil
+}
+
+func (d *DataBaseWrapper) ListRateLimits() ([]ProviderRateLimit, error) {
+	var limits []ProviderRateLimit
+	err := d.DBConn.Order("provider, sender").Find(&limits).Error
+	return limits, err
+}
+
+func (d *DataBaseWrapper) UpsertRateLimit(l *ProviderRateLimit) error {
+	var existing ProviderRateLimit
+	err := d.DBConn.Where("provider = ? AND sender = ?", l.Provider, l.Sender).First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return d.DBConn.Create(l).Error
+	}
+	if err != nil {
+		return err
+	}
+	l.ID = existing.ID
+	return d.DBConn.Model(&existing).Updates(map[string]interface{}{
+		"rate_per_second": l.RatePerSecond,
+		"burst":           l.Burst,
+	}).Error
+}
+
+func (d *DataBaseWrapper) DeleteRateLimit(limitId uint) error {
+	result := d.DBConn.Unscoped().Delete(&ProviderRateLimit{}, limitId)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("rate limit not found")
+	}
+	return nil
 }
@@ -0,0 +1,534 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"postchi/pkg/db/migrations"
+
+	"gorm.io/gorm"
+)
+
+// These tests need a real database and are skipped unless TEST_DB_DSN is set;
+// DB_DRIVER picks the engine as it does for the service. The schema is
+// migrated down and up again first, so point TEST_DB_DSN at a throwaway
+// database. See "database tests" in the README.
+
+var (
+	testOnce sync.Once
+	testConn *gorm.DB
+	testErr  error
+)
+
+func newTestDB(t *testing.T) *DataBaseWrapper {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN not set")
+	}
+	testOnce.Do(func() {
+		testConn, testErr = Open(os.Getenv("DB_DRIVER"), dsn)
+		if testErr != nil {
+			return
+		}
+		runner, err := migrations.New(testConn)
+		if err != nil {
+			testErr = err
+			return
+		}
+		ctx := context.Background()
+		if _, err := runner.Down(ctx, int(runner.Latest())); err != nil {
+			testErr = err
+			return
+		}
+		_, testErr = runner.Up(ctx, 0)
+	})
+	if testErr != nil {
+		t.Fatalf("test database: %v", testErr)
+	}
+	return &DataBaseWrapper{DBConn: testConn}
+}
+
+// newTestService creates a user owning one async service with credits.
+func newTestService(t *testing.T, d *DataBaseWrapper, credits uint64) Service {
+	t.Helper()
+	user := User{Name: t.Name(), Password: fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())}
+	if err := d.DBConn.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	svc := Service{UserID: user.ID, Type: ServiceTypeAsync, Status: "active", Credits: credits}
+	if err := d.DBConn.Create(&svc).Error; err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
+
+func newTestSms(receptor string) *Sms {
+	return &Sms{
+		Content:             "hello " + receptor,
+		Receptor:            receptor,
+		Status:              string(SmsStatusQueued),
+		SentTime:            time.Now().Unix(),
+		ServiceProviderName: "kavenegar",
+	}
+}
+
+func mustBalance(t *testing.T, d *DataBaseWrapper, svc Service, credits uint64, reserved uint64) {
+	t.Helper()
+	got, err := d.GetUserService(svc.UserID, svc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Credits != credits || got.Reserved != reserved {
+		t.Fatalf("got credits %d reserved %d, want %d and %d", got.Credits, got.Reserved, credits, reserved)
+	}
+}
+
+func TestReserveCaptureRelease(t *testing.T) {
+	d := newTestDB(t)
+
+	tests := []struct {
+		name string
+		// settle moves the reserved message on; nil leaves it reserved
+		settle       func(svc Service, sms *Sms) error
+		wantErr      error
+		wantCredits  uint64
+		wantReserved uint64
+		wantStatus   SmsStatus
+		wantCost     uint
+	}{
+		{
+			name:         "reserve holds the cost",
+			wantCredits:  70,
+			wantReserved: 30,
+			wantStatus:   SmsStatusQueued,
+		},
+		{
+			name: "capture charges the actual cost and returns the rest",
+			settle: func(svc Service, sms *Sms) error {
+				return d.MarkSmsSent(svc.UserID, svc.ID, sms.ID, "kavenegar", 42, 20)
+			},
+			wantCredits: 80,
+			wantStatus:  SmsStatusSent,
+			wantCost:    20,
+		},
+		{
+			name: "capture never charges more than reserved",
+			settle: func(svc Service, sms *Sms) error {
+				return d.MarkSmsSent(svc.UserID, svc.ID, sms.ID, "kavenegar", 42, 50)
+			},
+			wantCredits: 70,
+			wantStatus:  SmsStatusSent,
+			wantCost:    30,
+		},
+		{
+			name: "capture of a claimed message",
+			settle: func(svc Service, sms *Sms) error {
+				if _, err := d.ClaimSmsForSending(svc.ID, sms.ID); err != nil {
+					return err
+				}
+				return d.MarkSmsSent(svc.UserID, svc.ID, sms.ID, "kavenegar", 42, 30)
+			},
+			wantCredits: 70,
+			wantStatus:  SmsStatusSent,
+			wantCost:    30,
+		},
+		{
+			name: "release returns the reservation",
+			settle: func(svc Service, sms *Sms) error {
+				return d.ReleaseSmsCredit(svc.UserID, svc.ID, sms.ID, SmsStatusFailed)
+			},
+			wantCredits: 100,
+			wantStatus:  SmsStatusFailed,
+		},
+		{
+			name: "cancel releases a queued message",
+			settle: func(svc Service, sms *Sms) error {
+				return d.ReleaseSmsCredit(svc.UserID, svc.ID, sms.ID, SmsStatusCancelled)
+			},
+			wantCredits: 100,
+			wantStatus:  SmsStatusCancelled,
+		},
+		{
+			name: "cancel refuses a message being sent",
+			settle: func(svc Service, sms *Sms) error {
+				if _, err := d.ClaimSmsForSending(svc.ID, sms.ID); err != nil {
+					return err
+				}
+				return d.ReleaseSmsCredit(svc.UserID, svc.ID, sms.ID, SmsStatusCancelled)
+			},
+			wantErr:      ErrSmsNotQueued,
+			wantCredits:  70,
+			wantReserved: 30,
+			wantStatus:   SmsStatusSending,
+		},
+		{
+			name: "a settled message cannot be settled again",
+			settle: func(svc Service, sms *Sms) error {
+				if err := d.MarkSmsSent(svc.UserID, svc.ID, sms.ID, "kavenegar", 42, 30); err != nil {
+					return err
+				}
+				return d.ReleaseSmsCredit(svc.UserID, svc.ID, sms.ID, SmsStatusFailed)
+			},
+			wantErr:     ErrSmsNotQueued,
+			wantCredits: 70,
+			wantStatus:  SmsStatusSent,
+			wantCost:    30,
+		},
+		{
+			name: "an uncaptured message is never released",
+			settle: func(svc Service, sms *Sms) error {
+				if _, err := d.ClaimSmsForSending(svc.ID, sms.ID); err != nil {
+					return err
+				}
+				if err := d.MarkSmsUncaptured(svc.ID, sms.ID, 42); err != nil {
+					return err
+				}
+				return d.ReleaseSmsCredit(svc.UserID, svc.ID, sms.ID, SmsStatusFailed)
+			},
+			wantErr:      ErrSmsNotQueued,
+			wantCredits:  70,
+			wantReserved: 30,
+			wantStatus:   SmsStatusUncaptured,
+		},
+		{
+			name: "the sweep charges an uncaptured message",
+			settle: func(svc Service, sms *Sms) error {
+				if _, err := d.ClaimSmsForSending(svc.ID, sms.ID); err != nil {
+					return err
+				}
+				if err := d.MarkSmsUncaptured(svc.ID, sms.ID, 42); err != nil {
+					return err
+				}
+				if _, err := d.FailStuckSending(time.Now().Add(time.Minute), 100); err != nil {
+					return err
+				}
+				_, err := d.CaptureUncaptured(100)
+				return err
+			},
+			wantCredits: 70,
+			wantStatus:  SmsStatusSent,
+			wantCost:    30,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newTestService(t, d, 100)
+			sms := newTestSms("09120000001")
+			if err := d.CreateSmsAndReserveCredit(svc.UserID, svc.ID, sms, 30); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if tt.settle != nil {
+				err = tt.settle(svc, sms)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			mustBalance(t, d, svc, tt.wantCredits, tt.wantReserved)
+			got, err := d.GetSms(svc.ID, sms.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if SmsStatus(got.Status) != tt.wantStatus || got.Cost != tt.wantCost || got.ReservedCost != uint(tt.wantReserved) {
+				t.Fatalf("got status %s cost %d reserved %d, want %s, %d and %d",
+					got.Status, got.Cost, got.ReservedCost, tt.wantStatus, tt.wantCost, tt.wantReserved)
+			}
+		})
+	}
+}
+
+func TestReserveInsufficientCredits(t *testing.T) {
+	d := newTestDB(t)
+	svc := newTestService(t, d, 10)
+
+	sms := newTestSms("09120000002")
+	err := d.CreateSmsAndReserveCredit(svc.UserID, svc.ID, sms, 30)
+	if !errors.Is(err, ErrInsufficientCredits) {
+		t.Fatalf("got error %v, want ErrInsufficientCredits", err)
+	}
+	mustBalance(t, d, svc, 10, 0)
+
+	var count int64
+	if err := d.DBConn.Model(&Sms{}).Where("service_id = ?", svc.ID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("got %d messages, want none", count)
+	}
+}
+
+func TestClaimSmsForSending(t *testing.T) {
+	d := newTestDB(t)
+	svc := newTestService(t, d, 100)
+	sms := newTestSms("09120000003")
+	if err := d.CreateSmsAndReserveCredit(svc.UserID, svc.ID, sms, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		run  func() (bool, error)
+		want bool
+	}{
+		{"first claim wins", func() (bool, error) { return d.ClaimSmsForSending(svc.ID, sms.ID) }, true},
+		{"second claim loses", func() (bool, error) { return d.ClaimSmsForSending(svc.ID, sms.ID) }, false},
+		{"other service cannot claim", func() (bool, error) { return d.ClaimSmsForSending(svc.ID+1000, sms.ID) }, false},
+		{"requeued message can be claimed again", func() (bool, error) {
+			if err := d.RequeueSms(svc.ID, sms.ID); err != nil {
+				return false, err
+			}
+			return d.ClaimSmsForSending(svc.ID, sms.ID)
+		}, true},
+	}
+	for _, s := range steps {
+		got, err := s.run()
+		if err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if got != s.want {
+			t.Fatalf("%s: got %v, want %v", s.name, got, s.want)
+		}
+	}
+
+	// a claimed message left behind is failed and refunded by the sweep
+	n, err := d.FailStuckSending(time.Now().Add(time.Minute), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 1 {
+		t.Fatalf("sweep failed %d messages, want at least 1", n)
+	}
+	mustBalance(t, d, svc, 100, 0)
+	got, err := d.GetSms(svc.ID, sms.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SmsStatus(got.Status) != SmsStatusFailed {
+		t.Fatalf("got status %s, want failed", got.Status)
+	}
+}
+
+func TestDispatchOutbox(t *testing.T) {
+	d := newTestDB(t)
+	if err := d.DBConn.Where("1 = 1").Delete(&OutboxMessage{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	svc := newTestService(t, d, 100)
+	for _, to := range []string{"09120000011", "09120000012", "09120000013"} {
+		err := d.CreateSmsAndEnqueue(svc.UserID, svc.ID, newTestSms(to), 10, "sms", to, func(s *Sms) ([]byte, error) {
+			return []byte(fmt.Sprintf(`{"sms_id":%d}`, s.ID)), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustBalance(t, d, svc, 70, 30)
+
+	// the broker rejects the second message
+	var published []string
+	failKey := "09120000012"
+	publishErr := errors.New("broker down")
+	n, err := d.DispatchOutbox(10, func(msg OutboxMessage) error {
+		if msg.Key == failKey {
+			return publishErr
+		}
+		published = append(published, msg.Key)
+		return nil
+	})
+	if !errors.Is(err, publishErr) {
+		t.Fatalf("got error %v, want the publish error", err)
+	}
+	if n != 1 || len(published) != 1 || published[0] != "09120000011" {
+		t.Fatalf("dispatched %d (%v), want only the first message", n, published)
+	}
+
+	var failed OutboxMessage
+	if err := d.DBConn.Where(&OutboxMessage{Key: failKey}).First(&failed).Error; err != nil {
+		t.Fatal(err)
+	}
+	if failed.Status != OutboxStatusPending || failed.Attempts != 1 || failed.LastError != publishErr.Error() || failed.ClaimedUntil != nil {
+		t.Fatalf("got status %s attempts %d error %q claimed %v, want the attempt recorded and the row released",
+			failed.Status, failed.Attempts, failed.LastError, failed.ClaimedUntil)
+	}
+
+	// a row another relay is publishing is skipped until its lease runs out
+	lease := time.Now().Add(time.Minute)
+	if err := d.DBConn.Model(&OutboxMessage{}).Where("id = ?", failed.ID).Update("claimed_until", &lease).Error; err != nil {
+		t.Fatal(err)
+	}
+	published = nil
+	n, err = d.DispatchOutbox(10, func(msg OutboxMessage) error {
+		published = append(published, msg.Key)
+		return nil
+	})
+	if err != nil || n != 1 || published[0] != "09120000013" {
+		t.Fatalf("dispatched %d (%v), %v; want only the unclaimed message", n, published, err)
+	}
+	if err := d.DBConn.Model(&OutboxMessage{}).Where("id = ?", failed.ID).Update("claimed_until", nil).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// the next pass picks up the released row
+	published = nil
+	n, err = d.DispatchOutbox(10, func(msg OutboxMessage) error {
+		published = append(published, msg.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(published) != 1 || published[0] != failKey {
+		t.Fatalf("dispatched %d (%v), want the failed message", n, published)
+	}
+
+	n, err = d.DispatchOutbox(10, func(msg OutboxMessage) error { return nil })
+	if err != nil || n != 0 {
+		t.Fatalf("got %d, %v; want nothing left", n, err)
+	}
+}
+
+func TestListSms(t *testing.T) {
+	d := newTestDB(t)
+	svc := newTestService(t, d, 1000)
+
+	seed := []struct {
+		receptor string
+		status   SmsStatus
+		provider string
+		otp      bool
+		content  string
+	}{
+		{"09120000021", SmsStatusSent, "kavenegar", false, "welcome aboard"},
+		{"09120000022", SmsStatusFailed, "kavenegar", false, "your order shipped"},
+		{"09120000021", SmsStatusSent, "other", true, "code 1234"},
+		{"09120000023", SmsStatusQueued, "kavenegar", false, "order 1234 ready"},
+		{"09120000021", SmsStatusDelivered, "kavenegar", false, "50% off_today"},
+	}
+	ids := make([]uint, len(seed))
+	for i, s := range seed {
+		sms := newTestSms(s.receptor)
+		sms.Status = string(s.status)
+		sms.ServiceProviderName = s.provider
+		sms.Otp = s.otp
+		sms.Content = s.content
+		sms.ServiceId = svc.ID
+		if err := d.CreateSmsRecord(sms); err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = sms.ID
+	}
+	// newest first
+	idsOf := func(idx ...int) []uint {
+		out := make([]uint, len(idx))
+		for i, j := range idx {
+			out[i] = ids[j]
+		}
+		return out
+	}
+
+	tests := []struct {
+		name       string
+		filter     SmsFilter
+		want       []uint
+		wantCursor bool
+		wantTotal  int64
+	}{
+		{name: "first page", filter: SmsFilter{Limit: 2}, want: idsOf(4, 3), wantCursor: true},
+		{name: "next page", filter: SmsFilter{Limit: 2, Cursor: ids[3]}, want: idsOf(2, 1), wantCursor: true},
+		{name: "last page", filter: SmsFilter{Limit: 2, Cursor: ids[1]}, want: idsOf(0)},
+		{name: "status", filter: SmsFilter{Limit: 10, Statuses: []SmsStatus{SmsStatusSent, SmsStatusDelivered}}, want: idsOf(4, 2, 0)},
+		{name: "receptor", filter: SmsFilter{Limit: 10, Receptor: "09120000021"}, want: idsOf(4, 2, 0)},
+		{name: "provider", filter: SmsFilter{Limit: 10, Provider: "other"}, want: idsOf(2)},
+		{name: "search", filter: SmsFilter{Limit: 10, Search: "1234"}, want: idsOf(3, 2)},
+		{name: "search without otp", filter: SmsFilter{Limit: 10, Search: "1234", ExcludeOtp: true}, want: idsOf(3)},
+		{name: "search treats like wildcards literally", filter: SmsFilter{Limit: 10, Search: "50% off_"}, want: idsOf(4)},
+		{name: "total ignores the page", filter: SmsFilter{Limit: 1, Receptor: "09120000021", WithTotal: true}, want: idsOf(4), wantCursor: true, wantTotal: 3},
+		{name: "other user sees nothing", filter: SmsFilter{Limit: 10, UserId: svc.UserID + 1000}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.filter
+			f.ServiceId = svc.ID
+			if f.UserId == 0 {
+				f.UserId = svc.UserID
+			}
+			page, err := d.ListSms(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]uint, 0, len(page.Messages))
+			for _, m := range page.Messages {
+				got = append(got, m.ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(append([]uint{}, tt.want...)) {
+				t.Fatalf("got ids %v, want %v", got, tt.want)
+			}
+			if (page.NextCursor != 0) != tt.wantCursor {
+				t.Fatalf("got next cursor %d, want one: %v", page.NextCursor, tt.wantCursor)
+			}
+			if tt.filter.WithTotal && (page.Total == nil || *page.Total != tt.wantTotal) {
+				t.Fatalf("got total %v, want %d", page.Total, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestIncrCounter(t *testing.T) {
+	d := newTestDB(t)
+	name := fmt.Sprintf("test:%s:%d", t.Name(), time.Now().UnixNano())
+
+	// concurrent increments from several instances must not lose updates
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = d.IncrCounter(name, 1, time.Minute)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := d.GetCounter(name); err != nil || got != workers {
+		t.Fatalf("got %d, %v; want %d", got, err, workers)
+	}
+
+	if got, err := d.IncrCounter(name, -1, time.Hour); err != nil || got != workers-1 {
+		t.Fatalf("refund: got %d, %v; want %d", got, err, workers-1)
+	}
+
+	// an expired counter reads zero and starts over on its next increment
+	past := time.Now().Add(-time.Second)
+	if err := d.DBConn.Model(&QuotaCounter{}).Where("name = ?", name).Update("expires_at", past).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := d.GetCounter(name); err != nil || got != 0 {
+		t.Fatalf("expired: got %d, %v; want 0", got, err)
+	}
+	if got, err := d.IncrCounter(name, 3, time.Minute); err != nil || got != 3 {
+		t.Fatalf("restart: got %d, %v; want 3", got, err)
+	}
+
+	if err := d.DBConn.Model(&QuotaCounter{}).Where("name = ?", name).Update("expires_at", past).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.DeleteExpiredCounters(); err != nil || n < 1 {
+		t.Fatalf("sweep: got %d, %v; want at least 1", n, err)
+	}
+	if got, err := d.IncrCounter(name, 1, time.Minute); err != nil || got != 1 {
+		t.Fatalf("after sweep: got %d, %v; want 1", got, err)
+	}
+}
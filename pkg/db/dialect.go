@@ -0,0 +1,40 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// Supported DB_DRIVER values.
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+)
+
+// DetectDriver picks the driver for dsn when DB_DRIVER is unset: postgres for
+// postgres:// URLs and key=value DSNs, mysql otherwise.
+func DetectDriver(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") ||
+		strings.Contains(dsn, "host=") {
+		return DriverPostgres
+	}
+	return DriverMySQL
+}
+
+func dialector(driver string, dsn string) (gorm.Dialector, error) {
+	if driver == "" {
+		driver = DetectDriver(dsn)
+	}
+	switch driver {
+	case DriverMySQL:
+		return mysql.Open(dsn), nil
+	case DriverPostgres:
+		return postgres.Open(dsn), nil
+	default:
+		return nil, fmt.Errorf("db: unknown driver %q, expected mysql or postgres", driver)
+	}
+}
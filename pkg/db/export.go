@@ -0,0 +1,129 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrExportNotFound = errors.New("export not found")
+
+// StreamSms calls fn with the service's messages created in [from, to), in
+// id order and batch rows at a time, so a whole range never sits in memory.
+// Content is decrypted. It stops at the first error fn returns.
+func (d *DataBaseWrapper) StreamSms(serviceId uint, from time.Time, to time.Time, batch int, fn func(rows []Sms) error) error {
+	var cursor uint
+	for {
+		var rows []Sms
+		err := d.DBConn.
+			Where("service_id = ? AND created_at >= ? AND created_at < ? AND id > ?", serviceId, from, to, cursor).
+			Order("id").
+			Limit(batch).
+			Find(&rows).Error
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		for i := range rows {
+			if err := d.openSms(&rows[i]); err != nil {
+				return err
+			}
+		}
+		if err := fn(rows); err != nil {
+			return err
+		}
+		if len(rows) < batch {
+			return nil
+		}
+		cursor = rows[len(rows)-1].ID
+	}
+}
+
+func (d *DataBaseWrapper) CreateExportJob(j *ExportJob) error {
+	return d.DBConn.Create(j).Error
+}
+
+func (d *DataBaseWrapper) GetExportJob(userId uint, serviceId uint, exportId uint) (ExportJob, error) {
+	var j ExportJob
+	err := d.DBConn.Where("id = ? AND user_id = ? AND service_id = ?", exportId, userId, serviceId).First(&j).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return j, ErrExportNotFound
+	}
+	return j, err
+}
+
+func (d *DataBaseWrapper) ClaimExportJob(staleBefore time.Time) (ExportJob, bool, error) {
+	var j ExportJob
+	claimed := false
+	err := d.DBConn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? OR (status = ? AND (heartbeat_at IS NULL OR heartbeat_at < ?))",
+				ExportPending, ExportRunning, staleBefore).
+			Order("id").
+			Limit(1).
+			Find(&j).Error
+		if err != nil || j.ID == 0 {
+			return err
+		}
+		now := time.Now()
+		j.Status = ExportRunning
+		j.StartedAt = &now
+		j.HeartbeatAt = &now
+		claimed = true
+		return tx.Model(&ExportJob{}).Where("id = ?", j.ID).
+			Updates(map[string]interface{}{"status": ExportRunning, "started_at": now, "heartbeat_at": now}).Error
+	})
+	return j, claimed, err
+}
+
+// HeartbeatExportJob renews the lease of a running export.
+func (d *DataBaseWrapper) HeartbeatExportJob(exportId uint) error {
+	return d.DBConn.Model(&ExportJob{}).Where("id = ? AND status = ?", exportId, ExportRunning).
+		Update("heartbeat_at", time.Now()).Error
+}
+
+// FinishExportJob records the outcome of a running export; a non-nil
+// runErr marks it failed.
+func (d *DataBaseWrapper) FinishExportJob(exportId uint, file string, rows int64, runErr error) error {
+	updates := map[string]interface{}{
+		"status":       ExportDone,
+		"file":         file,
+		"rows":         rows,
+		"completed_at": time.Now(),
+	}
+	if runErr != nil {
+		msg := runErr.Error()
+		if len(msg) > 512 {
+			msg = msg[:512]
+		}
+		updates["status"] = ExportFailed
+		updates["error"] = msg
+	}
+	return d.DBConn.Model(&ExportJob{}).Where("id = ? AND status = ?", exportId, ExportRunning).Updates(updates).Error
+}
+
+// ExpireExportJobs marks finished exports completed before the cutoff as
+// expired and returns them, so their files can be removed.
+func (d *DataBaseWrapper) ExpireExportJobs(before time.Time, limit int) ([]ExportJob, error) {
+	var jobs []ExportJob
+	err := d.DBConn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ? AND completed_at < ?", []ExportStatus{ExportDone, ExportFailed}, before).
+			Order("id").
+			Limit(limit).
+			Find(&jobs).Error
+		if err != nil || len(jobs) == 0 {
+			return err
+		}
+		ids := make([]uint, len(jobs))
+		for i, j := range jobs {
+			ids[i] = j.ID
+		}
+		return tx.Model(&ExportJob{}).Where("id IN ?", ids).Update("status", ExportExpired).Error
+	})
+	return jobs, err
+}
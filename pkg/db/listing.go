@@ -0,0 +1,148 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// searchScanLimit bounds how many encrypted rows one page may decrypt while
+// looking for a content match.
+const searchScanLimit = 2000
+
+var ErrTotalUnavailable = errors.New("total is not available for content search on encrypted messages")
+
+// SmsFilter selects messages of one service owned by UserId. Zero values
+// leave a filter off. Pages are keyed by id: pass the previous page's
+// NextCursor as Cursor to continue.
+type SmsFilter struct {
+	UserId    uint
+	ServiceId uint
+	Statuses  []SmsStatus
+	Receptor  string
+	Provider  string
+	From      time.Time
+	To        time.Time
+	// Search matches a substring of the content.
+	Search string
+	// ExcludeOtp leaves one-time-code messages out.
+	ExcludeOtp bool
+	Cursor     uint
+	Limit      int
+	WithTotal  bool
+}
+
+type SmsPage struct {
+	Messages []Sms
+	// NextCursor is 0 on the last page.
+	NextCursor uint
+	// Total counts every match regardless of the cursor; nil unless asked for.
+	Total *int64
+}
+
+func (d *DataBaseWrapper) ListSms(f SmsFilter) (SmsPage, error) {
+	var page SmsPage
+
+	base := d.DBConn.Model(&Sms{}).
+		Where("service_id = ?", f.ServiceId).
+		Where("service_id IN (?)", d.DBConn.Model(&Service{}).Select("id").
+			Where("id = ? AND user_id = ?", f.ServiceId, f.UserId))
+	if len(f.Statuses) > 0 {
+		base = base.Where("status IN ?", f.Statuses)
+	}
+	if f.Receptor != "" {
+		base = base.Where("receptor = ?", f.Receptor)
+	}
+	if f.Provider != "" {
+		base = base.Where("service_provider_name = ?", f.Provider)
+	}
+	if !f.From.IsZero() {
+		base = base.Where("created_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		base = base.Where("created_at < ?", f.To)
+	}
+	if f.ExcludeOtp {
+		base = base.Where("otp = ?", false)
+	}
+
+	// encrypted content can only be searched after decryption
+	searchInMemory := f.Search != "" && d.Sealer != nil
+	if f.Search != "" && !searchInMemory {
+		base = base.Where("content LIKE ?", "%"+escapeLike(f.Search)+"%")
+	}
+
+	if f.WithTotal {
+		if searchInMemory {
+			return page, ErrTotalUnavailable
+		}
+		var total int64
+		if err := base.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+			return page, err
+		}
+		page.Total = &total
+	}
+
+	if !searchInMemory {
+		rows, err := d.fetchSmsPage(base, f.Cursor, f.Limit+1)
+		if err != nil {
+			return page, err
+		}
+		if len(rows) > f.Limit {
+			rows = rows[:f.Limit]
+			page.NextCursor = rows[len(rows)-1].ID
+		}
+		page.Messages = rows
+		return page, nil
+	}
+
+	// scan forward in batches until the page is full or the scan budget is
+	// spent; the cursor then points after the last row looked at
+	cursor, scanned := f.Cursor, 0
+	for scanned < searchScanLimit {
+		rows, err := d.fetchSmsPage(base, cursor, f.Limit)
+		if err != nil {
+			return page, err
+		}
+		for _, r := range rows {
+			scanned++
+			cursor = r.ID
+			if strings.Contains(r.Content, f.Search) {
+				page.Messages = append(page.Messages, r)
+				if len(page.Messages) == f.Limit {
+					page.NextCursor = cursor
+					return page, nil
+				}
+			}
+		}
+		if len(rows) < f.Limit {
+			return page, nil
+		}
+	}
+	page.NextCursor = cursor
+	return page, nil
+}
+
+// fetchSmsPage loads up to limit decrypted rows of q older than cursor.
+func (d *DataBaseWrapper) fetchSmsPage(q *gorm.DB, cursor uint, limit int) ([]Sms, error) {
+	q = q.Session(&gorm.Session{})
+	if cursor > 0 {
+		q = q.Where("id < ?", cursor)
+	}
+	var rows []Sms
+	if err := q.Order("id DESC").Limit(limit).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		if err := d.openSms(&rows[i]); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
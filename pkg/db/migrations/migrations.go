@@ -0,0 +1,414 @@
+// Package migrations applies the versioned schema migrations embedded under
+// mysql/ and postgres/. Each migration is a pair of files
+// NNNN_name.up.sql and NNNN_name.down.sql; applied versions are recorded in
+// the schema_migrations table.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed mysql/*.sql postgres/*.sql
+var files embed.FS
+
+const table = "schema_migrations"
+
+// lockName and lockKey name the lock that serialises migration runs on MySQL
+// and PostgreSQL.
+const (
+	lockName = "postchi_schema_migrations"
+	lockKey  = 7386150927
+)
+
+var (
+	ErrSchemaOutdated = errors.New("database schema is behind this build, run the migrate command")
+	ErrSchemaDirty    = errors.New("a migration failed half way, fix the schema and run migrate force")
+	ErrLockTimeout    = errors.New("timed out waiting for another migration run")
+	ErrUnversioned    = errors.New("tables exist but no migration is recorded; adopt a database created by AutoMigrate with migrate force 1 or 2, see the README")
+)
+
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Runner applies migrations to one database. Up, Down and Force hold a
+// database-wide lock, so concurrent runs from several replicas or deploy jobs
+// wait for each other instead of racing.
+type Runner struct {
+	db          *gorm.DB
+	dialect     string
+	migrations  []Migration
+	LockTimeout time.Duration
+}
+
+func New(g *gorm.DB) (*Runner, error) {
+	dialect := g.Dialector.Name()
+	migrations, err := load(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Runner{db: g, dialect: dialect, migrations: migrations, LockTimeout: time.Minute}, nil
+}
+
+func load(dialect string) ([]Migration, error) {
+	entries, err := files.ReadDir(dialect)
+	if err != nil {
+		return nil, fmt.Errorf("migrations: no migrations for %s", dialect)
+	}
+	byVersion := make(map[uint]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		rawVersion, label, ok2 := strings.Cut(base, "_")
+		version, err := strconv.ParseUint(rawVersion, 10, 32)
+		if !ok || !ok2 || err != nil || version == 0 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("migrations: bad file name %s/%s", dialect, name)
+		}
+		body, err := files.ReadFile(path.Join(dialect, name))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[uint(version)]
+		if m == nil {
+			m = &Migration{Version: uint(version), Name: label}
+			byVersion[uint(version)] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migrations: %s/%04d_%s needs both up and down files", dialect, m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Latest is the version this build expects.
+func (r *Runner) Latest() uint {
+	if len(r.migrations) == 0 {
+		return 0
+	}
+	return r.migrations[len(r.migrations)-1].Version
+}
+
+// Version reports the applied version, 0 on an empty database, and whether
+// a migration was left half applied.
+func (r *Runner) Version(ctx context.Context) (uint, bool, error) {
+	if !r.db.WithContext(ctx).Migrator().HasTable(table) {
+		return 0, false, nil
+	}
+	var row struct {
+		Version sql.NullInt64
+		Dirty   sql.NullInt64
+	}
+	err := r.db.WithContext(ctx).Table(table).
+		Select("MAX(version) AS version, SUM(CASE WHEN dirty THEN 1 ELSE 0 END) AS dirty").
+		Scan(&row).Error
+	if err != nil {
+		return 0, false, err
+	}
+	return uint(row.Version.Int64), row.Dirty.Int64 > 0, nil
+}
+
+// Check fails unless every migration of this build is applied. A database
+// migrated further than this build knows is accepted, so an older replica
+// keeps running during a rolling deploy.
+func (r *Runner) Check(ctx context.Context) error {
+	version, dirty, err := r.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w (version %d)", ErrSchemaDirty, version)
+	}
+	if version < r.Latest() {
+		return fmt.Errorf("%w (at version %d, need %d)", ErrSchemaOutdated, version, r.Latest())
+	}
+	return nil
+}
+
+// Pending lists the migrations not applied yet.
+func (r *Runner) Pending(ctx context.Context) ([]Migration, error) {
+	version, _, err := r.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range r.migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies up to steps pending migrations, all of them when steps is 0,
+// and returns the ones it applied.
+func (r *Runner) Up(ctx context.Context, steps int) ([]Migration, error) {
+	var applied []Migration
+	err := r.withLock(ctx, func(conn *sql.Conn) error {
+		pending, err := r.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		if err := r.refuseDirty(ctx); err != nil {
+			return err
+		}
+		if len(pending) == len(r.migrations) && r.db.WithContext(ctx).Migrator().HasTable("users") {
+			return ErrUnversioned
+		}
+		for _, m := range pending {
+			if steps > 0 && len(applied) == steps {
+				break
+			}
+			if err := r.apply(ctx, conn, m, true); err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			applied = append(applied, m)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns
+// the ones it reverted.
+func (r *Runner) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := r.withLock(ctx, func(conn *sql.Conn) error {
+		version, _, err := r.Version(ctx)
+		if err != nil {
+			return err
+		}
+		if err := r.refuseDirty(ctx); err != nil {
+			return err
+		}
+		for i := len(r.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			m := r.migrations[i]
+			if m.Version > version {
+				continue
+			}
+			if err := r.apply(ctx, conn, m, false); err != nil {
+				return fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+			}
+			reverted = append(reverted, m)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Force records version as cleanly applied without running anything, for
+// adopting a database created before versioned migrations or recovering
+// from a failed one after fixing the schema by hand. 0 clears the history.
+func (r *Runner) Force(ctx context.Context, version uint) error {
+	known := version == 0
+	for _, m := range r.migrations {
+		known = known || m.Version == version
+	}
+	if !known {
+		return fmt.Errorf("migrations: unknown version %d", version)
+	}
+	return r.withLock(ctx, func(conn *sql.Conn) error {
+		if _, err := conn.ExecContext(ctx, r.bind("DELETE FROM "+table)); err != nil {
+			return err
+		}
+		for _, m := range r.migrations {
+			if m.Version > version {
+				break
+			}
+			_, err := conn.ExecContext(ctx,
+				r.bind("INSERT INTO "+table+" (version, name, dirty, applied_at) VALUES (?, ?, ?, ?)"),
+				m.Version, m.Name, false, time.Now().UTC())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *Runner) refuseDirty(ctx context.Context) error {
+	version, dirty, err := r.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w (version %d)", ErrSchemaDirty, version)
+	}
+	return nil
+}
+
+// apply runs one migration. The version row is marked dirty before the
+// statements run and settled after, because MySQL commits DDL implicitly and
+// a failure there can leave the schema half changed.
+func (r *Runner) apply(ctx context.Context, conn *sql.Conn, m Migration, up bool) error {
+	script := m.Down
+	if up {
+		script = m.Up
+		_, err := conn.ExecContext(ctx,
+			r.bind("INSERT INTO "+table+" (version, name, dirty, applied_at) VALUES (?, ?, ?, ?)"),
+			m.Version, m.Name, true, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+	} else {
+		if _, err := conn.ExecContext(ctx, r.bind("UPDATE "+table+" SET dirty = ? WHERE version = ?"), true, m.Version); err != nil {
+			return err
+		}
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range statements(script) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if up {
+		_, err = conn.ExecContext(ctx, r.bind("UPDATE "+table+" SET dirty = ? WHERE version = ?"), false, m.Version)
+	} else {
+		_, err = conn.ExecContext(ctx, r.bind("DELETE FROM "+table+" WHERE version = ?"), m.Version)
+	}
+	return err
+}
+
+// withLock runs fn on a dedicated connection while holding the migration
+// lock, creating the version table first if needed.
+func (r *Runner) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	sqlDB, err := r.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := r.lock(ctx, conn); err != nil {
+		return err
+	}
+	defer r.unlock(conn)
+
+	timestamp := "DATETIME(3)"
+	if r.dialect == "postgres" {
+		timestamp = "TIMESTAMPTZ"
+	}
+	_, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+
+		" (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, dirty BOOLEAN NOT NULL, applied_at "+timestamp+" NOT NULL)")
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func (r *Runner) lock(ctx context.Context, conn *sql.Conn) error {
+	if r.dialect != "postgres" {
+		var got sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(r.LockTimeout.Seconds())).Scan(&got)
+		if err != nil {
+			return err
+		}
+		if got.Int64 != 1 {
+			return ErrLockTimeout
+		}
+		return nil
+	}
+	deadline := time.Now().Add(r.LockTimeout)
+	for {
+		var got bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockKey).Scan(&got); err != nil {
+			return err
+		}
+		if got {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *Runner) unlock(conn *sql.Conn) {
+	// the lock also goes away with the connection, so errors are ignored
+	if r.dialect == "postgres" {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+		return
+	}
+	conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", lockName)
+}
+
+// bind rewrites ? placeholders to $n for PostgreSQL.
+func (r *Runner) bind(query string) string {
+	if r.dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, ch := range query {
+		if ch == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(ch)
+	}
+	return b.String()
+}
+
+// statements splits a script on semicolons that end a line, dropping
+// comment lines.
+func statements(script string) []string {
+	var out []string
+	var cur strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		cur.WriteString(line)
+		cur.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			out = append(out, strings.TrimSuffix(strings.TrimSpace(cur.String()), ";"))
+			cur.Reset()
+		}
+	}
+	if s := strings.TrimSpace(cur.String()); s != "" {
+		out = append(out, s)
+	}
+	return out
+}
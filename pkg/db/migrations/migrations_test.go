@@ -0,0 +1,241 @@
+package migrations_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"postchi/pkg/db"
+	"postchi/pkg/db/migrations"
+
+	"gorm.io/gorm"
+)
+
+// Like the pkg/db tests these run against TEST_DB_DSN and DB_DRIVER, and
+// migrate the schema down and up, so they need a throwaway database.
+
+func newTestRunner(t *testing.T) (*gorm.DB, *migrations.Runner) {
+	t.Helper()
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN not set")
+	}
+	g, err := db.Open(os.Getenv("DB_DRIVER"), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := migrations.New(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, r
+}
+
+func TestRoundTrip(t *testing.T) {
+	g, r := newTestRunner(t)
+	ctx := context.Background()
+
+	if _, err := r.Down(ctx, int(r.Latest())); err != nil {
+		t.Fatal(err)
+	}
+	if version, _, err := r.Version(ctx); err != nil || version != 0 {
+		t.Fatalf("got version %d, %v after migrating down, want 0", version, err)
+	}
+	if err := r.Check(ctx); !errors.Is(err, migrations.ErrSchemaOutdated) {
+		t.Fatalf("got %v, want ErrSchemaOutdated", err)
+	}
+	if g.Migrator().HasTable(&db.User{}) {
+		t.Fatal("users table survived migrating down")
+	}
+
+	applied, err := r.Up(ctx, 1)
+	if err != nil || len(applied) != 1 || applied[0].Version != 1 {
+		t.Fatalf("got %v, %v; want only the first migration", applied, err)
+	}
+	if _, err := r.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if version, dirty, err := r.Version(ctx); err != nil || dirty || version != r.Latest() {
+		t.Fatalf("got version %d dirty %v, %v; want %d", version, dirty, err, r.Latest())
+	}
+	if err := r.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err := r.Pending(ctx); err != nil || len(pending) != 0 {
+		t.Fatalf("got %d pending, %v; want none", len(pending), err)
+	}
+}
+
+// models lists every table the code uses.
+var models = []interface{}{
+	&db.User{}, &db.Service{}, &db.Sms{}, &db.Price{}, &db.BlacklistedNumber{},
+	&db.OutboxMessage{}, &db.ProviderRateLimit{}, &db.PurgeRecord{}, &db.ExportJob{},
+	&db.SmsRollup{}, &db.RollupState{}, &db.QuotaCounter{},
+}
+
+// TestSchemaMatchesModels checks that the migrated schema has a column for
+// every model field, so a model change without a migration fails here.
+func TestSchemaMatchesModels(t *testing.T) {
+	g, r := newTestRunner(t)
+	if _, err := r.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	checkSchema(t, g)
+}
+
+func checkSchema(t *testing.T, g *gorm.DB) {
+	t.Helper()
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: g}
+		if err := stmt.Parse(model); err != nil {
+			t.Fatal(err)
+		}
+		if !g.Migrator().HasTable(model) {
+			t.Errorf("table %s is missing", stmt.Schema.Table)
+			continue
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" {
+				continue
+			}
+			if !g.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("column %s.%s is missing", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+}
+
+// The first release's models, which AutoMigrate turned into the schema that
+// migration 1 reproduces.
+type baselineUser struct {
+	gorm.Model
+	Name     string            `gorm:"type:varchar(128);not null;default:''"`
+	Password string            `gorm:"type:varchar(128);uniqueIndex;not null;default:''"`
+	Services []baselineService `gorm:"foreignKey:UserID"`
+}
+
+type baselineService struct {
+	gorm.Model
+	UserID  uint          `gorm:"index;not null"`
+	Type    string        `gorm:"type:enum('express','indirect');not null"`
+	Status  string        `gorm:"type:varchar(16);not null;default:'active'"`
+	Credits uint64        `gorm:"not null;default:0"`
+	User    baselineUser  `gorm:"references:ID"`
+	Sms     []baselineSms `gorm:"foreignKey:ServiceId"`
+}
+
+type baselineSms struct {
+	gorm.Model
+	Content                  string          `gorm:"type:string;not null;"`
+	Receptor                 string          `gorm:"type:string;not null;"`
+	Status                   string          `gorm:"type:string;not null;"`
+	SentTime                 int64           `gorm:"type:int;not null;"`
+	Cost                     uint            `gorm:"type:int;default:0;index:idx_service_status_cost;"`
+	ServiceProviderName      string          `gorm:"type:string;not null;"`
+	ServiceProviderMessageId int             `gorm:"type:int;not null;"`
+	ServiceId                uint            `gorm:"references:ID"`
+	Service                  baselineService `gorm:"references:ID"`
+}
+
+func (baselineUser) TableName() string    { return "users" }
+func (baselineService) TableName() string { return "services" }
+func (baselineSms) TableName() string     { return "sms" }
+
+// TestAdoptBaseline adopts a database AutoMigrate created for the first
+// release, holding a message, with force 1 and migrates it up.
+func TestAdoptBaseline(t *testing.T) {
+	g, r := newTestRunner(t)
+	if g.Dialector.Name() != "mysql" {
+		// the first release only ran on MySQL
+		t.Skip("baseline AutoMigrate schema is MySQL only")
+	}
+	ctx := context.Background()
+	if _, err := r.Down(ctx, int(r.Latest())); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// AutoMigrate's foreign key index may differ from migration 1's, so
+		// drop the tables instead of migrating down
+		for i := len(models) - 1; i >= 0; i-- {
+			if err := g.Migrator().DropTable(models[i]); err != nil {
+				t.Error(err)
+			}
+		}
+		if err := r.Force(ctx, 0); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if err := g.AutoMigrate(&baselineUser{}, &baselineService{}, &baselineSms{}); err != nil {
+		t.Fatal(err)
+	}
+	user := baselineUser{Name: "baseline", Password: "baseline"}
+	if err := g.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	svc := baselineService{UserID: user.ID, Type: "indirect", Credits: 10}
+	if err := g.Create(&svc).Error; err != nil {
+		t.Fatal(err)
+	}
+	sms := baselineSms{Content: "hello", Receptor: "09120000001", Status: "sent", ServiceProviderName: "kavenegar", ServiceId: svc.ID}
+	if err := g.Create(&sms).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Up(ctx, 0); !errors.Is(err, migrations.ErrUnversioned) {
+		t.Fatalf("got %v, want ErrUnversioned", err)
+	}
+	if err := r.Force(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkSchema(t, g)
+
+	var got db.Service
+	if err := g.First(&got, svc.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != db.ServiceTypeAsync || got.Credits != 10 {
+		t.Fatalf("got type %q credits %d, want async and 10", got.Type, got.Credits)
+	}
+}
+
+// TestConcurrentUp starts several replicas at once; the lock lets one of them
+// migrate and the others find nothing left to do.
+func TestConcurrentUp(t *testing.T) {
+	_, r := newTestRunner(t)
+	ctx := context.Background()
+	if _, err := r.Down(ctx, int(r.Latest())); err != nil {
+		t.Fatal(err)
+	}
+
+	runners := make([]*migrations.Runner, 3)
+	for i := range runners {
+		_, runners[i] = newTestRunner(t)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(runners))
+	for i, runner := range runners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = runner.Up(ctx, 0)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("runner %d: %v", i, err)
+		}
+	}
+	if err := r.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,3 @@
+DROP TABLE `sms`;
+DROP TABLE `services`;
+DROP TABLE `users`;
@@ -0,0 +1,51 @@
+-- Baseline: the schema AutoMigrate created for the first release, before any
+-- column added since. Databases still at it are adopted with
+-- `migrate force 1`; migration 2 brings it to the last AutoMigrate schema.
+-- fk_services_sms (service_id) is the index MySQL created for the foreign key.
+
+CREATE TABLE `users` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `created_at` datetime(3) NULL,
+    `updated_at` datetime(3) NULL,
+    `deleted_at` datetime(3) NULL,
+    `name` varchar(128) NOT NULL DEFAULT '',
+    `password` varchar(128) NOT NULL DEFAULT '',
+    PRIMARY KEY (`id`),
+    INDEX `idx_users_deleted_at` (`deleted_at`),
+    UNIQUE INDEX `idx_users_password` (`password`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `services` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `created_at` datetime(3) NULL,
+    `updated_at` datetime(3) NULL,
+    `deleted_at` datetime(3) NULL,
+    `user_id` bigint unsigned NOT NULL,
+    `type` enum('express','indirect') NOT NULL,
+    `status` varchar(16) NOT NULL DEFAULT 'active',
+    `credits` bigint unsigned NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    INDEX `idx_services_deleted_at` (`deleted_at`),
+    INDEX `idx_services_user_id` (`user_id`),
+    CONSTRAINT `fk_users_services` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `sms` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `created_at` datetime(3) NULL,
+    `updated_at` datetime(3) NULL,
+    `deleted_at` datetime(3) NULL,
+    `content` longtext NOT NULL,
+    `receptor` longtext NOT NULL,
+    `status` longtext NOT NULL,
+    `sent_time` int NOT NULL,
+    `cost` int DEFAULT 0,
+    `service_provider_name` longtext NOT NULL,
+    `service_provider_message_id` int NOT NULL,
+    `service_id` bigint unsigned,
+    PRIMARY KEY (`id`),
+    INDEX `idx_sms_deleted_at` (`deleted_at`),
+    INDEX `idx_service_status_cost` (`cost`),
+    INDEX `fk_services_sms` (`service_id`),
+    CONSTRAINT `fk_services_sms` FOREIGN KEY (`service_id`) REFERENCES `services`(`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
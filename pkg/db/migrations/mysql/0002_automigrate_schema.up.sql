@@ -0,0 +1,148 @@
+-- The columns, indexes and tables AutoMigrate added after the first release,
+-- up to the last release that still ran it. Databases last started by that
+-- release are adopted with `migrate force 2`. Like AutoMigrate it keeps the
+-- int columns in sms; migration 5 widens them.
+
+ALTER TABLE `services`
+    MODIFY `type` varchar(16) NOT NULL,
+    ADD COLUMN `reserved` bigint unsigned NOT NULL DEFAULT 0,
+    ADD COLUMN `low_balance_threshold` bigint unsigned NOT NULL DEFAULT 0,
+    ADD COLUMN `low_balance_alerted` boolean NOT NULL DEFAULT false,
+    ADD COLUMN `alert_email` varchar(255) NOT NULL DEFAULT '',
+    ADD COLUMN `alert_sms_receptor` varchar(32) NOT NULL DEFAULT '',
+    ADD COLUMN `alert_webhook_url` varchar(512) NOT NULL DEFAULT '',
+    ADD COLUMN `requests_per_minute` bigint unsigned NOT NULL DEFAULT 0,
+    ADD COLUMN `daily_quota` bigint unsigned NOT NULL DEFAULT 0,
+    ADD COLUMN `monthly_quota` bigint unsigned NOT NULL DEFAULT 0,
+    ADD COLUMN `retention_days` bigint unsigned NOT NULL DEFAULT 0,
+    ADD COLUMN `retention_action` varchar(16) NOT NULL DEFAULT 'delete';
+
+ALTER TABLE `sms`
+    MODIFY `content` text NOT NULL,
+    MODIFY `receptor` varchar(32) NOT NULL,
+    MODIFY `status` varchar(16) NOT NULL,
+    MODIFY `service_provider_name` varchar(64) NOT NULL,
+    ADD COLUMN `reserved_cost` int NOT NULL DEFAULT 0,
+    ADD COLUMN `operator` varchar(64) NOT NULL DEFAULT '',
+    ADD COLUMN `otp` boolean NOT NULL DEFAULT false,
+    ADD COLUMN `content_key_id` varchar(64) NOT NULL DEFAULT '',
+    ADD COLUMN `content_data_key` varbinary(255),
+    ADD COLUMN `anonymized_at` datetime(3) NULL,
+    ADD INDEX `idx_sms_service_keyset` (`service_id`,`id`),
+    ADD INDEX `idx_sms_service_status` (`service_id`,`status`,`id`),
+    ADD INDEX `idx_sms_service_receptor` (`service_id`,`receptor`,`id`),
+    ADD INDEX `idx_sms_service_provider` (`service_id`,`service_provider_name`,`id`),
+    ADD INDEX `idx_sms_service_created` (`service_id`,`created_at`),
+    ADD INDEX `idx_sms_created` (`created_at`),
+    ADD INDEX `idx_sms_content_key` (`content_key_id`);
+
+CREATE TABLE `prices` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `created_at` datetime(3) NULL,
+    `updated_at` datetime(3) NULL,
+    `deleted_at` datetime(3) NULL,
+    `prefix` varchar(16) NOT NULL DEFAULT '',
+    `operator` varchar(64) NOT NULL DEFAULT '',
+    `service_type` varchar(16) NOT NULL,
+    `provider` varchar(64) NOT NULL DEFAULT '',
+    `cost_per_segment` bigint unsigned NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    INDEX `idx_prices_deleted_at` (`deleted_at`),
+    UNIQUE INDEX `idx_price_route` (`prefix`,`service_type`,`provider`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `blacklisted_numbers` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `created_at` datetime(3) NULL,
+    `updated_at` datetime(3) NULL,
+    `deleted_at` datetime(3) NULL,
+    `receptor` varchar(32) NOT NULL,
+    `service_id` bigint unsigned NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    INDEX `idx_blacklisted_numbers_deleted_at` (`deleted_at`),
+    UNIQUE INDEX `idx_blacklist_receptor` (`receptor`,`service_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `outbox_messages` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `created_at` datetime(3) NOT NULL,
+    `topic` varchar(128) NOT NULL DEFAULT '',
+    `key` varchar(128) NOT NULL DEFAULT '',
+    `payload` longblob NOT NULL,
+    `headers` text,
+    `status` varchar(16) NOT NULL DEFAULT 'pending',
+    `attempts` bigint NOT NULL DEFAULT 0,
+    `last_error` varchar(512) NOT NULL DEFAULT '',
+    `dispatched_at` datetime(3) NULL,
+    PRIMARY KEY (`id`),
+    INDEX `idx_outbox_status` (`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `provider_rate_limits` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `created_at` datetime(3) NULL,
+    `updated_at` datetime(3) NULL,
+    `deleted_at` datetime(3) NULL,
+    `provider` varchar(64) NOT NULL,
+    `sender` varchar(32) NOT NULL DEFAULT '',
+    `rate_per_second` double NOT NULL DEFAULT 0,
+    `burst` bigint unsigned NOT NULL DEFAULT 1,
+    PRIMARY KEY (`id`),
+    INDEX `idx_provider_rate_limits_deleted_at` (`deleted_at`),
+    UNIQUE INDEX `idx_rate_limit_route` (`provider`,`sender`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `purge_records` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `created_at` datetime(3) NOT NULL,
+    `service_id` bigint unsigned NOT NULL,
+    `action` varchar(16) NOT NULL,
+    `count` bigint NOT NULL,
+    `first_sms_id` bigint unsigned NOT NULL,
+    `last_sms_id` bigint unsigned NOT NULL,
+    `before` datetime(3) NOT NULL,
+    `archive_uri` varchar(512) NOT NULL DEFAULT '',
+    PRIMARY KEY (`id`),
+    INDEX `idx_purge_records_service_id` (`service_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `export_jobs` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `created_at` datetime(3) NOT NULL,
+    `user_id` bigint unsigned NOT NULL,
+    `service_id` bigint unsigned NOT NULL,
+    `format` varchar(16) NOT NULL,
+    `role` varchar(64) NOT NULL DEFAULT '',
+    `from` datetime(3) NOT NULL,
+    `to` datetime(3) NOT NULL,
+    `status` varchar(16) NOT NULL DEFAULT 'pending',
+    `rows` bigint NOT NULL DEFAULT 0,
+    `file` varchar(512) NOT NULL DEFAULT '',
+    `error` varchar(512) NOT NULL DEFAULT '',
+    `started_at` datetime(3) NULL,
+    `completed_at` datetime(3) NULL,
+    PRIMARY KEY (`id`),
+    INDEX `idx_export_jobs_service_id` (`service_id`),
+    INDEX `idx_export_status` (`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `sms_rollups` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `bucket` datetime(3) NOT NULL,
+    `service_id` bigint unsigned NOT NULL,
+    `status` varchar(16) NOT NULL,
+    `provider` varchar(64) NOT NULL,
+    `operator` varchar(64) NOT NULL,
+    `messages` bigint NOT NULL DEFAULT 0,
+    `cost` bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    UNIQUE INDEX `idx_rollup_key` (`bucket`,`service_id`,`status`,`provider`,`operator`),
+    INDEX `idx_rollup_service_bucket` (`service_id`,`bucket`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `rollup_states` (
+    `id` bigint unsigned AUTO_INCREMENT,
+    `frozen_until` datetime(3) NULL,
+    `refreshed_at` datetime(3) NULL,
+    PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
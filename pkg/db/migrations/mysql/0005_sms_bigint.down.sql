@@ -0,0 +1,5 @@
+ALTER TABLE `sms`
+    MODIFY `sent_time` int NOT NULL,
+    MODIFY `cost` int DEFAULT 0,
+    MODIFY `reserved_cost` int NOT NULL DEFAULT 0,
+    MODIFY `service_provider_message_id` int NOT NULL;
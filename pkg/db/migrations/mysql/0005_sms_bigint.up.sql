@@ -0,0 +1,8 @@
+-- The sms amounts, send time and provider message id were created as int.
+-- Widen them to the types their Go fields map to: unix seconds run past int
+-- in 2038 and provider message ids already do.
+ALTER TABLE `sms`
+    MODIFY `sent_time` bigint NOT NULL,
+    MODIFY `cost` bigint unsigned DEFAULT 0,
+    MODIFY `reserved_cost` bigint unsigned NOT NULL DEFAULT 0,
+    MODIFY `service_provider_message_id` bigint NOT NULL;
@@ -0,0 +1,49 @@
+-- Baseline: the first release's schema, kept in step with the MySQL set.
+-- PostgreSQL was only supported by the last release that ran AutoMigrate, so
+-- databases it created are adopted with `migrate force 2`.
+
+CREATE TABLE users (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    name varchar(128) NOT NULL DEFAULT '',
+    password varchar(128) NOT NULL DEFAULT '',
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX idx_users_password ON users (password);
+CREATE INDEX idx_users_deleted_at ON users (deleted_at);
+
+CREATE TABLE services (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    user_id bigint NOT NULL,
+    type varchar(16) NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'active',
+    credits bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_users_services FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX idx_services_user_id ON services (user_id);
+CREATE INDEX idx_services_deleted_at ON services (deleted_at);
+
+CREATE TABLE sms (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    content text NOT NULL,
+    receptor text NOT NULL,
+    status text NOT NULL,
+    sent_time int NOT NULL,
+    cost int DEFAULT 0,
+    service_provider_name text NOT NULL,
+    service_provider_message_id int NOT NULL,
+    service_id bigint,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_services_sms FOREIGN KEY (service_id) REFERENCES services(id)
+);
+CREATE INDEX idx_service_status_cost ON sms (cost);
+CREATE INDEX idx_sms_deleted_at ON sms (deleted_at);
@@ -0,0 +1,37 @@
+DROP TABLE rollup_states;
+DROP TABLE sms_rollups;
+DROP TABLE export_jobs;
+DROP TABLE purge_records;
+DROP TABLE provider_rate_limits;
+DROP TABLE outbox_messages;
+DROP TABLE blacklisted_numbers;
+DROP TABLE prices;
+DROP INDEX idx_sms_content_key;
+DROP INDEX idx_sms_created;
+DROP INDEX idx_sms_service_created;
+DROP INDEX idx_sms_service_provider;
+DROP INDEX idx_sms_service_receptor;
+DROP INDEX idx_sms_service_status;
+DROP INDEX idx_sms_service_keyset;
+ALTER TABLE sms
+    DROP COLUMN reserved_cost,
+    DROP COLUMN operator,
+    DROP COLUMN otp,
+    DROP COLUMN content_key_id,
+    DROP COLUMN content_data_key,
+    DROP COLUMN anonymized_at,
+    ALTER COLUMN receptor TYPE text,
+    ALTER COLUMN status TYPE text,
+    ALTER COLUMN service_provider_name TYPE text;
+ALTER TABLE services
+    DROP COLUMN reserved,
+    DROP COLUMN low_balance_threshold,
+    DROP COLUMN low_balance_alerted,
+    DROP COLUMN alert_email,
+    DROP COLUMN alert_sms_receptor,
+    DROP COLUMN alert_webhook_url,
+    DROP COLUMN requests_per_minute,
+    DROP COLUMN daily_quota,
+    DROP COLUMN monthly_quota,
+    DROP COLUMN retention_days,
+    DROP COLUMN retention_action;
@@ -0,0 +1,146 @@
+-- The columns, indexes and tables AutoMigrate added after the first release,
+-- up to the last release that still ran it. Databases last started by that
+-- release are adopted with `migrate force 2`. Like AutoMigrate it keeps the
+-- int columns in sms; migration 5 widens them.
+
+ALTER TABLE services
+    ADD COLUMN reserved bigint NOT NULL DEFAULT 0,
+    ADD COLUMN low_balance_threshold bigint NOT NULL DEFAULT 0,
+    ADD COLUMN low_balance_alerted boolean NOT NULL DEFAULT false,
+    ADD COLUMN alert_email varchar(255) NOT NULL DEFAULT '',
+    ADD COLUMN alert_sms_receptor varchar(32) NOT NULL DEFAULT '',
+    ADD COLUMN alert_webhook_url varchar(512) NOT NULL DEFAULT '',
+    ADD COLUMN requests_per_minute bigint NOT NULL DEFAULT 0,
+    ADD COLUMN daily_quota bigint NOT NULL DEFAULT 0,
+    ADD COLUMN monthly_quota bigint NOT NULL DEFAULT 0,
+    ADD COLUMN retention_days bigint NOT NULL DEFAULT 0,
+    ADD COLUMN retention_action varchar(16) NOT NULL DEFAULT 'delete';
+
+ALTER TABLE sms
+    ALTER COLUMN receptor TYPE varchar(32),
+    ALTER COLUMN status TYPE varchar(16),
+    ALTER COLUMN service_provider_name TYPE varchar(64),
+    ADD COLUMN reserved_cost int NOT NULL DEFAULT 0,
+    ADD COLUMN operator varchar(64) NOT NULL DEFAULT '',
+    ADD COLUMN otp boolean NOT NULL DEFAULT false,
+    ADD COLUMN content_key_id varchar(64) NOT NULL DEFAULT '',
+    ADD COLUMN content_data_key bytea,
+    ADD COLUMN anonymized_at timestamptz;
+CREATE INDEX idx_sms_content_key ON sms (content_key_id);
+CREATE INDEX idx_sms_created ON sms (created_at);
+CREATE INDEX idx_sms_service_created ON sms (service_id,created_at);
+CREATE INDEX idx_sms_service_provider ON sms (service_id,service_provider_name,id);
+CREATE INDEX idx_sms_service_receptor ON sms (service_id,receptor,id);
+CREATE INDEX idx_sms_service_status ON sms (service_id,status,id);
+CREATE INDEX idx_sms_service_keyset ON sms (service_id,id);
+
+CREATE TABLE prices (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    prefix varchar(16) NOT NULL DEFAULT '',
+    operator varchar(64) NOT NULL DEFAULT '',
+    service_type varchar(16) NOT NULL,
+    provider varchar(64) NOT NULL DEFAULT '',
+    cost_per_segment bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX idx_price_route ON prices (prefix,service_type,provider);
+CREATE INDEX idx_prices_deleted_at ON prices (deleted_at);
+
+CREATE TABLE blacklisted_numbers (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    receptor varchar(32) NOT NULL,
+    service_id bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX idx_blacklist_receptor ON blacklisted_numbers (receptor,service_id);
+CREATE INDEX idx_blacklisted_numbers_deleted_at ON blacklisted_numbers (deleted_at);
+
+CREATE TABLE outbox_messages (
+    id bigserial,
+    created_at timestamptz NOT NULL,
+    topic varchar(128) NOT NULL DEFAULT '',
+    key varchar(128) NOT NULL DEFAULT '',
+    payload bytea NOT NULL,
+    headers text,
+    status varchar(16) NOT NULL DEFAULT 'pending',
+    attempts bigint NOT NULL DEFAULT 0,
+    last_error varchar(512) NOT NULL DEFAULT '',
+    dispatched_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_outbox_status ON outbox_messages (status);
+
+CREATE TABLE provider_rate_limits (
+    id bigserial,
+    created_at timestamptz,
+    updated_at timestamptz,
+    deleted_at timestamptz,
+    provider varchar(64) NOT NULL,
+    sender varchar(32) NOT NULL DEFAULT '',
+    rate_per_second double precision NOT NULL DEFAULT 0,
+    burst bigint NOT NULL DEFAULT 1,
+    PRIMARY KEY (id)
+);
+CREATE UNIQUE INDEX idx_rate_limit_route ON provider_rate_limits (provider,sender);
+CREATE INDEX idx_provider_rate_limits_deleted_at ON provider_rate_limits (deleted_at);
+
+CREATE TABLE purge_records (
+    id bigserial,
+    created_at timestamptz NOT NULL,
+    service_id bigint NOT NULL,
+    action varchar(16) NOT NULL,
+    count bigint NOT NULL,
+    first_sms_id bigint NOT NULL,
+    last_sms_id bigint NOT NULL,
+    before timestamptz NOT NULL,
+    archive_uri varchar(512) NOT NULL DEFAULT '',
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_purge_records_service_id ON purge_records (service_id);
+
+CREATE TABLE export_jobs (
+    id bigserial,
+    created_at timestamptz NOT NULL,
+    user_id bigint NOT NULL,
+    service_id bigint NOT NULL,
+    format varchar(16) NOT NULL,
+    role varchar(64) NOT NULL DEFAULT '',
+    "from" timestamptz NOT NULL,
+    "to" timestamptz NOT NULL,
+    status varchar(16) NOT NULL DEFAULT 'pending',
+    rows bigint NOT NULL DEFAULT 0,
+    file varchar(512) NOT NULL DEFAULT '',
+    error varchar(512) NOT NULL DEFAULT '',
+    started_at timestamptz,
+    completed_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_export_status ON export_jobs (status);
+CREATE INDEX idx_export_jobs_service_id ON export_jobs (service_id);
+
+CREATE TABLE sms_rollups (
+    id bigserial,
+    bucket timestamptz NOT NULL,
+    service_id bigint NOT NULL,
+    status varchar(16) NOT NULL,
+    provider varchar(64) NOT NULL,
+    operator varchar(64) NOT NULL,
+    messages bigint NOT NULL DEFAULT 0,
+    cost bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (id)
+);
+CREATE INDEX idx_rollup_service_bucket ON sms_rollups (service_id,bucket);
+CREATE UNIQUE INDEX idx_rollup_key ON sms_rollups (bucket,service_id,status,provider,operator);
+
+CREATE TABLE rollup_states (
+    id bigserial,
+    frozen_until timestamptz,
+    refreshed_at timestamptz,
+    PRIMARY KEY (id)
+);
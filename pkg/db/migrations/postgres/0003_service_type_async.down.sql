@@ -0,0 +1,2 @@
+ALTER TABLE services DROP CONSTRAINT chk_services_type;
+UPDATE services SET type = 'indirect' WHERE type = 'async';
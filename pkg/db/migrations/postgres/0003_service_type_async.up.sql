@@ -0,0 +1,4 @@
+-- Service.Type used to be enum('express','indirect') while the code calls the
+-- second type "async"; store the name the code uses and enforce both values.
+UPDATE services SET type = 'async' WHERE type = 'indirect';
+ALTER TABLE services ADD CONSTRAINT chk_services_type CHECK (type IN ('express', 'async'));
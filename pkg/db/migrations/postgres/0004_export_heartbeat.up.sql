@@ -0,0 +1,3 @@
+-- Running exports renew heartbeat_at; one whose heartbeat went stale was cut
+-- off by a crash or shutdown and is claimed again.
+ALTER TABLE export_jobs ADD COLUMN heartbeat_at timestamptz;
@@ -0,0 +1,5 @@
+ALTER TABLE sms
+    ALTER COLUMN sent_time TYPE int,
+    ALTER COLUMN cost TYPE int,
+    ALTER COLUMN reserved_cost TYPE int,
+    ALTER COLUMN service_provider_message_id TYPE int;
@@ -0,0 +1,8 @@
+-- The sms amounts, send time and provider message id were created as int.
+-- Widen them to the types their Go fields map to: unix seconds run past int
+-- in 2038 and provider message ids already do.
+ALTER TABLE sms
+    ALTER COLUMN sent_time TYPE bigint,
+    ALTER COLUMN cost TYPE bigint,
+    ALTER COLUMN reserved_cost TYPE bigint,
+    ALTER COLUMN service_provider_message_id TYPE bigint;
@@ -0,0 +1,4 @@
+-- A relay claims outbox rows until claimed_until and publishes them outside
+-- the claiming transaction; rows of a relay that died are claimed again after
+-- the lease runs out.
+ALTER TABLE outbox_messages ADD COLUMN claimed_until timestamptz;
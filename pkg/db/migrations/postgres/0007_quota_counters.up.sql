@@ -0,0 +1,9 @@
+-- Request rate and message quota counters shared by every API instance. A
+-- counter past expires_at starts over on its next increment.
+CREATE TABLE quota_counters (
+    name varchar(128) NOT NULL,
+    value bigint NOT NULL DEFAULT 0,
+    expires_at timestamptz NOT NULL,
+    PRIMARY KEY (name)
+);
+CREATE INDEX idx_quota_counter_expires ON quota_counters (expires_at);
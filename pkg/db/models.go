@@ -1,9 +1,14 @@
 package db
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
+// The schema is created by the versioned migrations in ./migrations, not from
+// these tags; changing a model needs a migration for mysql and postgres.
+
 type ServiceType string
 
 const (
@@ -15,9 +20,22 @@ type SmsStatus string
 
 const (
 	SmsStatusQueued    SmsStatus = "queued"
+	SmsStatusSending   SmsStatus = "sending"
 	SmsStatusSent      SmsStatus = "sent"
 	SmsStatusDelivered SmsStatus = "delivered"
 	SmsStatusFailed    SmsStatus = "failed"
+	SmsStatusCancelled SmsStatus = "cancelled"
+	// SmsStatusUncaptured is an express message the provider accepted whose
+	// reservation could not be captured yet. It is never refunded; the stuck
+	// sweep captures it later.
+	SmsStatusUncaptured SmsStatus = "uncaptured"
+)
+
+type OutboxStatus string
+
+const (
+	OutboxStatusPending    OutboxStatus = "pending"
+	OutboxStatusDispatched OutboxStatus = "dispatched"
 )
 
 type User struct {
@@ -29,23 +47,185 @@ type User struct {
 
 type Service struct {
 	gorm.Model
-	UserID  uint        `gorm:"index;not null"`
-	Type    ServiceType `gorm:"type:enum('express','indirect');not null"`
-	Status  string      `gorm:"type:varchar(16);not null;default:'active'"`
-	Credits uint64      `gorm:"not null;default:0"`
-	User    User        `gorm:"references:ID"`
-	Sms     []Sms       `gorm:"foreignKey:ServiceId"`
+	UserID   uint        `gorm:"index;not null"`
+	Type     ServiceType `gorm:"type:varchar(16);not null"`
+	Status   string      `gorm:"type:varchar(16);not null;default:'active'"`
+	Credits  uint64      `gorm:"not null;default:0"`
+	Reserved uint64      `gorm:"not null;default:0"`
+
+	LowBalanceThreshold uint64 `gorm:"not null;default:0"`
+	LowBalanceAlerted   bool   `gorm:"not null;default:false"`
+	AlertEmail          string `gorm:"type:varchar(255);not null;default:''"`
+	AlertSmsReceptor    string `gorm:"type:varchar(32);not null;default:''"`
+	AlertWebhookUrl     string `gorm:"type:varchar(512);not null;default:''"`
+
+	RequestsPerMinute uint   `gorm:"not null;default:0"`
+	DailyQuota        uint64 `gorm:"not null;default:0"`
+	MonthlyQuota      uint64 `gorm:"not null;default:0"`
+
+	// RetentionDays of 0 keeps messages forever.
+	RetentionDays   uint            `gorm:"not null;default:0"`
+	RetentionAction RetentionAction `gorm:"type:varchar(16);not null;default:'delete'"`
+
+	User User  `gorm:"references:ID"`
+	Sms  []Sms `gorm:"foreignKey:ServiceId"`
 }
 
+// Sms.Content holds base64 ciphertext when ContentKeyID is set; the data key
+// that encrypted it is stored wrapped in ContentDataKey. Rows without a key id
+// predate encryption and hold plaintext.
+//
+// Listings page by id within a service, so every filter index ends in id:
+// (service_id, id) for plain pages, (service_id, status, id),
+// (service_id, receptor, id) and (service_id, service_provider_name, id) for
+// the equality filters and (service_id, created_at) for date ranges. The
+// rollup job scans whole hours through created_at alone.
 type Sms struct {
-	gorm.Model
-	Content                  string  `gorm:"type:string;not null;"`
-	Receptor                 string  `gorm:"type:string;not null;"`
-	Status                   string  `gorm:"type:string;not null;"`
-	SentTime                 int64   `gorm:"type:int;not null;"`
-	Cost                     uint    `gorm:"type:int;default:0;index:idx_service_status_cost;"`
-	ServiceProviderName      string  `gorm:"type:string;not null;"`
-	ServiceProviderMessageId int     `gorm:"type:int;not null;"`
-	ServiceId                uint    `gorm:"references:ID"`
+	ID                       uint      `gorm:"primarykey;index:idx_sms_service_keyset,priority:2;index:idx_sms_service_status,priority:3;index:idx_sms_service_receptor,priority:3;index:idx_sms_service_provider,priority:3"`
+	CreatedAt                time.Time `gorm:"index:idx_sms_service_created,priority:2;index:idx_sms_created"`
+	UpdatedAt                time.Time
+	DeletedAt                gorm.DeletedAt `gorm:"index"`
+	Content                  string         `gorm:"type:text;not null;"`
+	Receptor                 string         `gorm:"type:varchar(32);not null;index:idx_sms_service_receptor,priority:2"`
+	Status                   string         `gorm:"type:varchar(16);not null;index:idx_sms_service_status,priority:2"`
+	SentTime                 int64          `gorm:"not null;"`
+	Cost                     uint           `gorm:"default:0;index:idx_service_status_cost;"`
+	ReservedCost             uint           `gorm:"not null;default:0"`
+	ServiceProviderName      string         `gorm:"type:varchar(64);not null;index:idx_sms_service_provider,priority:2"`
+	ServiceProviderMessageId int            `gorm:"not null;"`
+	Operator                 string         `gorm:"type:varchar(64);not null;default:''"`
+	Otp                      bool           `gorm:"not null;default:false"`
+	ContentKeyID             string         `gorm:"type:varchar(64);not null;default:'';index:idx_sms_content_key"`
+	ContentDataKey           []byte         `gorm:"size:255"`
+	AnonymizedAt             *time.Time
+	ServiceId                uint    `gorm:"index:idx_sms_service_keyset,priority:1;index:idx_sms_service_status,priority:1;index:idx_sms_service_receptor,priority:1;index:idx_sms_service_provider,priority:1;index:idx_sms_service_created,priority:1"`
 	Service                  Service `gorm:"references:ID"`
 }
+
+type Price struct {
+	gorm.Model
+	Prefix         string      `gorm:"type:varchar(16);not null;default:'';uniqueIndex:idx_price_route"`
+	Operator       string      `gorm:"type:varchar(64);not null;default:''"`
+	ServiceType    ServiceType `gorm:"type:varchar(16);not null;uniqueIndex:idx_price_route"`
+	Provider       string      `gorm:"type:varchar(64);not null;default:'';uniqueIndex:idx_price_route"`
+	CostPerSegment uint        `gorm:"not null;default:0"`
+}
+
+// BlacklistedNumber blocks a receptor for one service, or for every service
+// when ServiceId is zero.
+type BlacklistedNumber struct {
+	gorm.Model
+	Receptor  string `gorm:"type:varchar(32);not null;uniqueIndex:idx_blacklist_receptor"`
+	ServiceId uint   `gorm:"not null;default:0;uniqueIndex:idx_blacklist_receptor"`
+}
+
+// OutboxMessage is a Kafka message committed together with the state change
+// that produced it and published later by the outbox relay.
+type OutboxMessage struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"not null"`
+	Topic     string    `gorm:"type:varchar(128);not null;default:''"`
+	Key       string    `gorm:"type:varchar(128);not null;default:''"`
+	Payload   []byte    `gorm:"not null"`
+	// Headers carries the enqueuing request's trace context to the relay.
+	Headers      map[string]string `gorm:"type:text;serializer:json"`
+	Status       OutboxStatus      `gorm:"type:varchar(16);not null;default:'pending';index:idx_outbox_status"`
+	Attempts     int               `gorm:"not null;default:0"`
+	LastError    string            `gorm:"type:varchar(512);not null;default:''"`
+	DispatchedAt *time.Time
+	// ClaimedUntil is set while a relay is publishing the row.
+	ClaimedUntil *time.Time
+}
+
+// ProviderRateLimit caps sends per second to a provider, or to one of its
+// sender numbers when Sender is set.
+type ProviderRateLimit struct {
+	gorm.Model
+	Provider      string  `gorm:"type:varchar(64);not null;uniqueIndex:idx_rate_limit_route"`
+	Sender        string  `gorm:"type:varchar(32);not null;default:'';uniqueIndex:idx_rate_limit_route"`
+	RatePerSecond float64 `gorm:"not null;default:0"`
+	Burst         uint    `gorm:"not null;default:1"`
+}
+
+// RetentionAction is what happens to messages past their service's retention
+// period once they are archived.
+type RetentionAction string
+
+const (
+	RetentionDelete    RetentionAction = "delete"
+	RetentionAnonymize RetentionAction = "anonymize"
+)
+
+// PurgeRecord is the audit trail of one retention batch.
+type PurgeRecord struct {
+	ID         uint            `gorm:"primarykey"`
+	CreatedAt  time.Time       `gorm:"not null"`
+	ServiceId  uint            `gorm:"not null;index"`
+	Action     RetentionAction `gorm:"type:varchar(16);not null"`
+	Count      int             `gorm:"not null"`
+	FirstSmsId uint            `gorm:"not null"`
+	LastSmsId  uint            `gorm:"not null"`
+	Before     time.Time       `gorm:"not null"`
+	ArchiveURI string          `gorm:"type:varchar(512);not null;default:''"`
+}
+
+type ExportStatus string
+
+const (
+	ExportPending ExportStatus = "pending"
+	ExportRunning ExportStatus = "running"
+	ExportDone    ExportStatus = "done"
+	ExportFailed  ExportStatus = "failed"
+	ExportExpired ExportStatus = "expired"
+)
+
+// ExportJob is a message export written to a file in the background. Role is
+// the requesting caller's privacy role, so the file is masked as a streamed
+// download for the same caller would be.
+type ExportJob struct {
+	ID          uint         `gorm:"primarykey"`
+	CreatedAt   time.Time    `gorm:"not null"`
+	UserId      uint         `gorm:"not null"`
+	ServiceId   uint         `gorm:"not null;index"`
+	Format      string       `gorm:"type:varchar(16);not null"`
+	Role        string       `gorm:"type:varchar(64);not null;default:''"`
+	From        time.Time    `gorm:"not null"`
+	To          time.Time    `gorm:"not null"`
+	Status      ExportStatus `gorm:"type:varchar(16);not null;default:'pending';index:idx_export_status"`
+	Rows        int64        `gorm:"not null;default:0"`
+	File        string       `gorm:"type:varchar(512);not null;default:''"`
+	Error       string       `gorm:"type:varchar(512);not null;default:''"`
+	StartedAt   *time.Time
+	HeartbeatAt *time.Time
+	CompletedAt *time.Time
+}
+
+// SmsRollup counts the messages created in one hour by service, status,
+// provider and operator. Rows are rebuilt from sms while their hour is inside
+// the rollup window and frozen after that.
+type SmsRollup struct {
+	ID        uint      `gorm:"primarykey"`
+	Bucket    time.Time `gorm:"not null;uniqueIndex:idx_rollup_key,priority:1;index:idx_rollup_service_bucket,priority:2"`
+	ServiceId uint      `gorm:"not null;uniqueIndex:idx_rollup_key,priority:2;index:idx_rollup_service_bucket,priority:1"`
+	Status    string    `gorm:"type:varchar(16);not null;uniqueIndex:idx_rollup_key,priority:3"`
+	Provider  string    `gorm:"type:varchar(64);not null;uniqueIndex:idx_rollup_key,priority:4"`
+	Operator  string    `gorm:"type:varchar(64);not null;uniqueIndex:idx_rollup_key,priority:5"`
+	Messages  int64     `gorm:"not null;default:0"`
+	Cost      int64     `gorm:"not null;default:0"`
+}
+
+// RollupState is the single row that serialises rollup passes. Hours before
+// FrozenUntil are final.
+type RollupState struct {
+	ID          uint `gorm:"primarykey"`
+	FrozenUntil *time.Time
+	RefreshedAt *time.Time
+}
+
+// QuotaCounter is a request rate or message quota counter shared by every API
+// instance. It starts over once ExpiresAt has passed.
+type QuotaCounter struct {
+	Name      string    `gorm:"type:varchar(128);primarykey"`
+	Value     int64     `gorm:"not null;default:0"`
+	ExpiresAt time.Time `gorm:"not null;index:idx_quota_counter_expires"`
+}
@@ -0,0 +1,250 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Report intervals and dimensions.
+const (
+	IntervalHour = "hour"
+	IntervalDay  = "day"
+
+	GroupService  = "service"
+	GroupStatus   = "status"
+	GroupProvider = "provider"
+	GroupOperator = "operator"
+)
+
+// succeededStatuses count towards the success rate; failed ones against it.
+var succeededStatuses = []SmsStatus{SmsStatusSent, SmsStatusDelivered}
+
+var ErrRollupBusy = errors.New("another rollup pass is running")
+
+// rollupStateID is the primary key of the only RollupState row.
+const rollupStateID = 1
+
+// RefreshRollups rebuilds the hourly rollups from the oldest unfrozen hour up
+// to the current one, at most maxHours per call, and freezes hours that are
+// older than window and hold no unsettled message, since those may still
+// change status and cost. A message unsettled for maxHours is taken to be
+// stuck and no longer holds its hour open, so the rebuilt span stays bounded.
+// It returns how many hours it rebuilt. Only one caller runs at a time; the
+// others get ErrRollupBusy.
+func (d *DataBaseWrapper) RefreshRollups(window time.Duration, maxHours int) (int, error) {
+	err := d.DBConn.Clauses(clause.OnConflict{DoNothing: true}).Create(&RollupState{ID: rollupStateID}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	rebuilt := 0
+	err = d.DBConn.Transaction(func(tx *gorm.DB) error {
+		var state RollupState
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("id = ?", rollupStateID).Limit(1).Find(&state).Error
+		if err != nil {
+			return err
+		}
+		if state.ID == 0 {
+			return ErrRollupBusy
+		}
+
+		now := time.Now().UTC()
+		current := now.Truncate(time.Hour)
+		start := current
+		if state.FrozenUntil != nil {
+			start = state.FrozenUntil.UTC()
+		} else {
+			// first pass: backfill from the oldest message
+			var oldest Sms
+			err := tx.Unscoped().Select("created_at").Order("created_at").Limit(1).Find(&oldest).Error
+			if err != nil {
+				return err
+			}
+			if !oldest.CreatedAt.IsZero() && oldest.CreatedAt.Before(current) {
+				start = oldest.CreatedAt.UTC().Truncate(time.Hour)
+			}
+		}
+
+		end := current.Add(time.Hour)
+		if limit := start.Add(time.Duration(maxHours) * time.Hour); limit.Before(end) {
+			end = limit
+		}
+		for bucket := start; bucket.Before(end); bucket = bucket.Add(time.Hour) {
+			if err := rebuildRollupHour(tx, bucket); err != nil {
+				return err
+			}
+			rebuilt++
+		}
+
+		frozen := start
+		if cutoff := now.Add(-window).Truncate(time.Hour); cutoff.After(frozen) {
+			frozen = cutoff
+		}
+		if frozen.After(end) {
+			frozen = end
+		}
+		// older unsettled messages are stuck and do not hold their hour open
+		from := start
+		if stuckBefore := current.Add(-time.Duration(maxHours-1) * time.Hour); stuckBefore.After(from) {
+			from = stuckBefore
+		}
+		var unsettled Sms
+		err = tx.Select("created_at").
+			Where("status IN ? AND created_at >= ? AND created_at < ?", unsettledStatuses, from, frozen).
+			Order("created_at").
+			Limit(1).
+			Find(&unsettled).Error
+		if err != nil {
+			return err
+		}
+		if !unsettled.CreatedAt.IsZero() {
+			frozen = unsettled.CreatedAt.UTC().Truncate(time.Hour)
+		}
+		return tx.Model(&RollupState{}).Where("id = ?", rollupStateID).
+			Updates(map[string]interface{}{"frozen_until": frozen, "refreshed_at": now}).Error
+	})
+	return rebuilt, err
+}
+
+// rebuildRollupHour replaces the rollup rows of the hour starting at bucket.
+func rebuildRollupHour(tx *gorm.DB, bucket time.Time) error {
+	if err := tx.Where("bucket = ?", bucket).Delete(&SmsRollup{}).Error; err != nil {
+		return err
+	}
+	var rows []SmsRollup
+	err := tx.Model(&Sms{}).
+		Select("service_id, status, service_provider_name AS provider, operator, COUNT(*) AS messages, COALESCE(SUM(cost), 0) AS cost").
+		Where("created_at >= ? AND created_at < ?", bucket, bucket.Add(time.Hour)).
+		Group("service_id, status, service_provider_name, operator").
+		Scan(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	for i := range rows {
+		rows[i].Bucket = bucket
+	}
+	return tx.CreateInBatches(rows, 500).Error
+}
+
+// ReportQuery selects rollups of the user's services, all of them unless
+// ServiceIds is set, created in [From, To). Interval "" sums the whole range
+// into one bucket; GroupBy takes the Group* dimensions.
+type ReportQuery struct {
+	UserId     uint
+	ServiceIds []uint
+	From       time.Time
+	To         time.Time
+	Interval   string
+	GroupBy    []string
+}
+
+// ReportRow is one bucket of a report. Dimensions not grouped by are empty.
+type ReportRow struct {
+	Bucket    *time.Time
+	ServiceId uint
+	Status    string
+	Provider  string
+	Operator  string
+	Messages  int64
+	Succeeded int64
+	Failed    int64
+	Cost      int64
+}
+
+var groupColumns = map[string]string{
+	GroupService:  "service_id",
+	GroupStatus:   "status",
+	GroupProvider: "provider",
+	GroupOperator: "operator",
+}
+
+func (d *DataBaseWrapper) ReportSms(q ReportQuery) ([]ReportRow, error) {
+	cols := make([]string, 0, len(q.GroupBy)+1)
+	if q.Interval != "" {
+		cols = append(cols, "bucket")
+	}
+	for _, g := range q.GroupBy {
+		col, ok := groupColumns[g]
+		if !ok {
+			return nil, errors.New("unknown group " + g)
+		}
+		cols = append(cols, col)
+	}
+
+	sel := "SUM(messages) AS messages, SUM(cost) AS cost, " +
+		"SUM(CASE WHEN status IN ? THEN messages ELSE 0 END) AS succeeded, " +
+		"SUM(CASE WHEN status = ? THEN messages ELSE 0 END) AS failed"
+	group := ""
+	for i, col := range cols {
+		if i > 0 {
+			group += ", "
+		}
+		group += col
+	}
+	if group != "" {
+		sel = group + ", " + sel
+	}
+
+	tx := d.DBConn.Model(&SmsRollup{}).
+		Select(sel, succeededStatuses, SmsStatusFailed).
+		Where("service_id IN (?)", d.DBConn.Model(&Service{}).Select("id").Where("user_id = ?", q.UserId)).
+		Where("bucket >= ? AND bucket < ?", q.From, q.To)
+	if len(q.ServiceIds) > 0 {
+		tx = tx.Where("service_id IN ?", q.ServiceIds)
+	}
+	if group != "" {
+		tx = tx.Group(group).Order(group)
+	}
+	var rows []ReportRow
+	if err := tx.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	if q.Interval == IntervalDay {
+		rows = foldDays(rows)
+	}
+	return rows, nil
+}
+
+// foldDays merges hourly rows into UTC days, keeping the other dimensions.
+func foldDays(rows []ReportRow) []ReportRow {
+	type key struct {
+		day       time.Time
+		serviceId uint
+		status    string
+		provider  string
+		operator  string
+	}
+	out := make([]ReportRow, 0, len(rows))
+	index := make(map[key]int)
+	for _, r := range rows {
+		day := r.Bucket.UTC().Truncate(24 * time.Hour)
+		k := key{day, r.ServiceId, r.Status, r.Provider, r.Operator}
+		i, ok := index[k]
+		if !ok {
+			r.Bucket = &day
+			r.Messages, r.Succeeded, r.Failed, r.Cost = 0, 0, 0, 0
+			out = append(out, r)
+			i = len(out) - 1
+			index[k] = i
+		}
+		out[i].Messages += r.Messages
+		out[i].Succeeded += r.Succeeded
+		out[i].Failed += r.Failed
+		out[i].Cost += r.Cost
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Bucket.Before(*out[j].Bucket) })
+	return out
+}
+
+// RollupRefreshedAt reports when the rollups were last rebuilt; nil before
+// the first pass.
+func (d *DataBaseWrapper) RollupRefreshedAt() (*time.Time, error) {
+	var state RollupState
+	err := d.DBConn.Where("id = ?", rollupStateID).Limit(1).Find(&state).Error
+	return state.RefreshedAt, err
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"postchi/pkg/redact"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// settledStatuses are final; only settled messages are purged.
+var settledStatuses = []SmsStatus{SmsStatusSent, SmsStatusDelivered, SmsStatusFailed, SmsStatusCancelled}
+
+func (d *DataBaseWrapper) UpdateServiceRetention(userId uint, serviceId uint, days uint, action RetentionAction) error {
+	result := d.DBConn.Model(&Service{}).
+		Where("id = ? AND user_id = ?", serviceId, userId).
+		Updates(map[string]interface{}{
+			"retention_days":   days,
+			"retention_action": action,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("service not found")
+	}
+	return nil
+}
+
+func (d *DataBaseWrapper) ListRetentionServices() ([]Service, error) {
+	var svcs []Service
+	err := d.DBConn.Where("retention_days > 0").Order("id").Find(&svcs).Error
+	return svcs, err
+}
+
+// purgeable matches the settled, not yet anonymized messages of a service
+// created before a cutoff.
+const purgeable = "service_id = ? AND created_at < ? AND status IN ? AND anonymized_at IS NULL"
+
+// PurgeSms reads and archives a batch without holding any lock, so a slow
+// archive upload never blocks writers, and then deletes or anonymizes the
+// rows that still qualify in a short transaction. Replicas racing on the same
+// batch write the same archive name and only one of them purges the rows; a
+// row can at worst appear in two archives, but is never purged unarchived.
+func (d *DataBaseWrapper) PurgeSms(serviceId uint, before time.Time, action RetentionAction, limit int, archive func(rows []Sms) (string, error)) (PurgeRecord, error) {
+	var rows []Sms
+	err := d.DBConn.Unscoped().
+		Where(purgeable, serviceId, before, settledStatuses).
+		Order("id").
+		Limit(limit).
+		Find(&rows).Error
+	if err != nil || len(rows) == 0 {
+		return PurgeRecord{}, err
+	}
+
+	// the archive gets plaintext and seals it under its own key, so archives
+	// never depend on content keys that rotation retires
+	for i := range rows {
+		if err := d.openSms(&rows[i]); err != nil {
+			return PurgeRecord{}, err
+		}
+		rows[i].ContentKeyID, rows[i].ContentDataKey = "", nil
+	}
+	uri, err := archive(rows)
+	if err != nil {
+		return PurgeRecord{}, err
+	}
+
+	ids := make([]uint, len(rows))
+	for i, r := range rows {
+		ids[i] = r.ID
+	}
+
+	var record PurgeRecord
+	err = d.DBConn.Transaction(func(tx *gorm.DB) error {
+		// rows purged by another replica since, or locked by one now, are left out
+		var locked []Sms
+		err := tx.Unscoped().
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Select("id", "receptor").
+			Where("id IN ?", ids).
+			Where(purgeable, serviceId, before, settledStatuses).
+			Order("id").
+			Find(&locked).Error
+		if err != nil || len(locked) == 0 {
+			return err
+		}
+
+		purged := make([]uint, len(locked))
+		for i, r := range locked {
+			purged[i] = r.ID
+		}
+		switch action {
+		case RetentionAnonymize:
+			for _, r := range locked {
+				err := tx.Unscoped().Model(&Sms{}).Where("id = ?", r.ID).
+					Updates(map[string]interface{}{
+						"receptor":         redact.Phone(r.Receptor),
+						"content":          "",
+						"content_key_id":   "",
+						"content_data_key": nil,
+						"anonymized_at":    time.Now(),
+					}).Error
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			if err := tx.Unscoped().Where("id IN ?", purged).Delete(&Sms{}).Error; err != nil {
+				return err
+			}
+		}
+
+		record = PurgeRecord{
+			ServiceId:  serviceId,
+			Action:     action,
+			Count:      len(purged),
+			FirstSmsId: purged[0],
+			LastSmsId:  purged[len(purged)-1],
+			Before:     before,
+			ArchiveURI: uri,
+		}
+		return tx.Create(&record).Error
+	})
+	return record, err
+}
+
+func (d *DataBaseWrapper) ListPurgeRecords(serviceId uint, limit int) ([]PurgeRecord, error) {
+	var records []PurgeRecord
+	err := d.DBConn.Where("service_id = ?", serviceId).Order("id DESC").Limit(limit).Find(&records).Error
+	return records, err
+}
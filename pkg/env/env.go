@@ -6,23 +6,71 @@ import (
 )
 
 type Envs struct {
-	PROMETHEUS_PORT       string
-	APP_PORT              string
-	LOG_LEVEL             string
-	KAVENEGAR_SMS_API_KEY string
-	KAVENEGAR_SMS_NUMBER  string
-	KAFKA_BROKERS         string
-	KAFKA_TOPIC_SMS       string
-	KAFKA_CONSUMER_GROUP  string
-	SMS_WORKER_COUNT      int
-	DB_DSN                string
-	COST_PER_CHAR_EXPRESS int
-	COST_PER_CHAR_ASYNC   int
+	APP_ROLE                   string
+	PROMETHEUS_PORT            string
+	APP_PORT                   string
+	LOG_LEVEL                  string
+	KAVENEGAR_SMS_API_KEY      string
+	KAVENEGAR_SMS_NUMBER       string
+	KAFKA_BROKERS              string
+	KAFKA_TOPIC_SMS            string
+	KAFKA_TOPIC_SMS_HIGH       string
+	KAFKA_TOPIC_SMS_LOW        string
+	KAFKA_CONSUMER_GROUP       string
+	SMS_WORKER_COUNT           int
+	DB_DRIVER                  string
+	DB_DSN                     string
+	COST_PER_SEGMENT_EXPRESS   int
+	COST_PER_SEGMENT_ASYNC     int
+	SMTP_ADDR                  string
+	SMTP_USERNAME              string
+	SMTP_PASSWORD              string
+	SMTP_FROM                  string
+	ALERT_SMS_PROVIDER         string
+	SMS_SENDING_TIMEOUT        int
+	SMS_LANE_WEIGHT_HIGH       int
+	SMS_LANE_WEIGHT_NORMAL     int
+	SMS_LANE_WEIGHT_LOW        int
+	SMS_PROVIDER_DEFAULT_RATE  int
+	SMS_WORKER_REPLICAS        int
+	SHUTDOWN_TIMEOUT           int
+	HEALTH_CACHE_TTL           int
+	HEALTH_MAX_CONSUMER_LAG    int
+	OTEL_EXPORTER              string
+	OTEL_EXPORTER_FILE         string
+	OTEL_SAMPLE_RATIO          string
+	LOG_REDACT_PII             bool
+	ROLE_TOKENS                string
+	PII_UNMASKED_ROLES         string
+	PII_MASK_CONTENT           string
+	CONTENT_KEY_FILE           string
+	RETENTION_INTERVAL         int
+	RETENTION_BATCH            int
+	RETENTION_ARCHIVE          string
+	RETENTION_ARCHIVE_DIR      string
+	RETENTION_ARCHIVE_KEY_FILE string
+	S3_ENDPOINT                string
+	S3_BUCKET                  string
+	S3_ACCESS_KEY              string
+	S3_SECRET_KEY              string
+	S3_USE_SSL                 bool
+	EXPORT_DIR                 string
+	EXPORT_INTERVAL            int
+	EXPORT_BATCH               int
+	EXPORT_TTL                 int
+	REPORT_ROLLUP_INTERVAL     int
+	REPORT_ROLLUP_WINDOW       int
+	QUOTA_STORE                string
+
+	// Warnings lists deprecated settings in use; they are logged once the
+	// logger is up.
+	Warnings []string
 }
 
 func ReadEnvs() Envs {
 
 	envs := Envs{}
+	envs.APP_ROLE = os.Getenv("APP_ROLE")
 	envs.APP_PORT = os.Getenv("APP_PORT")
 	envs.PROMETHEUS_PORT = os.Getenv("PROMETHEUS_PORT")
 	envs.LOG_LEVEL = os.Getenv("LOG_LEVEL")
@@ -30,8 +78,16 @@ func ReadEnvs() Envs {
 	envs.KAVENEGAR_SMS_NUMBER = os.Getenv("KAVENEGAR_SMS_NUMBER")
 	envs.KAFKA_BROKERS = os.Getenv("KAFKA_BROKERS")
 	envs.KAFKA_TOPIC_SMS = os.Getenv("KAFKA_TOPIC_SMS")
+	envs.KAFKA_TOPIC_SMS_HIGH = stringOrDefault("KAFKA_TOPIC_SMS_HIGH", envs.KAFKA_TOPIC_SMS+"_high")
+	envs.KAFKA_TOPIC_SMS_LOW = stringOrDefault("KAFKA_TOPIC_SMS_LOW", envs.KAFKA_TOPIC_SMS+"_low")
 	envs.KAFKA_CONSUMER_GROUP = os.Getenv("KAFKA_CONSUMER_GROUP")
+	envs.DB_DRIVER = os.Getenv("DB_DRIVER")
 	envs.DB_DSN = os.Getenv("DB_DSN")
+	envs.SMTP_ADDR = os.Getenv("SMTP_ADDR")
+	envs.SMTP_USERNAME = os.Getenv("SMTP_USERNAME")
+	envs.SMTP_PASSWORD = os.Getenv("SMTP_PASSWORD")
+	envs.SMTP_FROM = os.Getenv("SMTP_FROM")
+	envs.ALERT_SMS_PROVIDER = os.Getenv("ALERT_SMS_PROVIDER")
 
 	workerCount, convErr := strconv.Atoi(os.Getenv("SMS_WORKER_COUNT"))
 	if convErr != nil {
@@ -39,17 +95,102 @@ func ReadEnvs() Envs {
 	}
 	envs.SMS_WORKER_COUNT = workerCount
 
-	asyncCostperChar, convErr := strconv.Atoi(os.Getenv("COST_PER_CHAR_ASYNC"))
-	if convErr != nil {
-		panic("Failed to parse COST_PER_CHAR_ASYNC")
+	envs.COST_PER_SEGMENT_ASYNC = envs.renamedInt("COST_PER_SEGMENT_ASYNC", "COST_PER_CHAR_ASYNC")
+	envs.COST_PER_SEGMENT_EXPRESS = envs.renamedInt("COST_PER_SEGMENT_EXPRESS", "COST_PER_CHAR_EXPRESS")
+
+	envs.SMS_SENDING_TIMEOUT = intOrDefault("SMS_SENDING_TIMEOUT", 300)
+	envs.SMS_LANE_WEIGHT_HIGH = intOrDefault("SMS_LANE_WEIGHT_HIGH", 8)
+	envs.SMS_LANE_WEIGHT_NORMAL = intOrDefault("SMS_LANE_WEIGHT_NORMAL", 3)
+	envs.SMS_LANE_WEIGHT_LOW = intOrDefault("SMS_LANE_WEIGHT_LOW", 1)
+	envs.SMS_PROVIDER_DEFAULT_RATE = intOrDefault("SMS_PROVIDER_DEFAULT_RATE", 0)
+	envs.SMS_WORKER_REPLICAS = intOrDefault("SMS_WORKER_REPLICAS", 1)
+	envs.SHUTDOWN_TIMEOUT = intOrDefault("SHUTDOWN_TIMEOUT", 30)
+	envs.HEALTH_CACHE_TTL = intOrDefault("HEALTH_CACHE_TTL", 5)
+	envs.HEALTH_MAX_CONSUMER_LAG = intOrDefault("HEALTH_MAX_CONSUMER_LAG", 0)
+	envs.OTEL_EXPORTER = stringOrDefault("OTEL_EXPORTER", "none")
+	envs.OTEL_EXPORTER_FILE = stringOrDefault("OTEL_EXPORTER_FILE", "traces.json")
+	envs.OTEL_SAMPLE_RATIO = stringOrDefault("OTEL_SAMPLE_RATIO", "1")
+	envs.LOG_REDACT_PII = boolOrDefault("LOG_REDACT_PII", true)
+	envs.ROLE_TOKENS = os.Getenv("ROLE_TOKENS")
+	envs.PII_UNMASKED_ROLES = stringOrDefault("PII_UNMASKED_ROLES", "admin")
+	envs.PII_MASK_CONTENT = stringOrDefault("PII_MASK_CONTENT", "otp")
+	envs.CONTENT_KEY_FILE = os.Getenv("CONTENT_KEY_FILE")
+	envs.RETENTION_INTERVAL = intOrDefault("RETENTION_INTERVAL", 3600)
+	envs.RETENTION_BATCH = intOrDefault("RETENTION_BATCH", 1000)
+	envs.RETENTION_ARCHIVE = stringOrDefault("RETENTION_ARCHIVE", "local")
+	envs.RETENTION_ARCHIVE_DIR = stringOrDefault("RETENTION_ARCHIVE_DIR", "archive")
+	envs.RETENTION_ARCHIVE_KEY_FILE = os.Getenv("RETENTION_ARCHIVE_KEY_FILE")
+	envs.S3_ENDPOINT = os.Getenv("S3_ENDPOINT")
+	envs.S3_BUCKET = os.Getenv("S3_BUCKET")
+	envs.S3_ACCESS_KEY = os.Getenv("S3_ACCESS_KEY")
+	envs.S3_SECRET_KEY = os.Getenv("S3_SECRET_KEY")
+	envs.S3_USE_SSL = boolOrDefault("S3_USE_SSL", true)
+	envs.EXPORT_DIR = stringOrDefault("EXPORT_DIR", "exports")
+	envs.EXPORT_INTERVAL = intOrDefault("EXPORT_INTERVAL", 5)
+	envs.EXPORT_BATCH = intOrDefault("EXPORT_BATCH", 1000)
+	envs.EXPORT_TTL = intOrDefault("EXPORT_TTL", 86400)
+	envs.REPORT_ROLLUP_INTERVAL = intOrDefault("REPORT_ROLLUP_INTERVAL", 60)
+	envs.REPORT_ROLLUP_WINDOW = intOrDefault("REPORT_ROLLUP_WINDOW", 6)
+	envs.QUOTA_STORE = stringOrDefault("QUOTA_STORE", "db")
+
+	return envs
+}
+
+// ReadDbEnvs reads only the database and logging settings, for tools such as
+// cmd/migrate that must run before the services are configured. Unlike
+// ReadEnvs it requires nothing.
+func ReadDbEnvs() Envs {
+	envs := Envs{}
+	envs.LOG_LEVEL = os.Getenv("LOG_LEVEL")
+	envs.LOG_REDACT_PII = boolOrDefault("LOG_REDACT_PII", true)
+	envs.DB_DRIVER = os.Getenv("DB_DRIVER")
+	envs.DB_DSN = os.Getenv("DB_DSN")
+	return envs
+}
+
+// renamedInt reads a required integer env that used to be called old. The old
+// name is still accepted, with a warning, so existing deployments keep
+// starting after an upgrade.
+func (e *Envs) renamedInt(name string, old string) int {
+	if os.Getenv(name) == "" && os.Getenv(old) != "" {
+		e.Warnings = append(e.Warnings, old+" is deprecated and now charged per segment, not per character; set "+name+" instead")
+		name = old
+	}
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		panic("Failed to parse " + name)
 	}
-	envs.COST_PER_CHAR_ASYNC = asyncCostperChar
+	return v
+}
 
-	expressCostPerChar, convErr := strconv.Atoi(os.Getenv("COST_PER_CHAR_EXPRESS"))
-	if convErr != nil {
-		panic("Failed to parse COST_PER_CHAR_EXPRESS")
+// intOrDefault parses an optional integer env, panicking only on a malformed value.
+func intOrDefault(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil {
+		panic("Failed to parse " + name)
+	}
+	return v
+}
+
+func stringOrDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
 	}
-	envs.COST_PER_CHAR_EXPRESS = expressCostPerChar
+	return def
+}
 
-	return envs
+func boolOrDefault(name string, def bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		panic("Failed to parse " + name)
+	}
+	return v
 }
@@ -0,0 +1,117 @@
+// Package envelope encrypts values with a fresh data key each, and protects
+// the data keys with a key-encryption key held by a KeyProvider. Rotating the
+// key-encryption key only needs the small data keys rewrapped.
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+const dataKeySize = 32
+
+var ErrUnknownKey = errors.New("envelope: unknown key id")
+
+// KeyProvider wraps and unwraps data keys. A local keyfile implements it
+// today; a KMS client can implement it without changing callers.
+type KeyProvider interface {
+	// CurrentKeyID is the key new data keys are wrapped with.
+	CurrentKeyID() string
+	Wrap(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Sealed is an encrypted value with its wrapped data key and the id of the
+// key that wrapped it.
+type Sealed struct {
+	KeyID      string
+	DataKey    []byte
+	Ciphertext []byte
+}
+
+type Sealer struct {
+	Provider KeyProvider
+}
+
+func SealerInit(p KeyProvider) *Sealer {
+	return &Sealer{Provider: p}
+}
+
+func (s *Sealer) Seal(ctx context.Context, plaintext []byte) (Sealed, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return Sealed{}, err
+	}
+	ciphertext, err := gcmSeal(dataKey, plaintext)
+	if err != nil {
+		return Sealed{}, err
+	}
+	keyID, wrapped, err := s.Provider.Wrap(ctx, dataKey)
+	if err != nil {
+		return Sealed{}, err
+	}
+	return Sealed{KeyID: keyID, DataKey: wrapped, Ciphertext: ciphertext}, nil
+}
+
+func (s *Sealer) Open(ctx context.Context, sealed Sealed) ([]byte, error) {
+	dataKey, err := s.Provider.Unwrap(ctx, sealed.KeyID, sealed.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcmOpen(dataKey, sealed.Ciphertext)
+}
+
+// Rewrap moves sealed's data key under the provider's current key; the
+// ciphertext is unchanged.
+func (s *Sealer) Rewrap(ctx context.Context, sealed Sealed) (Sealed, error) {
+	dataKey, err := s.Provider.Unwrap(ctx, sealed.KeyID, sealed.DataKey)
+	if err != nil {
+		return Sealed{}, err
+	}
+	keyID, wrapped, err := s.Provider.Wrap(ctx, dataKey)
+	if err != nil {
+		return Sealed{}, err
+	}
+	return Sealed{KeyID: keyID, DataKey: wrapped, Ciphertext: sealed.Ciphertext}, nil
+}
+
+// gcmSeal encrypts with AES-GCM and prefixes the random nonce.
+func gcmSeal(key []byte, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func gcmOpen(key []byte, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("envelope: ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: decrypt failed: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,67 @@
+package envelope
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// keyFile is the on-disk format of LocalKeyProvider:
+//
+//	{"current": "2025-01", "keys": {"2024-06": "<base64 32 bytes>", "2025-01": "..."}}
+//
+// Old keys stay in the file until the rotation command has rewrapped every
+// row that uses them.
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LocalKeyProvider keeps the key-encryption keys in a local JSON file.
+type LocalKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func LoadKeyFile(path string) (*LocalKeyProvider, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keyFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("envelope: parse key file: %w", err)
+	}
+	p := &LocalKeyProvider{current: f.Current, keys: make(map[string][]byte, len(f.Keys))}
+	for id, encoded := range f.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("envelope: key %q is not base64: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("envelope: key %q must be 32 bytes, got %d", id, len(key))
+		}
+		p.keys[id] = key
+	}
+	if _, ok := p.keys[p.current]; !ok {
+		return nil, fmt.Errorf("envelope: current key %q not in key file", p.current)
+	}
+	return p, nil
+}
+
+func (p *LocalKeyProvider) CurrentKeyID() string { return p.current }
+
+func (p *LocalKeyProvider) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	wrapped, err := gcmSeal(p.keys[p.current], dataKey)
+	return p.current, wrapped, err
+}
+
+func (p *LocalKeyProvider) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	return gcmOpen(key, wrapped)
+}
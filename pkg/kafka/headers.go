@@ -0,0 +1,60 @@
+package kafka
+
+import (
+	"context"
+
+	kafka "github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// HeaderCarrier adapts Kafka message headers to the OpenTelemetry propagator.
+type HeaderCarrier struct {
+	Headers *[]kafka.Header
+}
+
+func (h HeaderCarrier) Get(key string) string {
+	for _, hd := range *h.Headers {
+		if hd.Key == key {
+			return string(hd.Value)
+		}
+	}
+	return ""
+}
+
+func (h HeaderCarrier) Set(key string, value string) {
+	for i, hd := range *h.Headers {
+		if hd.Key == key {
+			(*h.Headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*h.Headers = append(*h.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (h HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(*h.Headers))
+	for _, hd := range *h.Headers {
+		keys = append(keys, hd.Key)
+	}
+	return keys
+}
+
+// ExtractContext returns ctx carrying the trace context stored in msg's headers.
+func ExtractContext(ctx context.Context, msg kafka.Message) context.Context {
+	headers := msg.Headers
+	return otel.GetTextMapPropagator().Extract(ctx, HeaderCarrier{Headers: &headers})
+}
+
+// InjectHeaders returns the trace context of ctx as plain key/value pairs,
+// for carrying it through storage such as the outbox.
+func InjectHeaders(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// ContextFromHeaders is the inverse of InjectHeaders.
+func ContextFromHeaders(ctx context.Context, headers map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(headers))
+}
@@ -3,10 +3,22 @@ package kafka
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	kafka "github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
 )
 
 type SmsKafkaMessage struct {
@@ -16,12 +28,34 @@ type SmsKafkaMessage struct {
 	Provider  string `json:"provider"`
 	UserId    uint   `json:"user_id"`
 	ServiceId uint   `json:"service_id"`
+	Cost      uint   `json:"cost"`
+	Attempts  int    `json:"attempts"`
+	Priority  string `json:"priority"`
+	// Delivered marks a message the provider already accepted whose result
+	// could not be stored; the consumer only captures its credit.
+	Delivered         bool `json:"delivered,omitempty"`
+	ProviderMessageId int  `json:"provider_message_id,omitempty"`
+	// NotBefore delays a retried send until this unix time in milliseconds.
+	NotBefore int64 `json:"not_before,omitempty"`
 }
 
 type KafkaInterface interface {
 	Publish(ctx context.Context, key string, value []byte) error
-	ReadMessage(ctx context.Context) (*kafka.Message, error)
+	// PublishTopic publishes to topic instead of the client's default topic.
+	PublishTopic(ctx context.Context, topic string, key string, value []byte) error
+	// FetchMessage returns the next message without committing its offset.
+	FetchMessage(ctx context.Context) (*kafka.Message, error)
+	// CommitMessages commits the offsets of msgs for the reader's group.
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
 	UseReader(groupID string) error
+	// Ping connects to a broker and returns the partition count of each topic,
+	// failing if a topic does not exist.
+	Ping(ctx context.Context, topics ...string) (map[string]int, error)
+	// Lag is the reader's last observed consumer lag, or -1 without a reader.
+	Lag() int64
+	// Rebalances is how many consumer group rebalances the reader has gone
+	// through so far.
+	Rebalances() int64
 	Close() error
 }
 
@@ -30,6 +64,10 @@ type Client struct {
 	topic   string
 	writer  *kafka.Writer
 	reader  *kafka.Reader
+
+	// Stats resets the reader's counters on every call, so they are summed here
+	statsMu    sync.Mutex
+	rebalances int64
 }
 
 func Init(brokers string, topic string) (KafkaInterface, error) {
@@ -40,7 +78,6 @@ func Init(brokers string, topic string) (KafkaInterface, error) {
 		topic:   topic,
 		writer: &kafka.Writer{
 			Addr:         kafka.TCP(bs...),
-			Topic:        topic,
 			Balancer:     &kafka.Hash{},
 			RequiredAcks: kafka.RequireOne,
 			Async:        false,
@@ -80,24 +117,118 @@ func (c *Client) Close() error {
 }
 
 func (c *Client) Publish(ctx context.Context, key string, value []byte) error {
-	return c.writer.WriteMessages(ctx, kafka.Message{
+	return c.PublishTopic(ctx, c.topic, key, value)
+}
+
+// PublishTopic writes one message inside a producer span whose context is
+// injected into the message headers for the consumer to continue.
+func (c *Client) PublishTopic(ctx context.Context, topic string, key string, value []byte) error {
+	ctx, span := otel.Tracer("postchi/kafka").Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingDestinationName(topic),
+			semconv.MessagingKafkaMessageKey(key),
+		))
+	defer span.End()
+
+	msg := kafka.Message{
+		Topic: topic,
 		Key:   []byte(key),
 		Value: value,
 		Time:  time.Now(),
-	})
+	}
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier{Headers: &msg.Headers})
+
+	err := c.writer.WriteMessages(ctx, msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
 }
 
-func (c *Client) ReadMessage(ctx context.Context) (*kafka.Message, error) {
+func (c *Client) FetchMessage(ctx context.Context) (*kafka.Message, error) {
 	if c.reader == nil {
 		return nil, errors.New("kafka: reader not initialized; call UseReader(groupID)")
 	}
-	m, err := c.reader.ReadMessage(ctx)
+	m, err := c.reader.FetchMessage(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return &m, nil
 }
 
+func (c *Client) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if c.reader == nil {
+		return errors.New("kafka: reader not initialized; call UseReader(groupID)")
+	}
+	return c.reader.CommitMessages(ctx, msgs...)
+}
+
+func (c *Client) Ping(ctx context.Context, topics ...string) (map[string]int, error) {
+	if len(c.brokers) == 0 {
+		return nil, errors.New("kafka: no brokers configured")
+	}
+	var conn *kafka.Conn
+	var err error
+	for _, b := range c.brokers {
+		conn, err = kafka.DialContext(ctx, "tcp", b)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	partitions, err := conn.ReadPartitions(topics...)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(topics))
+	for _, t := range topics {
+		counts[t] = 0
+	}
+	for _, p := range partitions {
+		counts[p.Topic]++
+	}
+	for t, n := range counts {
+		if n == 0 {
+			return counts, fmt.Errorf("kafka: topic %q has no partitions", t)
+		}
+	}
+	return counts, nil
+}
+
+func (c *Client) Lag() int64 {
+	if c.reader == nil {
+		return -1
+	}
+	lag, _ := c.readStats()
+	return lag
+}
+
+func (c *Client) Rebalances() int64 {
+	if c.reader == nil {
+		return 0
+	}
+	_, rebalances := c.readStats()
+	return rebalances
+}
+
+func (c *Client) readStats() (lag int64, rebalances int64) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	stats := c.reader.Stats()
+	c.rebalances += stats.Rebalances
+	return stats.Lag, c.rebalances
+}
+
 func splitBrokers(s string) []string {
 	parts := strings.Split(s, ",")
 	out := make([]string, 0, len(parts))
@@ -1,10 +1,14 @@
 package logger
 
 import (
+	"context"
+	"fmt"
 	"postchi/pkg/env"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 type ElasticLog struct {
@@ -14,35 +18,91 @@ type ElasticLog struct {
 	Timestamp      time.Time
 }
 
-type Logger struct {
-	Log *zap.Logger
-	env *env.Envs
-}
+// Field is a typed key/value attached to a log entry.
+type Field = zap.Field
+
+var (
+	String   = zap.String
+	Int      = zap.Int
+	Int64    = zap.Int64
+	Uint     = zap.Uint
+	Duration = zap.Duration
+	Any      = zap.Any
+)
+
+func Err(err error) Field { return zap.Error(err) }
+
+func UserID(id uint) Field       { return zap.Uint("user_id", id) }
+func ServiceID(id uint) Field    { return zap.Uint("service_id", id) }
+func SmsID(id uint) Field        { return zap.Uint("sms_id", id) }
+func Provider(name string) Field { return zap.String("provider", name) }
+func RequestID(id string) Field  { return zap.String("request_id", id) }
 
 type LoggerInterface interface {
-	StdLog(level string, message string)
+	Debug(message string, fields ...Field)
+	Info(message string, fields ...Field)
+	Warn(message string, fields ...Field)
+	Error(message string, fields ...Field)
+	// With returns a logger that adds fields to every entry.
+	With(fields ...Field) LoggerInterface
+	// Ctx returns a logger that adds the request and trace ids found in ctx.
+	Ctx(ctx context.Context) LoggerInterface
+	Sync() error
 }
 
+type Logger struct {
+	Log *zap.Logger
+}
+
+// Init builds a JSON logger at LOG_LEVEL (debug, info, warn or error;
+// default info). With LOG_REDACT_PII phone numbers and message bodies are
+// masked in every entry.
 func Init(envs *env.Envs) (LoggerInterface, error) {
-	logger := Logger{env: envs}
-	var err error
-	logger.Log, err = zap.NewProduction()
+	level := zapcore.InfoLevel
+	if envs.LOG_LEVEL != "" {
+		var err error
+		level, err = zapcore.ParseLevel(envs.LOG_LEVEL)
+		if err != nil {
+			return nil, fmt.Errorf("logger: invalid LOG_LEVEL %q: %w", envs.LOG_LEVEL, err)
+		}
+	}
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(level)
+	cfg.EncoderConfig.TimeKey = "time"
+	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	opts := []zap.Option{zap.AddCallerSkip(1)}
+	if envs.LOG_REDACT_PII {
+		opts = append(opts, zap.WrapCore(func(c zapcore.Core) zapcore.Core { return redactingCore{c} }))
+	}
+	log, err := cfg.Build(opts...)
 	if err != nil {
 		return nil, err
 	}
+	return &Logger{Log: log}, nil
+}
 
-	return &logger, nil
+func (l *Logger) Debug(message string, fields ...Field) { l.Log.Debug(message, fields...) }
+func (l *Logger) Info(message string, fields ...Field)  { l.Log.Info(message, fields...) }
+func (l *Logger) Warn(message string, fields ...Field)  { l.Log.Warn(message, fields...) }
+func (l *Logger) Error(message string, fields ...Field) { l.Log.Error(message, fields...) }
+
+func (l *Logger) With(fields ...Field) LoggerInterface {
+	return &Logger{Log: l.Log.With(fields...)}
 }
 
-func (logger *Logger) StdLog(level string, message string) {
-	switch {
-	case level == "info" && (logger.env.LOG_LEVEL == "info"):
-		logger.Log.Info(message)
-	case level == "warn":
-		logger.Log.Warn(message)
-	case level == "error":
-		logger.Log.Info(message)
-	case level == "panic":
-		logger.Log.Panic(message)
+func (l *Logger) Ctx(ctx context.Context) LoggerInterface {
+	var fields []Field
+	if id := RequestIDFromContext(ctx); id != "" {
+		fields = append(fields, RequestID(id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields = append(fields, zap.String("trace_id", sc.TraceID().String()))
 	}
+	if len(fields) == 0 {
+		return l
+	}
+	return l.With(fields...)
 }
+
+func (l *Logger) Sync() error { return l.Log.Sync() }
@@ -0,0 +1,56 @@
+package logger
+
+import (
+	"postchi/pkg/redact"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// phoneKeys and contentKeys name the fields that carry personal data.
+var (
+	phoneKeys   = map[string]bool{"to": true, "receptor": true, "receptors": true, "phone": true}
+	contentKeys = map[string]bool{"content": true, "text": true, "message_body": true}
+)
+
+// redactingCore masks phone numbers and drops message bodies before entries
+// reach the encoder, whatever the call site passed in.
+type redactingCore struct {
+	zapcore.Core
+}
+
+func (r redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{r.Core.With(redactFields(fields))}
+}
+
+func (r redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if r.Enabled(ent.Level) {
+		return ce.AddCore(ent, r)
+	}
+	return ce
+}
+
+func (r redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = redact.Text(ent.Message)
+	return r.Core.Write(ent, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		switch {
+		case contentKeys[f.Key]:
+			f = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: redact.Hidden}
+		case f.Type == zapcore.StringType && phoneKeys[f.Key]:
+			f.String = redact.Phone(f.String)
+		case f.Type == zapcore.StringType:
+			f.String = redact.Text(f.String)
+		case f.Type == zapcore.ErrorType:
+			// provider errors may echo the receptor back
+			if err, ok := f.Interface.(error); ok {
+				f = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: redact.Text(err.Error())}
+			}
+		}
+		out[i] = f
+	}
+	return out
+}
@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// RequestIDHeader carries the request id on HTTP requests and Kafka messages.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDPropagator moves the request id through any text map carrier. It
+// is installed next to the trace propagators, so the id follows a message
+// through the outbox and Kafka headers into the worker.
+type RequestIDPropagator struct{}
+
+func (RequestIDPropagator) Inject(ctx context.Context, carrier propagation.TextMapCarrier) {
+	if id := RequestIDFromContext(ctx); id != "" {
+		carrier.Set(RequestIDHeader, id)
+	}
+}
+
+func (RequestIDPropagator) Extract(ctx context.Context, carrier propagation.TextMapCarrier) context.Context {
+	if id := carrier.Get(RequestIDHeader); id != "" {
+		return WithRequestID(ctx, id)
+	}
+	return ctx
+}
+
+func (RequestIDPropagator) Fields() []string { return []string{RequestIDHeader} }
+
+// RequestIDMiddleware keeps the caller's X-Request-ID or generates one,
+// echoes it on the response and stores it in the request's user context.
+func RequestIDMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = uuid.NewString()
+		}
+		c.Set(RequestIDHeader, id)
+		c.SetUserContext(WithRequestID(c.UserContext(), id))
+		return c.Next()
+	}
+}
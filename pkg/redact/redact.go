@@ -0,0 +1,38 @@
+package redact
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Hidden replaces content that must not be shown.
+const Hidden = "[hidden]"
+
+// phonePattern matches Iranian mobile numbers in local (09..), national
+// (989..) and international (+989.., 00989..) form.
+var phonePattern = regexp.MustCompile(`(?:\+|00)?(?:98|0)9\d{9}`)
+
+var (
+	otpKeywords = regexp.MustCompile(`(?i)\b(otp|code|verification|verify|passcode|password|pin)\b|کد|رمز`)
+	otpCode     = regexp.MustCompile(`(?:^|\D)\d{4,8}(?:\D|$)`)
+)
+
+// Phone keeps the first four and last four digits of a phone number, e.g.
+// 09121234567 -> 0912***4567. Short values are fully masked.
+func Phone(phone string) string {
+	if len(phone) < 9 {
+		return strings.Repeat("*", len(phone))
+	}
+	return phone[:4] + "***" + phone[len(phone)-4:]
+}
+
+// Text masks every phone number found in s.
+func Text(s string) string {
+	return phonePattern.ReplaceAllStringFunc(s, Phone)
+}
+
+// LooksLikeOtp reports whether text reads like a one-time code: a 4 to 8
+// digit number next to a code/password keyword.
+func LooksLikeOtp(text string) bool {
+	return otpKeywords.MatchString(text) && otpCode.MatchString(text)
+}